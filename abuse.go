@@ -0,0 +1,479 @@
+//go:build !wasm
+
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/0magnet/cart/pow"
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v80"
+	"github.com/stripe/stripe-go/v80/charge"
+	"github.com/stripe/stripe-go/v80/paymentintent"
+)
+
+// challengeTTL is how long a proof of work challenge may take to solve.
+const challengeTTL = 10 * time.Minute
+
+// attempt is one charge made against a payment intent: one card tried.
+type attempt struct {
+	ID     string
+	Card   string // the card's fingerprint, the same for the same card number
+	Failed bool
+}
+
+// intentCharges asks Stripe, with the secret key key, for the charges made
+// against a payment intent, and whether one succeeded, after which no more
+// can be. Tests replace it.
+var intentCharges = func(key, id string) (attempts []attempt, settled bool, err error) {
+	charges := charge.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+	it := charges.List(&stripe.ChargeListParams{PaymentIntent: stripe.String(id)})
+	for it.Next() {
+		ch := it.Charge()
+		a := attempt{ID: ch.ID, Failed: ch.Status == stripe.ChargeStatusFailed}
+		if d := ch.PaymentMethodDetails; d != nil && d.Card != nil {
+			a.Card = d.Card.Fingerprint
+		}
+		settled = settled || ch.Status == stripe.ChargeStatusSucceeded
+		attempts = append(attempts, a)
+	}
+	return attempts, settled, it.Err()
+}
+
+// cancelIntent cancels a payment intent, with the secret key key, so that
+// its client secret can try no more cards. Tests replace it.
+var cancelIntent = func(key, id string) error {
+	intents := paymentintent.Client{B: stripe.GetBackend(stripe.APIBackend), Key: key}
+	_, err := intents.Cancel(id, &stripe.PaymentIntentCancelParams{CancellationReason: stripe.String(string(stripe.PaymentIntentCancellationReasonFraudulent))})
+	return err
+}
+
+// slidingWindow counts what happened to each key within the last d.
+type slidingWindow struct {
+	d    time.Duration
+	hits map[string][]time.Time
+}
+
+func newSlidingWindow(d time.Duration) *slidingWindow {
+	return &slidingWindow{d: d, hits: map[string][]time.Time{}}
+}
+
+func (w *slidingWindow) add(key string, now time.Time) {
+	w.hits[key] = append(w.hits[key], now)
+}
+
+// count is how many hits key has had within the window, and when the oldest
+// of them leaves it.
+func (w *slidingWindow) count(key string, now time.Time) (int, time.Time) {
+	hits := w.hits[key]
+	i := 0
+	for i < len(hits) && now.Sub(hits[i]) >= w.d {
+		i++
+	}
+	if hits = hits[i:]; len(hits) == 0 {
+		delete(w.hits, key)
+		return 0, now
+	}
+	w.hits[key] = hits
+	return len(hits), hits[0].Add(w.d)
+}
+
+// prune forgets the keys with no hits left in the window.
+func (w *slidingWindow) prune(now time.Time) {
+	for key := range w.hits {
+		w.count(key, now)
+	}
+}
+
+// openIntent is a payment intent created for a client that has not yet
+// succeeded: one that cards may still be tried against.
+type openIntent struct {
+	id, ip, session string
+	created         time.Time
+	reviewed        time.Time // when Stripe was last asked about it
+}
+
+// reviewEvery is how long what Stripe said about an intent stands before it
+// is asked again, and reviewBatch the most intents asked about for one
+// request. Between them they bound the Stripe requests a client can cause,
+// however fast it asks for intents.
+const (
+	reviewEvery = 30 * time.Second
+	reviewBatch = 3
+)
+
+// guard decides who may create payment intents. An endpoint that makes them
+// for any amount is what card testing bots look for, to try stolen card
+// numbers against one at a time, so it is limited four ways:
+//
+//   - INTENTSPERIP and INTENTSPERSESSION cap the intents made for one IP or
+//     one browser session within INTENTWINDOW
+//   - POWBITS asks for a proof of work with each one
+//   - FAILEDPAYMENTS caps the failed charges one IP, session or card may
+//     have within INTENTWINDOW; past it the client is refused and its open
+//     intents are cancelled
+//   - BLOCKLIST refuses addresses and cards outright
+//
+// Each decision is logged, with the IP and session, for review. A guard
+// looks after one Stripe account, whose secret key it asks about charges
+// with.
+type guard struct {
+	key                                     string
+	perIP, perSession, maxFailures, powBits int
+	window                                  time.Duration
+	blocklist                               *blocklist
+
+	mu        sync.Mutex
+	intents   *slidingWindow // intents made, by "ip " or "session " key
+	failures  *slidingWindow // failed charges, by "ip ", "session " or "card " key
+	cards     map[string]map[string]time.Time
+	open      []openIntent
+	counted   map[string]time.Time // the failed charges already counted
+	used      map[string]time.Time // the challenges already solved
+	lastSweep time.Time
+}
+
+func newGuard(key string) *guard {
+	g := &guard{
+		key:   key,
+		perIP: f.IntentsPerIP, perSession: f.IntentsPerSession, maxFailures: f.FailedPayments, powBits: f.PoWBits,
+		window:   f.IntentWindow,
+		intents:  newSlidingWindow(f.IntentWindow),
+		failures: newSlidingWindow(f.IntentWindow),
+		cards:    map[string]map[string]time.Time{},
+		counted:  map[string]time.Time{},
+		used:     map[string]time.Time{},
+	}
+	if f.Blocklist != "" {
+		g.blocklist = &blocklist{path: f.Blocklist}
+	}
+	return g
+}
+
+// client is who a request comes from: its IP, and its session if it has one.
+// Pages from CORSORIGINS have none, and are limited by IP alone.
+func client(c *gin.Context) (ip, session string) {
+	session, _ = c.Cookie(sessionCookie) //nolint:errcheck // no cookie is no session
+	return clientIP(c), session
+}
+
+// keys are the window keys of a client.
+func keys(ip, session string) []string {
+	if session == "" {
+		return []string{"ip " + ip}
+	}
+	return []string{"ip " + ip, "session " + session}
+}
+
+// logged is a client as the log names it, followed by more fields: the
+// session by a prefix only, enough to follow it through the log.
+func logged(ip, session string, fields ...any) []any {
+	if session != "" {
+		fields = append([]any{"session", session[:min(8, len(session))]}, fields...)
+	}
+	return append([]any{"ip", ip}, fields...)
+}
+
+// check is the middleware in front of /create-payment-intent.
+func (g *guard) check(c *gin.Context) {
+	ip, session := client(c)
+	ctx := c.Request.Context()
+	g.review(ctx, ip, session)
+
+	now := time.Now()
+	g.mu.Lock()
+	g.sweep(now)
+	reason := g.blocklist.blocked(ip, g.cardsOf(ip, session))
+	if reason == "" {
+		reason = g.tooManyFailures(ip, session, now)
+	}
+	var retry time.Time
+	var open []string
+	if reason != "" {
+		open = g.closeOpen(ip, session)
+	} else {
+		reason, retry = g.tooManyIntents(ip, session, now)
+	}
+	g.mu.Unlock()
+
+	switch {
+	case reason != "" && retry.IsZero():
+		for _, id := range open {
+			if err := cancelIntent(g.key, id); err != nil {
+				slog.ErrorContext(ctx, "Abuse: could not cancel payment intent", logged(ip, session, "payment_intent", id, "err", err)...)
+				continue
+			}
+			slog.WarnContext(ctx, "Abuse: cancelled payment intent", logged(ip, session, "payment_intent", id)...)
+		}
+		slog.WarnContext(ctx, "Abuse: refused a payment intent", logged(ip, session, "reason", reason)...)
+		c.AbortWithStatusJSON(http.StatusForbidden, errorBody(c, "checkout is not available: contact the shop"))
+	case reason != "":
+		slog.WarnContext(ctx, "Abuse: refused a payment intent", logged(ip, session, "reason", reason)...)
+		c.Writer.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(retry).Seconds()))))
+		c.AbortWithStatusJSON(http.StatusTooManyRequests, errorBody(c, "too many checkouts: try again later"))
+	case g.powBits > 0:
+		challenge, solution := c.GetHeader(pow.ChallengeHeader), c.GetHeader(pow.SolutionHeader)
+		reason = "a proof of work is required"
+		if challenge != "" {
+			if reason = g.checkProof(challenge, solution, now); reason == "" {
+				return
+			}
+			slog.WarnContext(ctx, "Abuse: refused a payment intent", logged(ip, session, "reason", reason)...)
+		}
+		body := errorBody(c, reason)
+		body["challenge"], body["bits"] = g.challenge(now), g.powBits
+		c.AbortWithStatusJSON(http.StatusPreconditionRequired, body)
+	}
+}
+
+// created records a payment intent made for the request's client.
+func (g *guard) created(c *gin.Context, id string) {
+	ip, session := client(c)
+	now := time.Now()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	for _, key := range keys(ip, session) {
+		g.intents.add(key, now)
+	}
+	if g.maxFailures > 0 {
+		g.open = append(g.open, openIntent{id: id, ip: ip, session: session, created: now})
+	}
+	slog.InfoContext(c.Request.Context(), "Abuse: allowed payment intent", logged(ip, session, "payment_intent", id)...)
+}
+
+// review asks Stripe how the client's open intents have gone and counts
+// their failed charges against the client and the cards tried. It runs
+// before each new intent the client asks for, which is when it matters, and
+// asks only about the client's own intents, each at most once every
+// reviewEvery and no more than reviewBatch of them at a time, oldest first.
+func (g *guard) review(ctx context.Context, ip, session string) {
+	if g.maxFailures == 0 {
+		return
+	}
+	asked := time.Now()
+	g.mu.Lock()
+	var mine []openIntent
+	for i := range g.open {
+		o := &g.open[i]
+		if len(mine) < reviewBatch && (o.ip == ip || (session != "" && o.session == session)) && asked.Sub(o.reviewed) >= reviewEvery {
+			o.reviewed = asked
+			mine = append(mine, *o)
+		}
+	}
+	g.mu.Unlock()
+
+	for _, o := range mine {
+		attempts, settled, err := intentCharges(g.key, o.id)
+		if err != nil {
+			slog.ErrorContext(ctx, "Abuse: could not review payment intent", "payment_intent", o.id, "err", err)
+			continue
+		}
+		now := time.Now()
+		g.mu.Lock()
+		for _, a := range attempts {
+			if a.Card != "" {
+				for _, key := range keys(o.ip, o.session) {
+					if g.cards[key] == nil {
+						g.cards[key] = map[string]time.Time{}
+					}
+					g.cards[key][a.Card] = now
+				}
+			}
+			if !a.Failed || !g.counted[a.ID].IsZero() {
+				continue
+			}
+			g.counted[a.ID] = now
+			for _, key := range keys(o.ip, o.session) {
+				g.failures.add(key, now)
+			}
+			if a.Card != "" {
+				g.failures.add("card "+a.Card, now)
+			}
+			slog.WarnContext(ctx, "Abuse: failed charge", logged(o.ip, o.session, "payment_intent", o.id, "charge", a.ID, "card", a.Card)...)
+		}
+		if settled {
+			g.forget(o.id)
+		}
+		g.mu.Unlock()
+	}
+}
+
+// cardsOf are the cards the client has tried within the window.
+func (g *guard) cardsOf(ip, session string) []string {
+	var cards []string
+	for _, key := range keys(ip, session) {
+		for card := range g.cards[key] {
+			cards = append(cards, card)
+		}
+	}
+	return cards
+}
+
+func (g *guard) tooManyFailures(ip, session string, now time.Time) string {
+	if g.maxFailures == 0 {
+		return ""
+	}
+	for _, key := range keys(ip, session) {
+		if n, _ := g.failures.count(key, now); n >= g.maxFailures {
+			return fmt.Sprintf("%d failed payments from %s", n, key)
+		}
+	}
+	for _, card := range g.cardsOf(ip, session) {
+		if n, _ := g.failures.count("card "+card, now); n >= g.maxFailures {
+			return fmt.Sprintf("%d failed payments with card %s", n, card)
+		}
+	}
+	return ""
+}
+
+func (g *guard) tooManyIntents(ip, session string, now time.Time) (string, time.Time) {
+	for _, key := range keys(ip, session) {
+		limit := g.perIP
+		if strings.HasPrefix(key, "session ") {
+			limit = g.perSession
+		}
+		if limit == 0 {
+			continue
+		}
+		if n, retry := g.intents.count(key, now); n >= limit {
+			return fmt.Sprintf("%d payment intents from %s within %s", n, key, g.window), retry
+		}
+	}
+	return "", time.Time{}
+}
+
+// closeOpen stops following the client's open intents and returns them, to
+// be cancelled.
+func (g *guard) closeOpen(ip, session string) []string {
+	var ids []string
+	kept := g.open[:0]
+	for _, o := range g.open {
+		if o.ip == ip || (session != "" && o.session == session) {
+			ids = append(ids, o.id)
+		} else {
+			kept = append(kept, o)
+		}
+	}
+	g.open = kept
+	return ids
+}
+
+// settled stops following an intent that has been paid, which no more cards
+// can be tried against, without asking Stripe again.
+func (g *guard) settled(id string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.forget(id)
+}
+
+func (g *guard) forget(id string) {
+	g.open = slices.DeleteFunc(g.open, func(o openIntent) bool { return o.id == id })
+}
+
+// sweep drops, once a minute, what has left the window: intents too old to
+// be followed, the cards clients tried, the charges counted and the
+// challenges used.
+func (g *guard) sweep(now time.Time) {
+	if now.Sub(g.lastSweep) < time.Minute {
+		return
+	}
+	g.lastSweep = now
+	g.intents.prune(now)
+	g.failures.prune(now)
+	g.open = slices.DeleteFunc(g.open, func(o openIntent) bool { return now.Sub(o.created) >= g.window })
+	for key, cards := range g.cards {
+		for card, seen := range cards {
+			if now.Sub(seen) >= g.window {
+				delete(cards, card)
+			}
+		}
+		if len(cards) == 0 {
+			delete(g.cards, key)
+		}
+	}
+	for id, seen := range g.counted {
+		if now.Sub(seen) >= g.window {
+			delete(g.counted, id)
+		}
+	}
+	for challenge, expires := range g.used {
+		if now.After(expires) {
+			delete(g.used, challenge)
+		}
+	}
+}
+
+// challenge makes a proof of work challenge: the difficulty and time it was
+// made, a random part, and a signature over them, so that the server need
+// keep nothing until it is solved.
+func (g *guard) challenge(now time.Time) string {
+	payload := fmt.Sprintf("%d.%d.%s", g.powBits, now.Unix(), rand.Text())
+	return payload + "." + sign(payload)
+}
+
+func sign(payload string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte("pow " + payload)) //nolint:errcheck,gosec // a hash.Hash cannot fail to write
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// checkProof tells what is wrong with a solved challenge, or "" if nothing
+// is. Each challenge is good for one intent.
+func (g *guard) checkProof(challenge, solution string, now time.Time) string {
+	i := strings.LastIndexByte(challenge, '.')
+	if i < 0 || !hmac.Equal([]byte(challenge[i+1:]), []byte(sign(challenge[:i]))) {
+		return "the proof of work challenge is not one this server made"
+	}
+	parts := strings.SplitN(challenge[:i], ".", 3)
+	made, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || now.Sub(time.Unix(made, 0)) > challengeTTL {
+		return "the proof of work challenge has expired"
+	}
+	if parts[0] != strconv.Itoa(g.powBits) || !pow.Check(challenge, solution, g.powBits) {
+		return "the proof of work is wrong"
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if _, ok := g.used[challenge]; ok {
+		return "the proof of work challenge has been used"
+	}
+	g.used[challenge] = time.Unix(made, 0).Add(challengeTTL)
+	return ""
+}
+
+// checkGuard reports the abuse settings that make no sense.
+func checkGuard() []error {
+	var errs []error
+	for _, n := range []*int{&f.IntentsPerIP, &f.IntentsPerSession, &f.FailedPayments} {
+		if *n < 0 {
+			errs = append(errs, fmt.Errorf("%s: %d is not a limit; 0 is none", ccc(n, &f, a), *n))
+		}
+	}
+	if f.IntentWindow <= 0 {
+		errs = append(errs, fmt.Errorf("INTENTWINDOW: %v is not a window; it has to be more than 0", f.IntentWindow))
+	}
+	// Each bit doubles the work: 20 is a million hashes, a second or so in a
+	// browser, and 28 already minutes.
+	if f.PoWBits < 0 || f.PoWBits > 28 {
+		errs = append(errs, fmt.Errorf("POWBITS: %d is not a difficulty from 0 to 28", f.PoWBits))
+	}
+	if f.Blocklist != "" {
+		if _, _, err := parseBlocklist(f.Blocklist); err != nil {
+			errs = append(errs, fmt.Errorf("BLOCKLIST: %w", err))
+		}
+	}
+	return errs
+}
@@ -0,0 +1,329 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/0magnet/cart/pow"
+	"github.com/gin-gonic/gin"
+)
+
+// guarded is /create-payment-intent behind g, making intents pi_1, pi_2, …
+func guarded(g *guard) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	initCSRFKey()
+	n := 0
+	r := gin.New()
+	r.POST("/create-payment-intent", g.check, func(c *gin.Context) {
+		n++
+		id := fmt.Sprintf("pi_%d", n)
+		g.created(c, id)
+		c.JSON(http.StatusOK, gin.H{"id": id})
+	})
+	return r
+}
+
+// checkout asks for an intent from ip, in session if it is not "", with
+// headers on top.
+func checkout(r *gin.Engine, ip, session string, headers ...string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/create-payment-intent", strings.NewReader(`{"items": []}`))
+	req.RemoteAddr = ip + ":1234"
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	}
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// testGuard is a guard with the given limits and no others.
+func testGuard(t *testing.T, perIP, perSession, maxFailures, powBits int) *guard {
+	t.Helper()
+	saved := f
+	t.Cleanup(func() { f = saved })
+	f.IntentsPerIP, f.IntentsPerSession, f.FailedPayments, f.PoWBits, f.IntentWindow, f.Blocklist = perIP, perSession, maxFailures, powBits, time.Hour, ""
+	return newGuard("")
+}
+
+// stripeSays makes intentCharges answer from charges, by intent, and records
+// what cancelIntent is asked to cancel.
+func stripeSays(t *testing.T, charges map[string][]attempt) *[]string {
+	t.Helper()
+	savedCharges, savedCancel := intentCharges, cancelIntent
+	t.Cleanup(func() { intentCharges, cancelIntent = savedCharges, savedCancel })
+	intentCharges = func(_, id string) ([]attempt, bool, error) { return charges[id], false, nil }
+	var cancelled []string
+	cancelIntent = func(_, id string) error {
+		cancelled = append(cancelled, id)
+		return nil
+	}
+	return &cancelled
+}
+
+// ── rate limits ──────────────────────────────────────────────────────────────
+
+func TestIntentsAreLimitedPerIPAndPerSession(t *testing.T) {
+	r := guarded(testGuard(t, 3, 2, 0, 0))
+	for i := range 2 {
+		if w := checkout(r, "203.0.113.1", "SESSIONAAAAAAAAAAAAAAAAAAA"); w.Code != http.StatusOK {
+			t.Fatalf("intent %d: %d", i+1, w.Code)
+		}
+	}
+	w := checkout(r, "203.0.113.1", "SESSIONAAAAAAAAAAAAAAAAAAA")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "3600" {
+		t.Errorf("a third intent in the session: %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	// A new session does not get around the limit on the IP.
+	if w := checkout(r, "203.0.113.1", "SESSIONBBBBBBBBBBBBBBBBBBB"); w.Code != http.StatusOK {
+		t.Errorf("a new session: %d", w.Code)
+	}
+	if w := checkout(r, "203.0.113.1", "SESSIONCCCCCCCCCCCCCCCCCCC"); w.Code != http.StatusTooManyRequests {
+		t.Errorf("a fourth intent from the IP: %d", w.Code)
+	}
+	if w := checkout(r, "203.0.113.2", ""); w.Code != http.StatusOK {
+		t.Errorf("another IP: %d", w.Code)
+	}
+}
+
+func TestTheWindowSlides(t *testing.T) {
+	w := newSlidingWindow(time.Hour)
+	start := time.Now()
+	w.add("ip 1", start)
+	w.add("ip 1", start.Add(30*time.Minute))
+	if n, retry := w.count("ip 1", start.Add(59*time.Minute)); n != 2 || !retry.Equal(start.Add(time.Hour)) {
+		t.Errorf("count = %d, retry at %v", n, retry.Sub(start))
+	}
+	if n, _ := w.count("ip 1", start.Add(time.Hour)); n != 1 {
+		t.Errorf("count after the first left = %d", n)
+	}
+	w.prune(start.Add(2 * time.Hour))
+	if len(w.hits) != 0 {
+		t.Errorf("kept %v", w.hits)
+	}
+}
+
+// ── proof of work ────────────────────────────────────────────────────────────
+
+func TestAnIntentNeedsAProofOfWork(t *testing.T) {
+	g := testGuard(t, 0, 0, 0, 8)
+	r := guarded(g)
+	w := checkout(r, "203.0.113.1", "")
+	if w.Code != http.StatusPreconditionRequired {
+		t.Fatalf("without a proof: %d", w.Code)
+	}
+	var asked struct {
+		Challenge string
+		Bits      int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &asked); err != nil || asked.Bits != 8 || asked.Challenge == "" {
+		t.Fatalf("asked %s", w.Body)
+	}
+
+	solution := pow.Solve(asked.Challenge, asked.Bits)
+	if w := checkout(r, "203.0.113.1", "", pow.ChallengeHeader, asked.Challenge, pow.SolutionHeader, solution); w.Code != http.StatusOK {
+		t.Errorf("with the proof: %d %s", w.Code, w.Body)
+	}
+	for name, headers := range map[string][]string{
+		"used twice":    {pow.ChallengeHeader, asked.Challenge, pow.SolutionHeader, solution},
+		"made up":       {pow.ChallengeHeader, "8.1.x.sig", pow.SolutionHeader, "1"},
+		"wrong":         {pow.ChallengeHeader, g.challenge(time.Now()), pow.SolutionHeader, "not it"},
+		"expired":       {pow.ChallengeHeader, g.challenge(time.Now().Add(-challengeTTL - time.Second)), pow.SolutionHeader, ""},
+		"easier":        {pow.ChallengeHeader, (&guard{powBits: 1}).challenge(time.Now()), pow.SolutionHeader, ""},
+		"nothing after": {pow.ChallengeHeader, asked.Challenge + ".", pow.SolutionHeader, solution},
+	} {
+		if name == "expired" || name == "easier" {
+			headers[3] = pow.Solve(headers[1], 8)
+		}
+		if w := checkout(r, "203.0.113.1", "", headers...); w.Code != http.StatusPreconditionRequired || !strings.Contains(w.Body.String(), "proof of work") {
+			t.Errorf("%s: %d %s", name, w.Code, w.Body)
+		}
+	}
+}
+
+func TestAProofTakesWork(t *testing.T) {
+	solved := 0
+	for i := range 64 {
+		if pow.Check("challenge", fmt.Sprint(i), 4) {
+			solved++
+		}
+	}
+	// One in sixteen hashes starts with four zero bits.
+	if solved == 0 || solved > 16 {
+		t.Errorf("%d of 64 solved", solved)
+	}
+	if s := pow.Solve("challenge", 12); !pow.Check("challenge", s, 12) {
+		t.Errorf("solution %s", s)
+	}
+}
+
+// ── failed payments ──────────────────────────────────────────────────────────
+
+// Card testing shows as one client's intents failing over and over; past
+// FAILEDPAYMENTS it gets no more, and those it has are cancelled so that
+// their client secrets can try no more cards.
+func TestAClientWhosePaymentsKeepFailingIsRefused(t *testing.T) {
+	r := guarded(testGuard(t, 0, 0, 3, 0))
+	cancelled := stripeSays(t, map[string][]attempt{
+		"pi_1": {{ID: "ch_1", Card: "card1", Failed: true}, {ID: "ch_2", Card: "card2", Failed: true}},
+		"pi_2": {{ID: "ch_3", Card: "card3", Failed: true}},
+	})
+	for i := range 2 {
+		if w := checkout(r, "203.0.113.1", ""); w.Code != http.StatusOK {
+			t.Fatalf("intent %d: %d", i+1, w.Code)
+		}
+	}
+	if w := checkout(r, "203.0.113.1", ""); w.Code != http.StatusForbidden {
+		t.Errorf("after three failed payments: %d", w.Code)
+	}
+	if strings.Join(*cancelled, " ") != "pi_1 pi_2" {
+		t.Errorf("cancelled %v", *cancelled)
+	}
+	if w := checkout(r, "203.0.113.2", ""); w.Code != http.StatusOK {
+		t.Errorf("another IP: %d", w.Code)
+	}
+}
+
+// However fast a client asks for intents, Stripe is asked about each of them
+// once in a while, and about a few at a time.
+func TestStripeIsAskedAboutEachIntentOnceInAWhile(t *testing.T) {
+	r := guarded(testGuard(t, 0, 0, 100, 0))
+	stripeSays(t, nil)
+	asked := map[string]int{}
+	intentCharges = func(_, id string) ([]attempt, bool, error) {
+		asked[id]++
+		return nil, false, nil
+	}
+	for range 8 {
+		checkout(r, "203.0.113.1", "")
+	}
+	for id, n := range asked {
+		if n > 1 {
+			t.Errorf("%s was asked about %d times", id, n)
+		}
+	}
+	if len(asked) != 7 {
+		t.Errorf("asked about %d intents, want each of the 7 made before the last request", len(asked))
+	}
+}
+
+// A paid intent is no longer followed, so Stripe is not asked about it.
+func TestASettledIntentIsNotAskedAbout(t *testing.T) {
+	g := testGuard(t, 0, 0, 3, 0)
+	r := guarded(g)
+	stripeSays(t, nil)
+	var asked []string
+	intentCharges = func(_, id string) ([]attempt, bool, error) {
+		asked = append(asked, id)
+		return nil, false, nil
+	}
+	checkout(r, "203.0.113.1", "")
+	g.settled("pi_1")
+	checkout(r, "203.0.113.1", "")
+	if len(asked) != 0 {
+		t.Errorf("asked about %v", asked)
+	}
+}
+
+// The same card failing from many addresses is someone guessing its details;
+// whoever tries it next is refused.
+func TestACardThatKeepsFailingIsRefusedFromAnyIP(t *testing.T) {
+	r := guarded(testGuard(t, 0, 0, 2, 0))
+	stripeSays(t, map[string][]attempt{
+		"pi_1": {{ID: "ch_1", Card: "stolen", Failed: true}},
+		"pi_2": {{ID: "ch_2", Card: "stolen", Failed: true}},
+		"pi_3": {{ID: "ch_3", Card: "stolen"}},
+	})
+	for i, ip := range []string{"203.0.113.1", "203.0.113.2", "203.0.113.3"} {
+		if w := checkout(r, ip, ""); w.Code != http.StatusOK {
+			t.Fatalf("intent %d: %d", i+1, w.Code)
+		}
+	}
+	// Both failures are counted when the first two IPs come back.
+	checkout(r, "203.0.113.1", "")
+	checkout(r, "203.0.113.2", "")
+	if w := checkout(r, "203.0.113.3", ""); w.Code != http.StatusForbidden {
+		t.Errorf("the third IP, having tried the card: %d", w.Code)
+	}
+}
+
+// ── blocklist ────────────────────────────────────────────────────────────────
+
+func TestTheBlocklistIsReadAgainWhenItChanges(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte("# bots\n198.51.100.0/24\n2001:db8::1 # one\ncard:stolen\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	b := &blocklist{path: path}
+	for _, tc := range []struct {
+		ip    string
+		cards []string
+		want  string
+	}{
+		{"198.51.100.7", nil, "198.51.100.0/24"},
+		{"::ffff:198.51.100.7", nil, "198.51.100.0/24"},
+		{"2001:db8::1", nil, "2001:db8::1/128"},
+		{"203.0.113.1", []string{"fine", "stolen"}, "card stolen"},
+		{"203.0.113.1", []string{"fine"}, ""},
+	} {
+		if got := b.blocked(tc.ip, tc.cards); tc.want == "" && got != "" || !strings.Contains(got, tc.want) {
+			t.Errorf("%s %v: %q, want %q", tc.ip, tc.cards, got, tc.want)
+		}
+	}
+
+	// A line that does not parse leaves the entries as they were.
+	if err := os.WriteFile(path, []byte("198.51.100.0/24\nnot an address at all\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := b.blocked("203.0.113.1", []string{"stolen"}); got == "" {
+		t.Error("a broken file emptied the blocklist")
+	}
+	if err := os.WriteFile(path, []byte("203.0.113.1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if b.blocked("203.0.113.1", nil) == "" || b.blocked("198.51.100.7", []string{"stolen"}) != "" {
+		t.Error("the changed file was not read")
+	}
+}
+
+func TestABlocklistedClientIsRefused(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "blocklist")
+	if err := os.WriteFile(path, []byte("203.0.113.0/24\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	g := testGuard(t, 0, 0, 0, 0)
+	g.blocklist = &blocklist{path: path}
+	r := guarded(g)
+	if w := checkout(r, "203.0.113.9", ""); w.Code != http.StatusForbidden {
+		t.Errorf("blocklisted: %d", w.Code)
+	}
+	if w := checkout(r, "198.51.100.1", ""); w.Code != http.StatusOK {
+		t.Errorf("not blocklisted: %d", w.Code)
+	}
+}
+
+func TestCheckGuardNamesEachBadSetting(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.IntentsPerIP, f.FailedPayments, f.IntentWindow, f.PoWBits, f.Blocklist = -1, -1, 0, 40, filepath.Join(t.TempDir(), "missing")
+	joined := ""
+	for _, err := range checkGuard() {
+		joined += err.Error() + "\n"
+	}
+	for _, want := range []string{"INTENTSPERIP", "FAILEDPAYMENTS", "INTENTWINDOW", "POWBITS", "BLOCKLIST"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("no complaint about %s in:\n%s", want, joined)
+		}
+	}
+}
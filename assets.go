@@ -0,0 +1,229 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// asset is one build of a file served under /assets. Its name carries a hash
+// of its contents, so a URL never changes what it serves and the browser can
+// keep it for good. The compressed variants are made once, when it is
+// published, not per request.
+type asset struct {
+	Type   string
+	Hash   string
+	Data   []byte
+	Gzip   []byte
+	Brotli []byte
+}
+
+var (
+	assetsMu sync.RWMutex
+	assets   = map[string]*asset{}
+	// assetGen remembers, by the file's plain name, the hashed names of its
+	// current build and the one before it. A page loaded just before a
+	// rebuild still finds what it links to; anything older is dropped,
+	// unless another file's builds still have it.
+	assetGen = map[string][2]string{}
+)
+
+// publishAsset serves data under a name made from name and a hash of data,
+// checkout.wasm becoming checkout.<hash>.wasm, and returns its URL.
+func publishAsset(name string, data []byte) string {
+	return publishVersion(name, name, data)
+}
+
+// publishVersion is publishAsset for one of several files served under the
+// same plain name, such as each store theme's shop.css: gen tells their
+// builds apart, so that a new build of one drops only that one's old ones.
+func publishVersion(gen, name string, data []byte) string {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:8])
+	ext := filepath.Ext(name)
+	hashed := strings.TrimSuffix(name, ext) + "." + hash + ext
+	url := "/assets/" + hashed
+
+	assetsMu.RLock()
+	_, ok := assets[hashed]
+	assetsMu.RUnlock()
+	var a *asset
+	if !ok {
+		a = newAsset(hash, ext, data)
+	}
+
+	assetsMu.Lock()
+	defer assetsMu.Unlock()
+	if _, ok := assets[hashed]; !ok {
+		if a == nil { // dropped since it was looked for
+			a = newAsset(hash, ext, data)
+		}
+		assets[hashed] = a
+	}
+	builds := assetGen[gen]
+	if builds[0] != hashed {
+		assetGen[gen] = [2]string{hashed, builds[0]}
+		if builds[1] != "" && !assetInUse(builds[1]) {
+			delete(assets, builds[1])
+		}
+	}
+	return url
+}
+
+func newAsset(hash, ext string, data []byte) *asset {
+	a := &asset{Type: mime.TypeByExtension(ext), Hash: hash, Data: data}
+	if a.Type == "" {
+		a.Type = "application/octet-stream"
+	}
+	a.Gzip, a.Brotli = compress(data)
+	return a
+}
+
+// assetInUse reports whether hashed is a current or previous build of some
+// file. Two files with the same contents share one.
+func assetInUse(hashed string) bool {
+	for _, builds := range assetGen {
+		if builds[0] == hashed || builds[1] == hashed {
+			return true
+		}
+	}
+	return false
+}
+
+// brotliSlowLimit is the largest file brotli gets its best compression for.
+// Above it the best is too slow to wait for: seconds for a file the size of
+// a Go-compiled wasm, every time the server starts. Level 6 does that in well
+// under a second and comes out only a few percent larger.
+const brotliSlowLimit = 1 << 20
+
+// compress makes the gzip and brotli variants of data, at the slowest and
+// smallest settings of each since it is only done once per build, brotli
+// short of that for large files. A variant that comes out no smaller than the
+// original is left out.
+func compress(data []byte) (gz, br []byte) {
+	var b bytes.Buffer
+	zw, _ := gzip.NewWriterLevel(&b, gzip.BestCompression) //nolint:errcheck // the level is valid
+	_, _ = zw.Write(data)                                  //nolint:errcheck // writes to a bytes.Buffer do not fail
+	_ = zw.Close()                                         //nolint:errcheck // as above
+	if b.Len() < len(data) {
+		gz = bytes.Clone(b.Bytes())
+	}
+	b.Reset()
+	level := brotli.BestCompression
+	if len(data) > brotliSlowLimit {
+		level = 6
+	}
+	bw := brotli.NewWriterLevel(&b, level)
+	_, _ = bw.Write(data) //nolint:errcheck // as above
+	_ = bw.Close()        //nolint:errcheck // as above
+	if b.Len() < len(data) {
+		br = bytes.Clone(b.Bytes())
+	}
+	return gz, br
+}
+
+// writeAssets writes every asset being served into dir under its hashed
+// name, with the gzip and brotli variants beside it as .gz and .br for a
+// static host to serve precompressed. They are public, and readable by
+// whatever serves them.
+func writeAssets(dir string) error {
+	if err := os.MkdirAll(dir, 0o755); err != nil { //nolint:gosec // a public site
+		return err
+	}
+	assetsMu.RLock()
+	defer assetsMu.RUnlock()
+	for name, a := range assets {
+		for ext, data := range map[string][]byte{"": a.Data, ".gz": a.Gzip, ".br": a.Brotli} {
+			if data == nil {
+				continue
+			}
+			if err := os.WriteFile(filepath.Join(dir, name+ext), data, 0o644); err != nil { //nolint:gosec // as above
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc,
+// taking q=0 as the refusal it is. enc named outright is what counts; *
+// speaks only for the codings the header does not name.
+func acceptsEncoding(header, enc string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.TrimSpace(name)
+		if !strings.EqualFold(name, enc) && name != "*" {
+			continue
+		}
+		ok := true
+		if q, found := strings.CutPrefix(strings.TrimSpace(params), "q="); found {
+			if v, err := strconv.ParseFloat(q, 64); err == nil && v == 0 {
+				ok = false
+			}
+		}
+		if name != "*" {
+			return ok
+		}
+		wildcard = ok
+	}
+	return wildcard
+}
+
+// etagMatches reports whether an If-None-Match header names etag, or any.
+// The comparison is the weak one RFC 9110 has If-None-Match use.
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		if tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/"); tag == etag || tag == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+// serveAsset is the handler for /assets/:name. Each encoding of an asset is
+// a different body, so each has its own ETag: the hash, with -br or -gz after
+// it for a compressed one.
+func serveAsset(c *gin.Context) {
+	assetsMu.RLock()
+	a, ok := assets[c.Param("name")]
+	assetsMu.RUnlock()
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+	h := c.Writer.Header()
+	h.Set("Server", "")
+	h.Set("Cache-Control", "public, max-age=31536000, immutable")
+	h.Set("Vary", "Accept-Encoding")
+	body, etag := a.Data, `"`+a.Hash+`"`
+	switch ae := c.GetHeader("Accept-Encoding"); {
+	case a.Brotli != nil && acceptsEncoding(ae, "br"):
+		body, etag = a.Brotli, `"`+a.Hash+`-br"`
+		h.Set("Content-Encoding", "br")
+	case a.Gzip != nil && acceptsEncoding(ae, "gzip"):
+		body, etag = a.Gzip, `"`+a.Hash+`-gz"`
+		h.Set("Content-Encoding", "gzip")
+	}
+	h.Set("ETag", etag)
+	if inm := c.GetHeader("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		h.Del("Content-Encoding")
+		c.Status(http.StatusNotModified)
+		return
+	}
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	c.Data(http.StatusOK, a.Type, body)
+}
@@ -0,0 +1,175 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/gin-gonic/gin"
+)
+
+// ── publishing ───────────────────────────────────────────────────────────────
+
+func TestPublishedNamesFollowTheContents(t *testing.T) {
+	data := bytes.Repeat([]byte("wasm"), 1000)
+	a, b := publishAsset("t1.wasm", data), publishAsset("t1.wasm", data)
+	if a != b {
+		t.Errorf("the same bytes got two URLs: %s, %s", a, b)
+	}
+	if !strings.HasPrefix(a, "/assets/t1.") || !strings.HasSuffix(a, ".wasm") {
+		t.Errorf("URL = %s, want /assets/t1.<hash>.wasm", a)
+	}
+	if c := publishAsset("t1.wasm", append(data, '!')); c == a {
+		t.Error("different bytes got the same URL")
+	}
+}
+
+// A page loaded just before a rebuild still finds what it links to, but the
+// builds before that are let go.
+func TestOnlyTheLastTwoBuildsAreKept(t *testing.T) {
+	var urls []string
+	for _, s := range []string{"one", "two", "three"} {
+		urls = append(urls, publishAsset("t2.js", []byte(s)))
+	}
+	assetsMu.RLock()
+	defer assetsMu.RUnlock()
+	for i, want := range []bool{false, true, true} {
+		if _, ok := assets[strings.TrimPrefix(urls[i], "/assets/")]; ok != want {
+			t.Errorf("build %d kept = %v, want %v", i+1, ok, want)
+		}
+	}
+}
+
+// Files served under the same plain name, like two themes' shop.css, are
+// built separately: a third build of one does not drop the other's.
+func TestBuildsAreKeptPerFile(t *testing.T) {
+	other := publishVersion("a/t4.css", "t4.css", []byte("a"))
+	shared := publishVersion("b/t4.css", "t4.css", []byte("same"))
+	publishVersion("c/t4.css", "t4.css", []byte("same"))
+	for _, s := range []string{"b1", "b2", "b3"} {
+		publishVersion("b/t4.css", "t4.css", []byte(s))
+	}
+	assetsMu.RLock()
+	defer assetsMu.RUnlock()
+	for _, url := range []string{other, shared} {
+		if _, ok := assets[strings.TrimPrefix(url, "/assets/")]; !ok {
+			t.Errorf("%s was dropped by another file's builds", url)
+		}
+	}
+}
+
+// ── serving ──────────────────────────────────────────────────────────────────
+
+func getAsset(t *testing.T, url string, header map[string]string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/assets/:name", serveAsset)
+	req := httptest.NewRequest(http.MethodGet, url, nil)
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestAssetsAreServedCompressedAndCacheable(t *testing.T) {
+	data := bytes.Repeat([]byte("\x00asm"), 5000)
+	url := publishAsset("t3.wasm", data)
+
+	w := getAsset(t, url, map[string]string{"Accept-Encoding": "gzip, br"})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/wasm" {
+		t.Fatalf("%d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Header().Get("Cache-Control"), "immutable") {
+		t.Errorf("Cache-Control = %q", w.Header().Get("Cache-Control"))
+	}
+	if w.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("Content-Encoding = %q, want br", w.Header().Get("Content-Encoding"))
+	}
+	if got, _ := io.ReadAll(brotli.NewReader(w.Body)); !bytes.Equal(got, data) {
+		t.Error("the brotli body does not decode to the asset")
+	}
+
+	w = getAsset(t, url, map[string]string{"Accept-Encoding": "br;q=0, gzip"})
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("br;q=0 still got %q", w.Header().Get("Content-Encoding"))
+	}
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(zr); !bytes.Equal(got, data) {
+		t.Error("the gzip body does not decode to the asset")
+	}
+
+	w = getAsset(t, url, nil)
+	if w.Header().Get("Content-Encoding") != "" || !bytes.Equal(w.Body.Bytes(), data) {
+		t.Error("a client that accepts no encoding did not get the plain bytes")
+	}
+
+	etag := w.Header().Get("ETag")
+	if w = getAsset(t, url, map[string]string{"If-None-Match": etag}); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("If-None-Match %s: %d with %d bytes, want 304 and nothing", etag, w.Code, w.Body.Len())
+	}
+}
+
+// Each encoding is its own body and so has its own strong ETag, and a cached
+// copy is only current for the encoding it was of.
+func TestEachEncodingHasItsOwnETag(t *testing.T) {
+	url := publishAsset("etag.js", bytes.Repeat([]byte("let tubes = 'valves';\n"), 200))
+	tags := map[string]string{}
+	for _, enc := range []string{"", "gzip", "br"} {
+		w := getAsset(t, url, map[string]string{"Accept-Encoding": enc})
+		tags[enc] = w.Header().Get("ETag")
+	}
+	if tags[""] == tags["gzip"] || tags[""] == tags["br"] || tags["gzip"] == tags["br"] {
+		t.Fatalf("ETags %v are not one per encoding", tags)
+	}
+	if !strings.HasSuffix(tags["br"], `-br"`) || !strings.HasSuffix(tags["gzip"], `-gz"`) {
+		t.Errorf("ETags %v do not name their encoding", tags)
+	}
+
+	w := getAsset(t, url, map[string]string{"Accept-Encoding": "br", "If-None-Match": tags[""]})
+	if w.Code != http.StatusOK || w.Header().Get("Content-Encoding") != "br" {
+		t.Errorf("the identity ETag revalidated a brotli response: %d", w.Code)
+	}
+	w = getAsset(t, url, map[string]string{"Accept-Encoding": "br", "If-None-Match": `"x", W/` + tags["br"]})
+	if w.Code != http.StatusNotModified {
+		t.Errorf("the brotli ETag, weak and in a list, did not revalidate: %d", w.Code)
+	}
+}
+
+// A coding the header names outright is not overruled by *, wherever it is.
+func TestANamedEncodingOutranksTheWildcard(t *testing.T) {
+	for header, want := range map[string]bool{
+		"br":              true,
+		"gzip":            false,
+		"*":               true,
+		"*;q=0":           false,
+		"*;q=0, br":       true,
+		"br, *;q=0":       true,
+		"br;q=0, *":       false,
+		"*, br;q=0":       false,
+		"gzip, *;q=0.5":   true,
+		"gzip;q=1, *;q=0": false,
+	} {
+		if got := acceptsEncoding(header, "br"); got != want {
+			t.Errorf("Accept-Encoding %q: br accepted = %v, want %v", header, got, want)
+		}
+	}
+}
+
+func TestAnUnknownAssetIsNotFound(t *testing.T) {
+	if w := getAsset(t, "/assets/nothing.0000.wasm", nil); w.Code != http.StatusNotFound {
+		t.Errorf("code = %d", w.Code)
+	}
+}
@@ -0,0 +1,110 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+)
+
+// blocklist is the BLOCKLIST file: clients that are refused payment intents
+// outright. Each line is an IP address, a CIDR range, or card: and a Stripe
+// card fingerprint, refusing whoever has tried that card; # starts a
+// comment. The file is looked at on each check and read again when it has
+// changed, so an entry added while reviewing the log takes effect at once.
+type blocklist struct {
+	path string
+
+	mu       sync.Mutex
+	info     os.FileInfo
+	prefixes []netip.Prefix
+	cards    map[string]bool
+}
+
+// parseBlocklist reads the entries of a blocklist file, naming the line of
+// any it does not understand.
+func parseBlocklist(path string) ([]netip.Prefix, map[string]bool, error) {
+	file, err := os.Open(path) //nolint:gosec // BLOCKLIST is the operator's own file
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close() //nolint:errcheck // read only
+	var prefixes []netip.Prefix
+	cards := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for n := 1; scanner.Scan(); n++ {
+		entry, _, _ := strings.Cut(scanner.Text(), "#")
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+		case strings.HasPrefix(entry, "card:"):
+			cards[strings.TrimPrefix(entry, "card:")] = true
+		case strings.Contains(entry, "/"):
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			prefixes = append(prefixes, p.Masked())
+		default:
+			a, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, nil, fmt.Errorf("%s:%d: %w", path, n, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+		}
+	}
+	return prefixes, cards, scanner.Err()
+}
+
+// reload reads the file again if it has changed. One that no longer parses
+// is logged and the entries already loaded are kept.
+func (b *blocklist) reload() {
+	info, err := os.Stat(b.path)
+	if err != nil {
+		if b.info != nil {
+			log.Printf("BLOCKLIST: %v; keeping the entries already loaded", err)
+			b.info = nil
+		}
+		return
+	}
+	if !changed(b.info, info) {
+		return
+	}
+	b.info = info
+	prefixes, cards, err := parseBlocklist(b.path)
+	if err != nil {
+		log.Printf("BLOCKLIST: %v; keeping the entries already loaded", err)
+		return
+	}
+	b.prefixes, b.cards = prefixes, cards
+	log.Printf("loaded %d addresses and %d cards from %s", len(prefixes), len(cards), b.path)
+}
+
+// blocked tells why a client from ip that has tried cards is refused, or ""
+// if it is not.
+func (b *blocklist) blocked(ip string, cards []string) string {
+	if b == nil {
+		return ""
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.reload()
+	if a, err := netip.ParseAddr(ip); err == nil {
+		for _, p := range b.prefixes {
+			if p.Contains(a.Unmap()) {
+				return "blocklisted address " + p.String()
+			}
+		}
+	}
+	for _, card := range cards {
+		if b.cards[card] {
+			return "blocklisted card " + card
+		}
+	}
+	return ""
+}
@@ -0,0 +1,225 @@
+//go:build !wasm
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// The wasm cache keeps every binary the compiler has made, named by a hash of
+// everything that went into it: the sources of each package it is built from,
+// go.mod and go.sum, the compiler and its version, and the command line with
+// the environment that changes what it does. A restart, or a rebuild that
+// ends up where an earlier one was, takes the binary from there instead of
+// compiling it again. Nothing in it is ever stale, only unused, which is what
+// `srv cache prune` is for.
+
+// cacheExt is what every cache entry is named with, so that prune never
+// touches anything else that ends up in the directory.
+const cacheExt = ".wasm"
+
+// cacheEnv are the environment variables that change what a build produces
+// without being on its command line.
+var cacheEnv = []string{"GOFLAGS", "GOEXPERIMENT", "GOWASM", "TINYGOFLAGS"}
+
+// compilerVersion is what the compiler says its version is, which for a
+// development build of either includes the commit.
+func compilerVersion(tiny bool) (string, error) {
+	c := "go"
+	if tiny {
+		c = "tinygo"
+	}
+	out, err := exec.Command(c, "version").Output()
+	if err != nil {
+		return "", fmt.Errorf("%s version: %w", c, err)
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// wasmCacheKey hashes what a build is made from: its command line, the
+// compiler version and cacheEnv, and the path and contents of each source.
+// The order srcs come in makes no difference.
+func wasmCacheKey(command, version string, srcs []string) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "command %s\nversion %s\n", command, version)
+	for _, env := range cacheEnv {
+		fmt.Fprintf(h, "env %s=%s\n", env, os.Getenv(env))
+	}
+	srcs = slices.Sorted(slices.Values(srcs))
+	for _, src := range slices.Compact(srcs) {
+		file, err := os.Open(src) //nolint:gosec // the sources go list named
+		if err != nil {
+			return "", err
+		}
+		fh := sha256.New()
+		_, err = io.Copy(fh, file)
+		file.Close() //nolint:errcheck,gosec // only read from
+		if err != nil {
+			return "", err
+		}
+		rel := src
+		if r, err := filepath.Rel(".", src); err == nil {
+			rel = r
+		}
+		fmt.Fprintf(h, "file %s %x\n", filepath.ToSlash(rel), fh.Sum(nil))
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// cacheKeyFor is the cache key of building the entrypoint name, from sources
+// as they are on disk now.
+func cacheKeyFor(name string, tiny bool) (string, error) {
+	srcs, err := wasmSources(name)
+	if err != nil {
+		return "", fmt.Errorf("listing the sources: %w", err)
+	}
+	if abs, err := filepath.Abs("go.sum"); err == nil {
+		if _, err := os.Stat(abs); err == nil {
+			srcs = append(srcs, abs)
+		}
+	}
+	version, err := compilerVersion(tiny)
+	if err != nil {
+		return "", err
+	}
+	return wasmCacheKey(wasmBuildCommand(name, tiny), version, srcs)
+}
+
+func cachePath(key string) string {
+	return filepath.Join(f.CacheDir, key+cacheExt)
+}
+
+// cacheLoad is the binary cached under key, if there is one. It is touched on
+// the way out, so that prune sees it as used.
+func cacheLoad(key string) ([]byte, bool) {
+	if f.CacheDir == "" {
+		return nil, false
+	}
+	data, err := os.ReadFile(cachePath(key))
+	if err != nil {
+		return nil, false
+	}
+	now := time.Now()
+	_ = os.Chtimes(cachePath(key), now, now) //nolint:errcheck // an entry that looks older is only pruned sooner
+	return data, true
+}
+
+// cacheStore keeps data under key. It is written beside its final name and
+// renamed into place, so that a server reading the cache, or another one
+// writing the same entry, never sees half of it.
+func cacheStore(key string, data []byte) error {
+	if f.CacheDir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(f.CacheDir, 0o750); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(f.CacheDir, ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone already once it is renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() //nolint:errcheck,gosec // the write already failed
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), cachePath(key))
+}
+
+// cacheEntry is one binary in the cache, as prune sees it.
+type cacheEntry struct {
+	Path string
+	Size int64
+	Used time.Time
+}
+
+func cacheEntries(dir string) ([]cacheEntry, error) {
+	des, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []cacheEntry
+	for _, de := range des {
+		if de.IsDir() || !strings.HasSuffix(de.Name(), cacheExt) {
+			continue
+		}
+		fi, err := de.Info()
+		if err != nil {
+			continue
+		}
+		entries = append(entries, cacheEntry{Path: filepath.Join(dir, de.Name()), Size: fi.Size(), Used: fi.ModTime()})
+	}
+	return entries, nil
+}
+
+// pruneCache removes the entries not used within maxAge, then the least
+// recently used of the rest until they come to no more than maxSize bytes.
+// Zero for either means no limit on it. It returns what it removed.
+func pruneCache(dir string, maxAge time.Duration, maxSize int64, now time.Time) ([]cacheEntry, error) {
+	entries, err := cacheEntries(dir)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].Used.After(entries[b].Used) })
+	var removed []cacheEntry
+	var kept int64
+	for _, e := range entries {
+		tooOld := maxAge > 0 && now.Sub(e.Used) > maxAge
+		tooBig := maxSize > 0 && kept+e.Size > maxSize
+		if !tooOld && !tooBig {
+			kept += e.Size
+			continue
+		}
+		if err := os.Remove(e.Path); err != nil {
+			return removed, err
+		}
+		removed = append(removed, e)
+	}
+	return removed, nil
+}
+
+var cacheCmd = &cobra.Command{
+	Use:   "cache",
+	Short: "manage the wasm build cache",
+}
+
+var pruneFlags struct {
+	maxAge  time.Duration
+	maxSize int64
+}
+
+var cachePruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "remove cached wasm builds that have not been used lately",
+	Args:  cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		if f.CacheDir == "" {
+			log.Fatal("CACHEDIR is unset, so there is no cache to prune")
+		}
+		removed, err := pruneCache(f.CacheDir, pruneFlags.maxAge, pruneFlags.maxSize*MB, time.Now())
+		var freed int64
+		for _, e := range removed {
+			freed += e.Size
+		}
+		fmt.Printf("removed %d cached builds, %.2f MB\n", len(removed), float64(freed)/MB)
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	},
+}
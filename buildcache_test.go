@@ -0,0 +1,121 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// ── build cache ──────────────────────────────────────────────────────────────
+
+func TestCacheKeyFollowsWhatTheBuildIsMadeFrom(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a.go"), filepath.Join(dir, "b.go")
+	for _, p := range []string{a, b} {
+		if err := os.WriteFile(p, []byte("package main // "+p), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	key := func(command, version string, srcs ...string) string {
+		t.Helper()
+		k, err := wasmCacheKey(command, version, srcs)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return k
+	}
+	base := key("go build", "go1.25", a, b)
+	if key("go build", "go1.25", b, a) != base {
+		t.Error("the order of the sources changed the key")
+	}
+	for what, k := range map[string]string{
+		"command": key("tinygo build", "go1.25", a, b),
+		"version": key("go build", "go1.26", a, b),
+		"sources": key("go build", "go1.25", a),
+	} {
+		if k == base {
+			t.Errorf("a different %s gave the same key", what)
+		}
+	}
+	t.Setenv("GOFLAGS", "-ldflags=-s")
+	if key("go build", "go1.25", a, b) == base {
+		t.Error("GOFLAGS did not change the key")
+	}
+	t.Setenv("GOFLAGS", "")
+	if err := os.WriteFile(b, []byte("package main // edited"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if key("go build", "go1.25", a, b) == base {
+		t.Error("editing a source did not change the key")
+	}
+	if _, err := wasmCacheKey("go build", "go1.25", []string{filepath.Join(dir, "gone.go")}); err == nil {
+		t.Error("a missing source was hashed")
+	}
+}
+
+func TestCacheStoresAndLoadsByKey(t *testing.T) {
+	saved := f.CacheDir
+	defer func() { f.CacheDir = saved }()
+	f.CacheDir = filepath.Join(t.TempDir(), "cache")
+
+	if _, ok := cacheLoad("abc"); ok {
+		t.Fatal("an empty cache had an entry")
+	}
+	if err := cacheStore("abc", []byte("\x00asm")); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := cacheLoad("abc"); !ok || !bytes.Equal(data, []byte("\x00asm")) {
+		t.Errorf("loaded %q, %v", data, ok)
+	}
+	entries, err := cacheEntries(f.CacheDir)
+	if err != nil || len(entries) != 1 {
+		t.Errorf("entries = %v, %v; the temporary file was left behind", entries, err)
+	}
+
+	f.CacheDir = ""
+	if err := cacheStore("def", []byte("x")); err != nil {
+		t.Error(err)
+	}
+	if _, ok := cacheLoad("abc"); ok {
+		t.Error("an unset CACHEDIR still read the cache")
+	}
+}
+
+func TestPruneRemovesOldThenLeastRecentlyUsed(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Now()
+	for name, age := range map[string]time.Duration{
+		"new" + cacheExt:    time.Hour,
+		"recent" + cacheExt: 2 * time.Hour,
+		"older" + cacheExt:  3 * time.Hour,
+		"stale" + cacheExt:  60 * 24 * time.Hour,
+		"notes.txt":         60 * 24 * time.Hour,
+	} {
+		p := filepath.Join(dir, name)
+		if err := os.WriteFile(p, make([]byte, 100), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(p, now.Add(-age), now.Add(-age)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	removed, err := pruneCache(dir, 30*24*time.Hour, 200, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 2 {
+		t.Errorf("removed %v, want stale and older", removed)
+	}
+	for name, want := range map[string]bool{
+		"new" + cacheExt: true, "recent" + cacheExt: true, "older" + cacheExt: false,
+		"stale" + cacheExt: false, "notes.txt": true,
+	} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != want {
+			t.Errorf("%s kept = %v, want %v", name, err == nil, want)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+//go:embed catalog.json
+var catalogJSON []byte
+
+// product is one line of the catalog. Price is in cents, which is what the
+// cart and Stripe both count in. Stock is what the storefront shows, what a
+// sale takes from and what a restocking refund puts back.
+type product struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Category string `json:"category"`
+	Price    int64  `json:"price"`
+	Stock    int64  `json:"stock"`
+}
+
+// Dollars is the price the way the page shows it and addToCart takes it.
+func (p product) Dollars() float64 { return float64(p.Price) / 100 }
+
+type category struct {
+	Name     string
+	Products []product
+}
+
+// catalogMu serializes the read-modify-write of the catalog file between a
+// sale and a refund landing at the same moment.
+var catalogMu sync.Mutex
+
+// loadCatalog reads the store's catalog from disk. CATALOG falls back to the
+// copy compiled into the binary when there is none there; a catalog a store
+// in STORES names has to exist, or the store would sell another's products.
+// It is read on every request, the same as the pages are, so that editing it
+// shows up without a restart.
+func (s *store) loadCatalog() ([]product, error) {
+	data, err := os.ReadFile(s.catalog())
+	if errors.Is(err, os.ErrNotExist) && s.Catalog == "" {
+		data = catalogJSON
+	} else if err != nil {
+		return nil, err
+	}
+	var products []product
+	if err := json.Unmarshal(data, &products); err != nil {
+		return nil, fmt.Errorf("%s: %w", s.catalog(), err)
+	}
+	return products, nil
+}
+
+func (s *store) saveCatalog(products []product) error {
+	data, err := json.MarshalIndent(products, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(s.catalog(), data)
+}
+
+// adjustStock moves the stock of each product in counts by sign times its
+// count: -1 for a sale, +1 for a restock. Ids that are not products — the
+// shipping line is one — are skipped, and a sale never takes stock below zero.
+func (s *store) adjustStock(counts map[string]int64, sign int64) error {
+	if len(counts) == 0 {
+		return nil
+	}
+	catalogMu.Lock()
+	defer catalogMu.Unlock()
+	products, err := s.loadCatalog()
+	if err != nil {
+		return err
+	}
+	for i := range products {
+		if n, ok := counts[products[i].ID]; ok {
+			products[i].Stock += sign * n
+			if products[i].Stock < 0 {
+				products[i].Stock = 0
+			}
+		}
+	}
+	return s.saveCatalog(products)
+}
+
+// categories groups the products for the storefront, in the order each
+// category first appears in the catalog.
+func categories(products []product) []category {
+	var cats []category
+	index := map[string]int{}
+	for _, p := range products {
+		i, ok := index[p.Category]
+		if !ok {
+			i = len(cats)
+			index[p.Category] = i
+			cats = append(cats, category{Name: p.Category})
+		}
+		cats[i].Products = append(cats[i].Products, p)
+	}
+	return cats
+}
+
+// productByID finds the product a product page is for.
+func productByID(products []product, id string) (product, bool) {
+	for _, p := range products {
+		if p.ID == id {
+			return p, true
+		}
+	}
+	return product{}, false
+}
+
+// validateCatalog lists everything wrong with a catalog rather than stopping
+// at the first problem, so a hand-edited file can be fixed in one pass.
+func validateCatalog(products []product) []error {
+	var errs []error
+	seen := map[string]bool{}
+	for i, p := range products {
+		switch {
+		case p.ID == "":
+			errs = append(errs, fmt.Errorf("product %d has no id", i+1))
+		case strings.ContainsAny(p.ID, "| \t\n'\""):
+			// The cart joins fields with | and the page quotes ids into
+			// element ids and onclick handlers.
+			errs = append(errs, fmt.Errorf("product %q: id may not contain |, quotes or whitespace", p.ID))
+		case seen[p.ID]:
+			errs = append(errs, fmt.Errorf("product %q appears more than once", p.ID))
+		}
+		seen[p.ID] = true
+		if p.Name == "" {
+			errs = append(errs, fmt.Errorf("product %q has no name", p.ID))
+		}
+		if p.Price <= 0 {
+			errs = append(errs, fmt.Errorf("product %q: price must be more than zero cents", p.ID))
+		}
+		if p.Stock < 0 {
+			errs = append(errs, fmt.Errorf("product %q: stock cannot be negative", p.ID))
+		}
+	}
+	return errs
+}
+
+var catalogCSVHeader = []string{"id", "name", "category", "price", "stock"}
+
+// readCatalogFile reads a catalog in JSON or, for a .csv file, in the columns
+// of catalogCSVHeader with the header row first.
+func readCatalogFile(path string) ([]product, error) {
+	data, err := os.ReadFile(path) //nolint:gosec // a path given on the command line
+	if err != nil {
+		return nil, err
+	}
+	var products []product
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		rows, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		for n, row := range rows {
+			if n == 0 {
+				continue
+			}
+			if len(row) != len(catalogCSVHeader) {
+				return nil, fmt.Errorf("%s: line %d has %d columns, want %d", path, n+1, len(row), len(catalogCSVHeader))
+			}
+			price, err := strconv.ParseInt(row[3], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: line %d: price: %w", path, n+1, err)
+			}
+			stock, err := strconv.ParseInt(row[4], 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("%s: line %d: stock: %w", path, n+1, err)
+			}
+			products = append(products, product{ID: row[0], Name: row[1], Category: row[2], Price: price, Stock: stock})
+		}
+		return products, nil
+	}
+	if err := json.Unmarshal(data, &products); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return products, nil
+}
+
+func writeCatalogCSV(w io.Writer, products []product) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(catalogCSVHeader); err != nil {
+		return err
+	}
+	for _, p := range products {
+		if err := cw.Write([]string{p.ID, p.Name, p.Category, strconv.FormatInt(p.Price, 10), strconv.FormatInt(p.Stock, 10)}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var catalogFormat string
+
+var catalogCmd = &cobra.Command{
+	Use:   "catalog",
+	Short: "manage the product catalog",
+}
+
+var catalogImportCmd = &cobra.Command{
+	Use:   "import <file.json|file.csv>",
+	Short: "replace the catalog with a validated json or csv file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		products, err := readCatalogFile(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		if errs := validateCatalog(products); len(errs) > 0 {
+			log.Fatal("not imported: ", errors.Join(errs...))
+		}
+		s, err := storeNamed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		catalogMu.Lock()
+		defer catalogMu.Unlock()
+		if err := s.saveCatalog(products); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("imported %d products into %s\n", len(products), s.catalog())
+	},
+}
+
+var catalogExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "write the catalog to stdout as json or csv",
+	Args:  cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		s, err := storeNamed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		products, err := s.loadCatalog()
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch catalogFormat {
+		case "json":
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(products)
+		case "csv":
+			err = writeCatalogCSV(os.Stdout, products)
+		default:
+			err = fmt.Errorf("unknown format %q: use json or csv", catalogFormat)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var catalogValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "check a catalog file, by default the one in use",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		s, err := storeNamed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		path := s.catalog()
+		if len(args) == 1 {
+			path = args[0]
+		}
+		products, err := readCatalogFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		errs := validateCatalog(products)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Printf("%s: %d products, ok\n", path, len(products))
+	},
+}
@@ -0,0 +1,150 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+)
+
+// ── loading ──────────────────────────────────────────────────────────────────
+
+// With no catalog on disk the storefront still has something to show: the copy
+// compiled into the binary.
+func TestLoadCatalogFallsBackToTheEmbeddedCopy(t *testing.T) {
+	t.Chdir(t.TempDir())
+	products, err := defaultStore.loadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(products) == 0 {
+		t.Fatal("the embedded catalog is empty")
+	}
+	for _, p := range products {
+		if p.ID == "" || p.Price <= 0 {
+			t.Errorf("embedded product %+v has no id or no price", p)
+		}
+	}
+}
+
+// A catalog that does not parse is an error, not an empty shop.
+func TestLoadCatalogReportsABrokenFile(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile(f.Catalog, []byte("[{"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := defaultStore.loadCatalog(); err == nil {
+		t.Error("a truncated catalog loaded without error")
+	}
+}
+
+// ── stock ────────────────────────────────────────────────────────────────────
+
+func TestAdjustStockSellsAndRestocks(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := defaultStore.saveCatalog([]product{{ID: "A", Price: 100, Stock: 5}, {ID: "B", Price: 200, Stock: 1}}); err != nil {
+		t.Fatal(err)
+	}
+	// The shipping line is in every order and is not a product.
+	if err := defaultStore.adjustStock(map[string]int64{"A": 2, "B": 3, "shipping-to|x": 1}, -1); err != nil {
+		t.Fatal(err)
+	}
+	products, err := defaultStore.loadCatalog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if products[0].Stock != 3 {
+		t.Errorf("A after selling 2 of 5 = %d, want 3", products[0].Stock)
+	}
+	if products[1].Stock != 0 {
+		t.Errorf("B after overselling = %d, want 0 rather than negative", products[1].Stock)
+	}
+	if err := defaultStore.adjustStock(map[string]int64{"A": 2}, 1); err != nil {
+		t.Fatal(err)
+	}
+	if products, _ = defaultStore.loadCatalog(); products[0].Stock != 5 { //nolint:errcheck // loaded without error just above
+		t.Errorf("A after restocking 2 = %d, want 5", products[0].Stock)
+	}
+}
+
+// ── storefront ───────────────────────────────────────────────────────────────
+
+func TestCategoriesKeepCatalogOrder(t *testing.T) {
+	cats := categories([]product{
+		{ID: "1", Category: "tube"},
+		{ID: "2", Category: "radio"},
+		{ID: "3", Category: "tube"},
+	})
+	if len(cats) != 2 || cats[0].Name != "tube" || cats[1].Name != "radio" {
+		t.Fatalf("categories = %+v, want tube then radio", cats)
+	}
+	if len(cats[0].Products) != 2 || cats[0].Products[1].ID != "3" {
+		t.Errorf("tube holds %+v, want 1 and 3", cats[0].Products)
+	}
+}
+
+// addToCart takes the price as a number; quoted, the wasm side reads it with
+// Float and panics. The arguments are JSON, escaped for the attribute.
+func TestIndexRendersProductsFromTheCatalog(t *testing.T) {
+	h := htmlTemplateData{Categories: categories([]product{{ID: "VT-1", Name: "one tube", Category: "tube", Price: 650, Stock: 4}})}
+	out, err := defaultStore.renderPage("index", h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"one tube", "$6.50", "<td>4</td>", "qty-VT-1", "data-args='[&#34;VT-1&#34;,6.5]'"} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("the rendered page has no %q", want)
+		}
+	}
+}
+
+// ── validation and import ────────────────────────────────────────────────────
+
+// Every problem is reported at once, so a hand-edited file is fixed in one go.
+func TestValidateCatalogReportsEverything(t *testing.T) {
+	errs := validateCatalog([]product{
+		{ID: "A", Name: "a", Price: 100},
+		{ID: "A", Name: "dup", Price: 100},
+		{ID: "", Name: "no id", Price: 100},
+		{ID: "B|C", Name: "pipe", Price: 100},
+		{ID: "D", Price: 0, Stock: -1},
+	})
+	if len(errs) != 6 {
+		t.Errorf("got %d errors, want 6: %v", len(errs), errs)
+	}
+	if errs := validateCatalog([]product{{ID: "A", Name: "a", Price: 1}}); len(errs) != 0 {
+		t.Errorf("a good catalog failed: %v", errs)
+	}
+}
+
+func TestCatalogCSVRoundTrips(t *testing.T) {
+	dir := t.TempDir()
+	want := []product{{ID: "VT-1", Name: "one, with a comma", Category: "tube", Price: 650, Stock: 4}}
+	var buf bytes.Buffer
+	if err := writeCatalogCSV(&buf, want); err != nil {
+		t.Fatal(err)
+	}
+	path := dir + "/catalog.csv"
+	if err := os.WriteFile(path, buf.Bytes(), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readCatalogFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0] != want[0] {
+		t.Errorf("round trip gave %+v, want %+v", got, want)
+	}
+}
+
+func TestReadCatalogFileRejectsABadPrice(t *testing.T) {
+	path := t.TempDir() + "/catalog.csv"
+	if err := os.WriteFile(path, []byte("id,name,category,price,stock\nA,a,t,six,1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readCatalogFile(path); err == nil || !strings.Contains(err.Error(), "line 2") {
+		t.Errorf("err = %v, want one naming line 2", err)
+	}
+}
@@ -3,14 +3,19 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"html"
 	"log"
 	"strconv"
 	"strings"
 	"syscall/js"
+
+	"github.com/0magnet/cart/clientconfig"
+	"github.com/0magnet/cart/pow"
 )
 
-// set client pk on compile
-var stripePK string
+// cfg is read from the page at startup rather than compiled in, so the same
+// wasm works with test and live keys alike.
+var cfg clientconfig.Config
 
 type item struct {
 	ID     string `json:"id"`
@@ -25,25 +30,17 @@ var (
 
 func main() {
 	c := make(chan struct{})
-	if stripePK == "" {
-		log.Fatal("Stripe PK not found!")
-	}
-	window := js.Global().Get("window")
-	location := window.Get("location")
-	pathname := location.Get("pathname").String()
-	log.Printf("Current Pathname: %s", pathname)
-
-	switch pathname {
-	case "/":
-		defaultLogic()
-	case "/complete":
-		completeLogic()
-	default:
-		log.Printf("Unknown Pathname: %s", pathname)
+	var err error
+	if cfg, err = clientconfig.Load(); err != nil {
+		log.Fatal("Client config not loaded: ", err)
 	}
+	defaultLogic()
 	<-c
 }
 
+// The page's elements call these by name, from data-click, data-change and
+// data-submit, with the arguments in data-args and then the element and the
+// event; see the theme's actions partial.
 func defaultLogic() {
 	js.Global().Set("addToCart", js.FuncOf(addUnToCart))
 	js.Global().Set("clearStorage", js.FuncOf(clearAll))
@@ -199,7 +196,7 @@ func updateCartDisplay() {
 		total += m.Amount
 		row := doc.Call("createElement", "tr")
 
-		row.Set("innerHTML", fmt.Sprintf(`<td>%s</td><td>$%.2f</td><td>%s</td><td><button onclick='removeFromCart("%s")'>Remove</button></td>`,
+		row.Set("innerHTML", fmt.Sprintf(`<td>%s</td><td>$%.2f</td><td>%s</td><td><button data-click='removeFromCart' data-args='%s'>Remove</button></td>`,
 			func() string {
 				parts := strings.Split(m.ID, "|")
 				if len(parts) < 8 {
@@ -213,9 +210,9 @@ func updateCartDisplay() {
 				if len(strings.Split(m.ID, "|")) == 8 {
 					return ""
 				}
-				return fmt.Sprintf(`<input type='number' value='%d' min='1' onchange='updateItemQuantity("%s", this.value)'>`, m.Qty, m.ID)
+				return fmt.Sprintf(`<input type='number' value='%d' min='1' data-change='updateItemQuantity' data-args='%s'>`, m.Qty, dataArgs(m.ID))
 			}(),
-			m.ID,
+			dataArgs(m.ID),
 		))
 		tbody.Call("appendChild", row)
 	}
@@ -233,9 +230,19 @@ func updateCartDisplay() {
 	}
 }
 
+// dataArgs is the data-args of an element that calls a function with args,
+// escaped for an attribute in single quotes.
+func dataArgs(args ...any) string {
+	data, err := json.Marshal(args)
+	if err != nil {
+		log.Println("dataArgs:", err)
+	}
+	return html.EscapeString(string(data))
+}
+
 func updateItemQuantity(this js.Value, args []js.Value) interface{} {
 	id := args[0].String()
-	qty, err := strconv.Atoi(args[1].String())
+	qty, err := strconv.Atoi(args[1].Get("value").String())
 	if err != nil {
 		log.Println(err)
 	}
@@ -252,8 +259,8 @@ func updateItemQuantity(this js.Value, args []js.Value) interface{} {
 }
 
 func addShippingInfo(this js.Value, args []js.Value) interface{} {
-	event := args[0]
-	form := args[1]
+	form := args[0]
+	event := args[1]
 	event.Call("preventDefault")
 	getFormValue := func(name string) string {
 		return form.Call("querySelector", fmt.Sprintf("[name='%s']", name)).Get("value").String()
@@ -304,7 +311,7 @@ func goToCheckout(this js.Value, args []js.Value) any {
 	if stripe.IsUndefined() {
 		log.Println("Invoking Stripe")
 		//	stripe = stripeValue.Invoke("pk_test...")
-		stripe = stripeValue.Invoke(stripePK)
+		stripe = stripeValue.Invoke(cfg.PublishableKey)
 		if stripe.IsUndefined() {
 			log.Println("Failed to invoke Stripe")
 			return nil
@@ -313,7 +320,7 @@ func goToCheckout(this js.Value, args []js.Value) any {
 	log.Println("Stripe initialized")
 	checkoutStripe.Call("showModal")
 	log.Println("initializePayment()")
-	initializePayment()
+	initializePayment("", "")
 	return nil
 }
 
@@ -324,10 +331,14 @@ func cancelCheckout(this js.Value, args []js.Value) any {
 	return nil
 }
 
-func initializePayment() {
+// initializePayment asks the server for a payment intent. When the server
+// asks for a proof of work first, the challenge is solved and the request
+// made again with the solution.
+func initializePayment(challenge, solution string) {
 	type cItem struct {
 		ID     string `json:"id"`
 		Amount int    `json:"amount"`
+		Qty    int    `json:"quantity"`
 	}
 	type checkout struct {
 		Items []cItem `json:"items"`
@@ -336,7 +347,7 @@ func initializePayment() {
 		Items: func() []cItem {
 			var items []cItem
 			for _, it := range cart {
-				items = append(items, cItem{ID: it.ID + " X " + strconv.Itoa(it.Qty), Amount: it.Amount})
+				items = append(items, cItem{ID: it.ID + " X " + strconv.Itoa(it.Qty), Amount: it.Amount, Qty: it.Qty})
 			}
 			return items
 		}(),
@@ -346,27 +357,53 @@ func initializePayment() {
 		log.Println("Error marshaling JSON:", err)
 		return
 	}
+	headers := cfg.Headers()
+	if challenge != "" {
+		headers[pow.ChallengeHeader] = challenge
+		headers[pow.SolutionHeader] = solution
+	}
 	fetchInit := map[string]interface{}{
-		"method": "POST",
-		"headers": map[string]interface{}{
-			"Content-Type": "application/json",
-		},
-		"body": string(payloadJSON),
+		"method":  "POST",
+		"headers": headers,
+		"body":    string(payloadJSON),
 	}
 
 	log.Println("fetch  /create-payment-intent")
-	js.Global().Call("fetch", "/create-payment-intent", js.ValueOf(fetchInit)).
+	js.Global().Call("fetch", cfg.APIBase+"/create-payment-intent", js.ValueOf(fetchInit)).
 		Call("then", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 			response := args[0]
 			log.Println("got response from fetch /create-payment-intent")
 			if !response.Get("ok").Bool() {
-				log.Println("Fetch request failed with status:", response.Get("status").Int())
-				showMessage("Failed to create payment intent: " + response.Get("status").String())
+				// The server says why, in a 403 for one: the page
+				// having expired.
+				status := response.Get("status").Int()
+				log.Println("Fetch request failed with status:", status)
+				response.Call("json").Call("then", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+					if status == 428 && challenge == "" {
+						challenge, bits := args[0].Get("challenge").String(), args[0].Get("bits").Int()
+						showMessage("Checking your browser…")
+						// Solving blocks the page, so the message is
+						// let to show first.
+						js.Global().Call("setTimeout", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+							initializePayment(challenge, pow.Solve(challenge, bits))
+							return nil
+						}), 0)
+						return nil
+					}
+					showMessage("Failed to create payment intent: " + clientconfig.ErrorMessage(args[0]))
+					return nil
+				})).Call("catch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+					showMessage(fmt.Sprintf("Failed to create payment intent: %d", status))
+					return nil
+				}))
 				return nil
 			}
 			response.Call("json").Call("then", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
 				clientSecret := args[0].Get("clientSecret").String()
-				log.Println("Client secret received:", clientSecret)
+				log.Println("Client secret received")
+				if challenge != "" {
+					showMessage("")
+				}
 				setupStripeElements(clientSecret)
 				return nil
 			})).Call("catch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
@@ -427,7 +464,6 @@ func confirmPayment(clientSecret string) {
 
 	returnURL := baseURL + "/complete"
 	returnURL += "?payment_intent=" + clientSecret // + "#complete"
-	log.Println("Return URL for payment:", returnURL)
 
 	stripe.Call("confirmPayment", map[string]interface{}{
 		"elements": elements,
@@ -467,194 +503,3 @@ func showSpinner(isLoading bool) {
 		buttonText.Set("className", "")
 	}
 }
-
-// /complete
-
-func completeLogic() {
-	initializeStripe()
-}
-
-func initializeStripe() {
-	stripeValue := js.Global().Get("Stripe")
-	if stripeValue.IsUndefined() {
-		log.Println("Stripe is not defined")
-		return
-	}
-
-	// stripe = stripeValue.Invoke("pk_...")
-	stripe = stripeValue.Invoke(stripePK)
-
-	if stripe.IsUndefined() {
-		log.Println("Failed to initialize Stripe")
-		return
-	}
-	checkStatus()
-}
-
-var (
-	successIcon = `<svg width="16" height="14" viewBox="0 0 16 14" fill="none" xmlns="http://www.w3.org/2000/svg">
-		<path fill-rule="evenodd" clip-rule="evenodd" d="M15.4695 0.232963C15.8241 0.561287 15.8454 1.1149 15.5171 1.46949L6.14206 11.5945C5.97228 11.7778 5.73221 11.8799 5.48237 11.8748C5.23253 11.8698 4.99677 11.7582 4.83452 11.5681L0.459523 6.44311C0.145767 6.07557 0.18937 5.52327 0.556912 5.20951C0.924454 4.89575 1.47676 4.93936 1.79051 5.3069L5.52658 9.68343L14.233 0.280522C14.5613 -0.0740672 15.1149 -0.0953599 15.4695 0.232963Z" fill="white"/>
-	</svg>`
-
-	errorIcon = `<svg width="16" height="16" viewBox="0 0 16 16" fill="none" xmlns="http://www.w3.org/2000/svg">
-		<path fill-rule="evenodd" clip-rule="evenodd" d="M1.25628 1.25628C1.59799 0.914573 2.15201 0.914573 2.49372 1.25628L8 6.76256L13.5063 1.25628C13.848 0.914573 14.402 0.914573 14.7437 1.25628C15.0854 1.59799 15.0854 2.15201 14.7437 2.49372L9.23744 8L14.7437 13.5063C15.0854 13.848 15.0854 14.402 14.7437 14.7437C14.402 15.0854 13.848 15.0854 13.5063 14.7437L8 9.23744L2.49372 14.7437C2.15201 15.0854 1.59799 15.0854 1.25628 14.7437C0.914573 14.402 0.914573 13.848 1.25628 13.5063L6.76256 8L1.25628 2.49372C0.914573 2.15201 0.914573 1.59799 1.25628 1.25628Z" fill="white"/>
-	</svg>`
-
-	infoIcon = `<svg width="14" height="14" viewBox="0 0 14 14" fill="none" xmlns="http://www.w3.org/2000/svg">
-		<path fill-rule="evenodd" clip-rule="evenodd" d="M10 1.5H4C2.61929 1.5 1.5 2.61929 1.5 4V10C1.5 11.3807 2.61929 12.5 4 12.5H10C11.3807 12.5 12.5 11.3807 12.5 10V4C12.5 2.61929 11.3807 1.5 10 1.5ZM4 0C1.79086 0 0 1.79086 0 4V10C0 12.2091 1.79086 14 4 14H10C12.2091 14 14 12.2091 14 10V4C14 1.79086 12.2091 0 10 0H4Z" fill="white"/>
-		<path fill-rule="evenodd" clip-rule="evenodd" d="M5.25 7C5.25 6.58579 5.58579 6.25 6 6.25H7.25C7.66421 6.25 8 6.58579 8 7V10.5C8 10.9142 7.66421 11.25 7.25 11.25C6.83579 11.25 6.5 10.9142 6.5 10.5V7.75H6C5.58579 7.75 5.25 7.41421 5.25 7Z" fill="white"/>
-		<path d="M5.75 4C5.75 3.31075 6.31075 2.75 7 2.75C7.68925 2.75 8.25 3.31075 8.25 4C8.25 4.68925 7.68925 5.25 7 5.25C6.31075 5.25 5.75 4.68925 5.75 4Z" fill="white"/>
-	</svg>`
-)
-
-func setErrorState() {
-	js.Global().Get("document").Call("querySelector", "#status-icon").Set("style", map[string]interface{}{"backgroundColor": "#DF1B41"})
-	js.Global().Get("document").Call("querySelector", "#status-icon").Set("innerHTML", errorIcon)
-	js.Global().Get("document").Call("querySelector", "#status-text").Set("textContent", "Something went wrong, please try again.")
-	js.Global().Get("document").Call("querySelector", "#details-table").Call("classList").Call("add", "hidden")
-	js.Global().Get("document").Call("querySelector", "#view-details").Call("classList").Call("add", "hidden")
-}
-
-func checkStatus() {
-	clientSecret := js.Global().Get("URLSearchParams").New(js.Global().Get("window").Get("location").Get("search")).Call("get", "payment_intent_client_secret").String()
-
-	if clientSecret == "" {
-		setErrorState()
-		return
-	}
-
-	if stripe.IsUndefined() {
-		log.Println("Stripe is not initialized")
-		setErrorState()
-		return
-	}
-
-	stripe.Call("retrievePaymentIntent", clientSecret).Call("then", js.FuncOf(func(this js.Value, p []js.Value) interface{} {
-		paymentIntent := p[0].Get("paymentIntent")
-		setPaymentDetails(paymentIntent)
-		return nil
-	})).Call("catch", js.FuncOf(func(this js.Value, p []js.Value) interface{} {
-		setErrorState()
-		return nil
-	}))
-}
-
-func getAllLocalStorageData() map[string]interface{} {
-	localStorage := js.Global().Get("localStorage")
-	keys := js.Global().Get("Object").Call("keys", localStorage)
-	data := make(map[string]interface{})
-
-	for i := 0; i < keys.Length(); i++ {
-		key := keys.Index(i).String()
-		value := localStorage.Call("getItem", key).String()
-		var parsedValue interface{}
-		err := json.Unmarshal([]byte(value), &parsedValue)
-		if err != nil {
-			parsedValue = value // If not JSON, store raw value
-		}
-		data[key] = parsedValue
-	}
-	return data
-}
-
-func submitOrder(localStorageData map[string]interface{}, paymentIntentId string) {
-	orderData := map[string]interface{}{
-		"localStorageData": localStorageData,
-		"paymentIntentId":  paymentIntentId,
-	}
-
-	body, err := json.Marshal(orderData)
-	if err != nil {
-		log.Println("Error marshaling order data:", err)
-		return
-	}
-
-	fetch := js.Global().Get("fetch")
-	if fetch.IsUndefined() {
-		log.Println("Fetch API is not available")
-		return
-	}
-
-	options := map[string]interface{}{
-		"method": "POST",
-		"headers": map[string]interface{}{
-			"Content-Type": "application/json",
-		},
-		"body": string(body),
-	}
-
-	fetch.Invoke("/submit-order", js.ValueOf(options)).Call("then", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		response := args[0]
-		response.Call("json").Call("then", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-			data := args[0]
-			log.Println("Order submitted successfully:", data)
-			return nil
-		})).Call("catch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-			err := args[0]
-			log.Println("Error parsing order response:", err)
-			return nil
-		}))
-		return nil
-	})).Call("catch", js.FuncOf(func(this js.Value, args []js.Value) interface{} {
-		err := args[0]
-		log.Println("Error submitting order:", err)
-		return nil
-	}))
-}
-
-func setPaymentDetails(intent js.Value) {
-	// Every path through the switch below sets this, including its default,
-	// so there is nothing to fall back to. iconColor and icon do fall back:
-	// the cases that only change the wording leave them red.
-	var statusText string
-	iconColor := "#DF1B41"
-	icon := errorIcon
-
-	if !intent.IsUndefined() {
-		intentStatus := intent.Get("status").String()
-		intentID := intent.Get("id").String()
-
-		allLocalStorageData := getAllLocalStorageData()
-
-		switch intentStatus {
-		case "succeeded":
-			statusText = "Payment succeeded"
-			iconColor = "#30B130"
-			icon = successIcon
-			if len(allLocalStorageData) > 0 {
-				submitOrder(allLocalStorageData, intentID)
-			} else {
-				log.Println("No data found in localStorage; order not submitted.")
-			}
-		case "processing":
-			statusText = "Your payment is processing."
-			iconColor = "#6D6E78"
-			icon = infoIcon
-			if len(allLocalStorageData) > 0 {
-				submitOrder(allLocalStorageData, intentID)
-			} else {
-				log.Println("No data found in localStorage; order not submitted.")
-			}
-		case "requires_payment_method":
-			statusText = "Your payment was not successful, please try again."
-		default:
-			statusText = "Unknown payment status."
-		}
-
-		// Update the status icon, text, and links
-		js.Global().Get("document").Call("querySelector", "#status-icon").Set("style", map[string]interface{}{"backgroundColor": iconColor})
-		js.Global().Get("document").Call("querySelector", "#status-icon").Set("innerHTML", icon)
-		js.Global().Get("document").Call("querySelector", "#status-text").Set("textContent", statusText)
-		js.Global().Get("document").Call("querySelector", "#intent-id").Set("textContent", intentID)
-		js.Global().Get("document").Call("querySelector", "#intent-status").Set("textContent", intentStatus)
-		js.Global().Get("document").Call("querySelector", "#view-details").Set("href", "https://dashboard.stripe.com/payments/"+intentID)
-
-		// Update the "Order Details" link with the paymentIntent ID
-		orderDetailsLink := js.Global().Get("document").Call("querySelector", "#order-details-link")
-		orderDetailsLink.Set("href", "/order/"+intentID)
-		orderDetailsLink.Set("onclick", nil) // Allow default behavior (navigation)
-
-	} else {
-		setErrorState()
-	}
-}
@@ -0,0 +1,454 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stripe/stripe-go/v80"
+)
+
+var rootCmd = &cobra.Command{
+	Use:   "srv",
+	Short: "stripe test server for webassembly",
+	// A setting that could not be read is an error before anything runs,
+	// rather than a default nobody chose. config check is the exception: it
+	// is how to find out what is wrong.
+	PersistentPreRunE: func(cmd *cobra.Command, _ []string) error {
+		if cmd == configCheckCmd {
+			return nil
+		}
+		cmd.SilenceUsage = true
+		if len(configErrs) > 0 {
+			return fmt.Errorf("bad configuration: %w", errors.Join(configErrs...))
+		}
+		return resolveSecrets(cmd)
+	},
+}
+
+// startFlags begins a command's flags. Shorthands are handed out per command,
+// so every command starts again from the first letter.
+func startFlags(cmd *cobra.Command) {
+	cmd.Flags().SortFlags = false
+	nextShortIndex = 0
+}
+
+// addStripeFlags adds the key-mode flag and whichever of the key pairs a
+// command needs: the secret keys to talk to Stripe, the publishable keys for
+// the pages to start Stripe.js with.
+func addStripeFlags(cmd *cobra.Command, sk, pk bool) {
+	addBoolFlag(cmd, &f, &f.Teststripekey, "use stripe test api keys instead of live key")
+	if sk {
+		addStringFlag(cmd, &f, &f.StripeliveSK, "stripe live api sk")
+	}
+	if pk {
+		addStringFlag(cmd, &f, &f.StripelivePK, "stripe live api pk")
+	}
+	if sk {
+		addStringFlag(cmd, &f, &f.StripetestSK, "stripe test api sk")
+	}
+	if pk {
+		addStringFlag(cmd, &f, &f.StripetestPK, "stripe test api pk")
+	}
+	if sk {
+		addStringFlag(cmd, &f, &f.StripeliveSKFile, "file to read the stripe live api sk from")
+		addStringFlag(cmd, &f, &f.StripetestSKFile, "file to read the stripe test api sk from")
+	}
+}
+
+// addStoreFlags adds what a command needs to work on one of the stores in
+// STORES rather than the one the flags describe.
+func addStoreFlags(cmd *cobra.Command) {
+	addStringFlag(cmd, &f, &f.Stores, "file of stores by host name, as serve reads it")
+	addStringFlag(cmd, &f, &f.Store, "host of the store in STORES to work on; unset for the one the flags describe")
+}
+
+func init() {
+	stripe.EnableTelemetry = false
+	rootCmd.SetUsageTemplate(help)
+	rootCmd.AddCommand(serveCmd, buildCmd, ordersCmd, catalogCmd, configCmd, cacheCmd, exportCmd)
+	ordersCmd.AddCommand(ordersListCmd, ordersShowCmd, ordersExportCmd, refundCmd)
+	catalogCmd.AddCommand(catalogImportCmd, catalogExportCmd, catalogValidateCmd)
+	configCmd.AddCommand(configCheckCmd)
+	cacheCmd.AddCommand(cachePruneCmd)
+
+	f.Dev = prebuilt == nil
+	for _, cmd := range []*cobra.Command{serveCmd, configCheckCmd} {
+		startFlags(cmd)
+		addStripeFlags(cmd, true, true)
+		addIntFlag(cmd, &f, &f.WebPort, "port to serve on")
+		addStringFlag(cmd, &f, &f.AdminToken, "bearer token for the /admin endpoints; unset disables them")
+		addStringFlag(cmd, &f, &f.Catalog, "product catalog file")
+		addStringFlag(cmd, &f, &f.OrdersDir, "directory orders are written to")
+		addBoolFlag(cmd, &f, &f.Dev, "compile the wasm from source and rebuild it on change, instead of serving the one built in")
+		addStringFlag(cmd, &f, &f.WasmRoutes, "which wasm each page loads, as route=entrypoint,...; unset keeps the built-in ones")
+		addStringFlag(cmd, &f, &f.Currency, "currency prices are charged in, as an ISO code")
+		addStringFlag(cmd, &f, &f.APIBase, "origin the pages send api requests to; unset for the one they came from")
+		addStringFlag(cmd, &f, &f.Features, "comma-separated feature flags handed to the wasm")
+		addStringFlag(cmd, &f, &f.Compiler, "go or tinygo, for all entrypoints or as entrypoint=compiler,...; tinygo falls back to go when it is not installed")
+		addStringFlag(cmd, &f, &f.CacheDir, "directory compiled wasm is kept in by a hash of its sources; unset disables the cache")
+		addStringFlag(cmd, &f, &f.Theme, "directory whose files override the built-in theme's of the same name")
+		addBoolFlag(cmd, &f, &f.APIOnly, "serve only the api, for pages exported with srv export and hosted elsewhere")
+		addStringFlag(cmd, &f, &f.CORSOrigins, "origins whose pages may call the api, comma-separated, or * for any; unset for none")
+		addDurationFlag(cmd, &f, &f.ReadHeaderTimeout, "how long a client has to send a request's headers")
+		addDurationFlag(cmd, &f, &f.ReadTimeout, "how long a client has to send a whole request")
+		addDurationFlag(cmd, &f, &f.WriteTimeout, "how long a response may take to send, from the end of its request's headers")
+		addDurationFlag(cmd, &f, &f.IdleTimeout, "how long a kept-alive connection may sit idle")
+		addIntFlag(cmd, &f, &f.MaxHeaderBytes, "largest a request's headers may be, in bytes")
+		addDurationFlag(cmd, &f, &f.ShutdownTimeout, "how long requests in flight get to finish on SIGTERM or ctrl-c")
+		addStringFlag(cmd, &f, &f.TLSCert, "certificate file to serve https with, reloaded when it changes; unset serves http")
+		addStringFlag(cmd, &f, &f.TLSKey, "private key file for TLSCERT, reloaded when it changes")
+		addIntFlag(cmd, &f, &f.RedirectPort, "port to redirect http requests to https from; unset for none")
+		addDurationFlag(cmd, &f, &f.HSTSMaxAge, "how long browsers are told to use only https, sent with TLSCERT; unset for never")
+		addBoolFlag(cmd, &f, &f.CSPReportOnly, "only report what the content security policy would block, instead of blocking it")
+		addStringFlag(cmd, &f, &f.Listen, "unix:<path> or systemd to serve on a unix socket or the one systemd passed, instead of WEBPORT")
+		addStringFlag(cmd, &f, &f.CSRFKey, "secret the CSRF tokens are signed with; unset for one made at startup, which a restart changes")
+		addIntFlag(cmd, &f, &f.IntentsPerIP, "payment intents one IP may create within INTENTWINDOW; 0 for no limit")
+		addIntFlag(cmd, &f, &f.IntentsPerSession, "payment intents one browser session may create within INTENTWINDOW; 0 for no limit")
+		addDurationFlag(cmd, &f, &f.IntentWindow, "window the payment intent and failed payment limits count over")
+		addIntFlag(cmd, &f, &f.FailedPayments, "failed payments one IP, session or card may have within INTENTWINDOW before its payment intents are refused; 0 for no limit")
+		addIntFlag(cmd, &f, &f.PoWBits, "difficulty of the proof of work asked for before each payment intent, in bits; 0 for none")
+		addStringFlag(cmd, &f, &f.Blocklist, "file of IPs, CIDR ranges and card:<fingerprint>s refused payment intents, reread when it changes")
+		addStringFlag(cmd, &f, &f.TrustedProxies, "IPs and CIDR ranges of the proxies in front, comma-separated, whose CLIENTIPHEADERS are believed; unset for none")
+		addStringFlag(cmd, &f, &f.ClientIPHeaders, "headers trusted proxies name the client in, comma-separated, first found first: X-Forwarded-For, X-Real-IP, Forwarded, CF-Connecting-IP")
+		addStringFlag(cmd, &f, &f.LogFormat, "text, for a terminal, or json, a record a line for a log collector")
+		addStringFlag(cmd, &f, &f.LogLevel, "least severe log lines written: debug, info, warn or error")
+		addStringFlag(cmd, &f, &f.MetricsToken, "bearer token /metrics asks for; unset serves it to anyone")
+		addIntFlag(cmd, &f, &f.MaxItems, "most lines a cart, an order or a restock may have")
+		addIntFlag(cmd, &f, &f.MaxQuantity, "most of one item a cart line may have")
+		addStringFlag(cmd, &f, &f.Stores, "file of stores by host name, each with its own catalog, theme, orders, currency, stripe keys and mail settings; unset for one store")
+		addStringFlag(cmd, &f, &f.SMTPAddr, "host:port of the mail server a notice of each new order is sent through; unset sends none")
+		addStringFlag(cmd, &f, &f.SMTPUser, "user to log in to SMTPADDR as; unset for no login")
+		addStringFlag(cmd, &f, &f.SMTPPasswordFile, "file to read SMTPUSER's password from, or set SMTPPASSWORD")
+		addStringFlag(cmd, &f, &f.EmailFrom, "address order notices are sent from")
+		addStringFlag(cmd, &f, &f.EmailTo, "addresses order notices are sent to, comma-separated")
+	}
+	addStringFlag(configCheckCmd, &f, &f.OutDir, "directory srv build writes to")
+
+	startFlags(buildCmd)
+	addStringFlag(buildCmd, &f, &f.OutDir, "directory to write the wasm and assets to")
+	addStringFlag(buildCmd, &f, &f.WasmRoutes, "which wasm each page loads, as route=entrypoint,...; unset keeps the built-in ones")
+	addStringFlag(buildCmd, &f, &f.Compiler, "go or tinygo, for all entrypoints or as entrypoint=compiler,...; tinygo falls back to go when it is not installed")
+	addStringFlag(buildCmd, &f, &f.CacheDir, "directory compiled wasm is kept in by a hash of its sources; unset disables the cache")
+	addStringFlag(buildCmd, &f, &f.Theme, "directory whose files override the built-in theme's of the same name")
+
+	startFlags(exportCmd)
+	addStripeFlags(exportCmd, false, true)
+	addStringFlag(exportCmd, &f, &f.ExportDir, "directory to write the static site to")
+	addStringFlag(exportCmd, &f, &f.APIBase, "origin the pages send api requests to: where serve --apionly runs")
+	addStringFlag(exportCmd, &f, &f.Catalog, "product catalog file")
+	addStringFlag(exportCmd, &f, &f.Currency, "currency prices are charged in, as an ISO code")
+	addStringFlag(exportCmd, &f, &f.Features, "comma-separated feature flags handed to the wasm")
+	addBoolFlag(exportCmd, &f, &f.Dev, "compile the wasm from source, instead of exporting the one built in")
+	addStringFlag(exportCmd, &f, &f.WasmRoutes, "which wasm each page loads, as route=entrypoint,...; unset keeps the built-in ones")
+	addStringFlag(exportCmd, &f, &f.Compiler, "go or tinygo, for all entrypoints or as entrypoint=compiler,...; tinygo falls back to go when it is not installed")
+	addStringFlag(exportCmd, &f, &f.CacheDir, "directory compiled wasm is kept in by a hash of its sources; unset disables the cache")
+	addStringFlag(exportCmd, &f, &f.Theme, "directory whose files override the built-in theme's of the same name")
+
+	startFlags(cachePruneCmd)
+	addStringFlag(cachePruneCmd, &f, &f.CacheDir, "directory compiled wasm is kept in by a hash of its sources")
+	cachePruneCmd.Flags().DurationVar(&pruneFlags.maxAge, "max-age", 30*24*time.Hour, "remove builds not used for this long; 0 keeps them however old")
+	cachePruneCmd.Flags().Int64Var(&pruneFlags.maxSize, "max-size", 0, "then remove the least recently used until the rest fit in this many MB; 0 for no limit")
+
+	for _, cmd := range []*cobra.Command{ordersListCmd, ordersShowCmd, ordersExportCmd} {
+		startFlags(cmd)
+		addStringFlag(cmd, &f, &f.OrdersDir, "directory orders are written to")
+		addStoreFlags(cmd)
+	}
+	ordersExportCmd.Flags().StringVar(&ordersFormat, "format", "json", "json or csv")
+
+	startFlags(refundCmd)
+	refundCmd.Flags().Int64Var(&refundFlags.amount, "amount", 0, "amount to refund in cents; 0 refunds the rest of the payment")
+	refundCmd.Flags().StringVar(&refundFlags.reason, "reason", "", "duplicate, fraudulent or requested_by_customer")
+	refundCmd.Flags().StringSliceVar(&refundFlags.restock, "restock", nil, "item to put back in stock, as id or id:quantity; repeatable")
+	refundCmd.Flags().BoolVar(&refundFlags.restockAll, "restock-all", false, "put everything on the order not yet restocked back in stock")
+	addStripeFlags(refundCmd, true, false)
+	addStringFlag(refundCmd, &f, &f.Catalog, "product catalog file")
+	addStringFlag(refundCmd, &f, &f.OrdersDir, "directory orders are written to")
+	addStoreFlags(refundCmd)
+
+	for _, cmd := range []*cobra.Command{catalogImportCmd, catalogExportCmd, catalogValidateCmd} {
+		startFlags(cmd)
+		addStringFlag(cmd, &f, &f.Catalog, "product catalog file")
+	}
+	addStoreFlags(catalogImportCmd)
+	addStoreFlags(catalogExportCmd)
+	addStoreFlags(catalogValidateCmd)
+	catalogExportCmd.Flags().StringVar(&catalogFormat, "format", "json", "json or csv")
+}
+
+var buildCmd = &cobra.Command{
+	Use:   "build",
+	Short: "compile the wasm and write it out with the assets it needs",
+	Args:  cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		requireGo()
+		if err := applyWasmRoutes(f.WasmRoutes); err != nil {
+			log.Fatal(err)
+		}
+		if err := selectCompilers(f.Compiler); err != nil {
+			log.Fatal(err)
+		}
+		if err := loadThemes(); err != nil {
+			log.Fatal(err)
+		}
+		if err := buildAssets(f.OutDir); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+// wasmName is the file a wasm entrypoint is written out as:
+// checkout_wasm.go becomes checkout.wasm.
+func wasmName(src string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(filepath.Base(src), ".go"), "_wasm") + ".wasm"
+}
+
+// buildAssets compiles every wasm entrypoint into dir, all at once, next to
+// the wasm_exec.js each needs, the manifest saying which that is, and the
+// theme's stylesheets and scripts.
+func buildAssets(dir string) error {
+	if err := os.MkdirAll(dir, 0o750); err != nil {
+		return err
+	}
+	err := eachWasm(func(i int) error {
+		data, err := compileWasm(wasmFiles[i].Name, wasmFiles[i].Tiny)
+		if err != nil {
+			return fmt.Errorf("%s: %w", wasmFiles[i].Name, err)
+		}
+		return os.WriteFile(filepath.Join(dir, wasmName(wasmFiles[i].Name)), data, 0o600)
+	})
+	if err != nil {
+		return err
+	}
+	manifest := map[string]string{}
+	for i := range wasmFiles {
+		if wasmFiles[i].Cmp {
+			manifest[wasmName(wasmFiles[i].Name)] = compilerName(wasmFiles[i].Tiny)
+		}
+	}
+	for _, i := range wasmExecInUse() {
+		data, err := os.ReadFile(jsFiles[i].Name)
+		if err != nil {
+			return err
+		}
+		if err := os.WriteFile(filepath.Join(dir, wasmExecName(i)), data, 0o600); err != nil {
+			return err
+		}
+	}
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, manifestName), data, 0o600); err != nil {
+		return err
+	}
+	for i := range htmlFiles {
+		if htmlFiles[i].Theme == "" || isTemplate(htmlFiles[i].Theme) {
+			continue
+		}
+		out := filepath.Join(dir, filepath.FromSlash(htmlFiles[i].Theme))
+		if err := os.MkdirAll(filepath.Dir(out), 0o750); err != nil {
+			return err
+		}
+		if err := os.WriteFile(out, readFile(htmlFiles, i), 0o600); err != nil {
+			return err
+		}
+	}
+	fmt.Println("wrote", dir)
+	return nil
+}
+
+// wasmExecName is what the wasm_exec.js at index i of jsFiles is written out
+// as, so that both can sit side by side.
+func wasmExecName(i int) string {
+	if i == wasmExecJS(true) {
+		return "wasm_exec_tinygo.js"
+	}
+	return "wasm_exec.js"
+}
+
+// manifestName is the file buildAssets records the compiler of each
+// entrypoint in, since that decides which wasm_exec.js goes with it.
+const manifestName = "manifest.json"
+
+// loadPrebuilt fills the asset table from the output of buildAssets instead of
+// compiling it: each wasm entrypoint and the wasm_exec.js it needs.
+func loadPrebuilt(fsys fs.FS) error {
+	if data, err := fs.ReadFile(fsys, manifestName); err == nil {
+		manifest := map[string]string{}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return fmt.Errorf("%s: %w", manifestName, err)
+		}
+		for i := range wasmFiles {
+			if c, ok := manifest[wasmName(wasmFiles[i].Name)]; ok {
+				wasmFiles[i].Tiny = c == "tinygo"
+			}
+		}
+	}
+	for i := range wasmFiles {
+		if !wasmFiles[i].Cmp {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, wasmName(wasmFiles[i].Name))
+		if err != nil {
+			return err
+		}
+		js := wasmExecJS(wasmFiles[i].Tiny)
+		jsData, err := fs.ReadFile(fsys, wasmExecName(js))
+		if err != nil {
+			return err
+		}
+		wasmFiles[i].Mu.Lock()
+		wasmFiles[i].Data, wasmFiles[i].Built = data, time.Now()
+		wasmFiles[i].URL = publishAsset(wasmName(wasmFiles[i].Name), data)
+		wasmFiles[i].Mu.Unlock()
+		jsFiles[js].Mu.Lock()
+		jsFiles[js].Data = jsData
+		jsFiles[js].URL = publishAsset(wasmExecName(js), jsData)
+		jsFiles[js].Mu.Unlock()
+	}
+	return nil
+}
+
+var configCmd = &cobra.Command{
+	Use:   "config",
+	Short: "inspect the configuration",
+}
+
+var configCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "print the configuration in effect and report anything wrong with it",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, _ []string) {
+		if menvfile != "" {
+			fmt.Println("MENV", menvfile)
+		}
+		secretErr := resolveSecrets(cmd)
+		errs := checkConfig()
+		if secretErr != nil {
+			errs = append(errs, secretErr)
+		}
+		printConfig(os.Stdout, cmd)
+		for _, err := range errs {
+			fmt.Println(err)
+		}
+		if len(errs) > 0 {
+			os.Exit(1)
+		}
+		fmt.Println("config ok")
+	},
+}
+
+// printConfig lists the settings by their environment names, the same names
+// MENV uses, with the secrets hidden and where each value came from. A Stripe
+// secret key keeps its prefix, which says only what kind of key it is; the
+// tokens and CSRFKEY are shown only as set or unset.
+func printConfig(w io.Writer, cmd *cobra.Command) {
+	v := reflect.ValueOf(&f).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		name := v.Type().Field(i).Name
+		if name == "StripeSK" || name == "StripePK" {
+			continue // chosen from the others by selectStripeKeys
+		}
+		val := fmt.Sprint(v.Field(i).Interface())
+		switch {
+		case strings.HasSuffix(name, "SK"):
+			val = maskSecret(val)
+		case name == "AdminToken" || name == "CSRFKey" || name == "MetricsToken" || name == "SMTPPassword":
+			val = secretSet(val)
+		}
+		from := "default"
+		if file := v.FieldByName(name + "File"); file.IsValid() && file.String() != "" {
+			from = file.String()
+		} else if cmd.Flags().Changed(strings.ToLower(name)) {
+			from = "flag"
+		} else if _, src, ok := configValue(strings.ToUpper(name)); ok {
+			from = src
+		}
+		fmt.Fprintf(w, "%-17s %-24s %s\n", strings.ToUpper(name), val, from)
+	}
+}
+
+func maskSecret(s string) string {
+	if len(s) <= 8 {
+		return strings.Repeat("*", len(s))
+	}
+	return s[:8] + strings.Repeat("*", 8)
+}
+
+// secretSet says whether a secret has a value, and nothing of the value.
+func secretSet(s string) string {
+	if s == "" {
+		return "(unset)"
+	}
+	return "(set)"
+}
+
+// checkConfig reports every problem with the settings that would stop the
+// server working, rather than the first.
+func checkConfig() []error {
+	errs := append([]error(nil), configErrs...)
+	if !f.Dev && prebuilt == nil && !f.APIOnly {
+		errs = append(errs, errors.New("DEV: false, but this binary was built without -tags release and has no prebuilt wasm to serve"))
+	}
+	if err := applyWasmRoutes(f.WasmRoutes); err != nil {
+		errs = append(errs, err)
+	}
+	if _, err := compilers(f.Compiler); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, checkCORSOrigins(corsOrigins(f.CORSOrigins))...)
+	errs = append(errs, checkLimits()...)
+	// WEBPORT goes unused when the server listens on a socket.
+	if f.Listen == "" && (f.WebPort < 1 || f.WebPort > 65535) {
+		errs = append(errs, fmt.Errorf("WEBPORT: %d is not a port", f.WebPort))
+	}
+	for _, d := range []*time.Duration{&f.ReadHeaderTimeout, &f.ReadTimeout, &f.WriteTimeout, &f.IdleTimeout, &f.ShutdownTimeout} {
+		if *d <= 0 {
+			errs = append(errs, fmt.Errorf("%s: %v is not a timeout; it has to be more than 0", ccc(d, &f, a), *d))
+		}
+	}
+	if err := checkListen(f.Listen); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, checkTLS()...)
+	errs = append(errs, checkGuard()...)
+	if _, err := parseProxies(f.TrustedProxies); err != nil {
+		errs = append(errs, err)
+	}
+	errs = append(errs, checkLogging()...)
+	if f.MaxHeaderBytes < 1 {
+		errs = append(errs, fmt.Errorf("MAXHEADERBYTES: %d is not a size", f.MaxHeaderBytes))
+	}
+	if fi, err := os.Stat(f.CacheDir); err == nil && !fi.IsDir() {
+		errs = append(errs, fmt.Errorf("CACHEDIR: %s is not a directory", f.CacheDir))
+	}
+	if err := initStores(); err != nil {
+		errs = append(errs, err)
+	}
+	themesErr := loadThemes()
+	if themesErr != nil {
+		errs = append(errs, themesErr)
+	}
+	for _, s := range allStores() {
+		errs = append(errs, s.check()...)
+		if themesErr == nil && (s.Host == "" || s.themeTag() != "") {
+			for _, err := range s.checkTheme() {
+				errs = append(errs, fmt.Errorf("%s: %w", s.setting("THEME", "theme"), err))
+			}
+		}
+	}
+	return errs
+}
@@ -0,0 +1,200 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+// ── commands ─────────────────────────────────────────────────────────────────
+
+func TestEveryBacklogCommandIsThere(t *testing.T) {
+	for _, path := range [][]string{
+		{"serve"}, {"build"}, {"config", "check"},
+		{"orders", "list"}, {"orders", "show"}, {"orders", "export"}, {"orders", "refund"},
+		{"catalog", "import"}, {"catalog", "export"}, {"catalog", "validate"},
+	} {
+		cmd, rest, err := rootCmd.Find(path)
+		if err != nil || len(rest) != 0 || cmd.Name() != path[len(path)-1] {
+			t.Errorf("srv %s is not a command", strings.Join(path, " "))
+		}
+	}
+}
+
+// Every flag that names a setting reads its default from the same place, so
+// the flag has the same name under every command that takes it.
+func TestSharedSettingsHaveOneNameEverywhere(t *testing.T) {
+	for _, path := range [][]string{{"serve"}, {"orders", "refund"}, {"orders", "list"}, {"config", "check"}} {
+		cmd, _, err := rootCmd.Find(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cmd.Flags().Lookup("ordersdir") == nil {
+			t.Errorf("srv %s has no --ordersdir", strings.Join(path, " "))
+		}
+	}
+}
+
+// ── build ────────────────────────────────────────────────────────────────────
+
+func TestWasmNameDropsTheSuffix(t *testing.T) {
+	for src, want := range map[string]string{
+		"checkout_wasm.go":     "checkout.wasm",
+		"sub/complete_wasm.go": "complete.wasm",
+		"plain.go":             "plain.wasm",
+	} {
+		if got := wasmName(src); got != want {
+			t.Errorf("wasmName(%q) = %q, want %q", src, got, want)
+		}
+	}
+}
+
+// What build writes is what a release binary reads back, under the same
+// names, wasm_exec.js included.
+func TestLoadPrebuiltReadsWhatBuildWrites(t *testing.T) {
+	saved := make([][]byte, len(wasmFiles))
+	for i := range wasmFiles {
+		saved[i] = wasmFiles[i].Data
+	}
+	js := jsFiles[wasmExecJS(true)].Data
+	defer func() {
+		for i := range saved {
+			wasmFiles[i].Data = saved[i]
+		}
+		jsFiles[wasmExecJS(true)].Data = js
+	}()
+
+	dist := fstest.MapFS{
+		wasmExecName(wasmExecJS(true)): {Data: []byte("// exec")},
+		"checkout.css":                 {Data: []byte("body{}")},
+	}
+	for i := range wasmFiles {
+		dist[wasmName(wasmFiles[i].Name)] = &fstest.MapFile{Data: []byte("\x00asm " + wasmFiles[i].Name)}
+	}
+	if err := loadPrebuilt(dist); err != nil {
+		t.Fatal(err)
+	}
+	for i := range wasmFiles {
+		if got := string(readFile(wasmFiles, i)); got != "\x00asm "+wasmFiles[i].Name {
+			t.Errorf("%s = %q", wasmFiles[i].Name, got)
+		}
+	}
+	if got := string(readFile(jsFiles, wasmExecJS(true))); got != "// exec" {
+		t.Errorf("wasm_exec.js = %q", got)
+	}
+
+	delete(dist, wasmExecName(wasmExecJS(true)))
+	if err := loadPrebuilt(dist); err == nil {
+		t.Error("a dist without its wasm_exec.js loaded")
+	}
+}
+
+// ── config check ─────────────────────────────────────────────────────────────
+
+func TestMaskSecretNeverShowsTheWholeKey(t *testing.T) {
+	for _, s := range []string{"sk_test_51abcdefghijklmnop", "short", ""} {
+		got := maskSecret(s)
+		if s != "" && got == s {
+			t.Errorf("maskSecret(%q) showed it whole", s)
+		}
+		if len(s) > 8 && !strings.HasPrefix(got, s[:8]) {
+			t.Errorf("maskSecret(%q) = %q, which no longer says what kind of key it is", s, got)
+		}
+	}
+}
+
+// A token has no kind to show, so none of it is shown.
+func TestTokensAreShownOnlyAsSet(t *testing.T) {
+	saved := f
+	t.Cleanup(func() { f = saved })
+	f.AdminToken, f.CSRFKey, f.MetricsToken = "admin-0123456789", "csrf-0123456789", ""
+	var out bytes.Buffer
+	printConfig(&out, configCheckCmd)
+	for _, secret := range []string{"admin-", "csrf-"} {
+		if strings.Contains(out.String(), secret) {
+			t.Errorf("config check prints %q", secret)
+		}
+	}
+	for _, want := range []string{`ADMINTOKEN +\(set\)`, `CSRFKEY +\(set\)`, `METRICSTOKEN +\(unset\)`} {
+		if !regexp.MustCompile(want).MatchString(out.String()) {
+			t.Errorf("config check has no line matching %s", want)
+		}
+	}
+}
+
+func TestCheckConfigNamesEachBadSetting(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	t.Chdir(t.TempDir())
+
+	f = FlagVars{Teststripekey: true, StripetestSK: "sk_live_x", StripetestPK: "pk_test_x", WebPort: 0, Catalog: "catalog.json", OrdersDir: "orders", Dev: true, Currency: "usd",
+		ReadHeaderTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second, MaxHeaderBytes: KB, ShutdownTimeout: time.Second, IntentWindow: time.Hour, LogFormat: "text", LogLevel: "info", MaxItems: 50, MaxQuantity: 100}
+	var got []string
+	for _, err := range checkConfig() {
+		got = append(got, err.Error())
+	}
+	joined := strings.Join(got, "\n")
+	for _, want := range []string{"STRIPETESTSK", "WEBPORT"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("no complaint about %s in:\n%s", want, joined)
+		}
+	}
+	if strings.Contains(joined, "STRIPETESTPK") {
+		t.Errorf("a good publishable key was reported:\n%s", joined)
+	}
+
+	f.StripetestSK, f.WebPort = "sk_test_x", 8080
+	if errs := checkConfig(); len(errs) != 0 {
+		t.Errorf("a good config reported %v", errs)
+	}
+}
+
+// serve refuses to start on anything config check would report.
+func TestServeChecksTheConfigFirst(t *testing.T) {
+	keepStores(t)
+	keepLogging(t)
+	t.Chdir(t.TempDir())
+
+	f = FlagVars{Teststripekey: true, StripetestSK: "sk_test_x", StripetestPK: "pk_test_x", WebPort: 8080, Catalog: "catalog.json", OrdersDir: "orders", Dev: true, Currency: "usd",
+		ReadHeaderTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second, MaxHeaderBytes: KB, ShutdownTimeout: time.Second, IntentWindow: time.Hour, LogFormat: "text", LogLevel: "info", MaxItems: 50, MaxQuantity: 100}
+	if err := serveCmd.PreRunE(serveCmd, nil); err != nil {
+		t.Fatalf("a good config stopped serve: %v", err)
+	}
+	// serve goes on with the stores the check loaded, so they are ready.
+	if g := defaultStore.guard; g == nil || g.key != "sk_test_x" {
+		t.Error("the check did not leave the stores ready to serve with the chosen key")
+	}
+	f.MaxItems, f.WriteTimeout = 0, 0
+	err := serveCmd.PreRunE(serveCmd, nil)
+	for _, want := range []string{"MAXITEMS", "WRITETIMEOUT"} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("serve started with a bad %s: %v", want, err)
+		}
+	}
+}
+
+// A server on a unix socket or systemd's has no port, and needs no WEBPORT.
+func TestListeningOnASocketNeedsNoWebPort(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	keepLogging(t)
+	t.Chdir(t.TempDir())
+
+	f = FlagVars{Teststripekey: true, StripetestSK: "sk_test_x", StripetestPK: "pk_test_x", Listen: "unix:srv.sock", Catalog: "catalog.json", OrdersDir: "orders", Dev: true, Currency: "usd",
+		ReadHeaderTimeout: time.Second, ReadTimeout: time.Second, WriteTimeout: time.Second, IdleTimeout: time.Second, MaxHeaderBytes: KB, ShutdownTimeout: time.Second, IntentWindow: time.Hour, LogFormat: "text", LogLevel: "info", MaxItems: 50, MaxQuantity: 100}
+	for _, listen := range []string{"unix:srv.sock", "systemd"} {
+		f.Listen = listen
+		if err := serveCmd.PreRunE(serveCmd, nil); err != nil {
+			t.Errorf("LISTEN=%s without WEBPORT stopped serve: %v", listen, err)
+		}
+	}
+	f.Listen = ""
+	if err := serveCmd.PreRunE(serveCmd, nil); err == nil || !strings.Contains(err.Error(), "WEBPORT") {
+		t.Errorf("serve started on no port at all: %v", err)
+	}
+}
@@ -0,0 +1,31 @@
+// Package clientconfig is the configuration the server hands the wasm at
+// runtime. Nothing that differs between environments is compiled into the
+// wasm, so one build of it serves test and live, here or anywhere else.
+package clientconfig
+
+// Config is what /client-config returns and what every page carries as
+// window.clientConfig.
+type Config struct {
+	// PublishableKey is the Stripe key Stripe.js is started with.
+	PublishableKey string `json:"publishableKey"`
+	// Currency is the ISO code prices are charged in, in lower case.
+	Currency string `json:"currency"`
+	// APIBase is prefixed to the paths of the server's endpoints. Empty
+	// means the origin the page came from.
+	APIBase string `json:"apiBase"`
+	// Features turns optional behaviour on by name.
+	Features map[string]bool `json:"features"`
+	// CSRFToken goes with every POST, in X-CSRF-Token. Pages rendered
+	// elsewhere, from srv export, have none and need none.
+	CSRFToken string `json:"csrfToken,omitempty"`
+}
+
+// Headers are the headers of a POST to the server: JSON, with the CSRF token
+// when there is one.
+func (c Config) Headers() map[string]any {
+	h := map[string]any{"Content-Type": "application/json"}
+	if c.CSRFToken != "" {
+		h["X-CSRF-Token"] = c.CSRFToken
+	}
+	return h
+}
@@ -0,0 +1,69 @@
+//go:build js && wasm
+
+package clientconfig
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"syscall/js"
+)
+
+// Load reads the configuration the page was rendered with, or fetches it
+// from /client-config when the page has none. It blocks until it has it, so
+// call it before anything needs the key and not from inside a callback.
+func Load() (Config, error) {
+	var c Config
+	v := js.Global().Get("clientConfig")
+	if v.IsUndefined() || v.IsNull() {
+		var err error
+		if v, err = fetchJSON("/client-config"); err != nil {
+			return c, err
+		}
+	}
+	if err := json.Unmarshal([]byte(js.Global().Get("JSON").Call("stringify", v).String()), &c); err != nil {
+		return c, err
+	}
+	if c.PublishableKey == "" {
+		return c, errors.New("client config has no publishable key")
+	}
+	return c, nil
+}
+
+func fetchJSON(url string) (js.Value, error) {
+	type result struct {
+		v   js.Value
+		err error
+	}
+	done := make(chan result, 2)
+	onResponse := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		if r := args[0]; !r.Get("ok").Bool() {
+			return js.Global().Get("Promise").Call("reject", fmt.Sprintf("%s: %d %s", url, r.Get("status").Int(), r.Get("statusText").String()))
+		}
+		return args[0].Call("json")
+	})
+	onJSON := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		done <- result{v: args[0]}
+		return nil
+	})
+	onError := js.FuncOf(func(_ js.Value, args []js.Value) any {
+		done <- result{err: errors.New(args[0].Call("toString").String())}
+		return nil
+	})
+	defer onResponse.Release()
+	defer onJSON.Release()
+	defer onError.Release()
+	js.Global().Call("fetch", url).Call("then", onResponse).Call("then", onJSON).Call("catch", onError)
+	r := <-done
+	return r.v, r.err
+}
+
+// ErrorMessage is the error a server response carries, with the id of the
+// request to quote to the shop, which finds it in the log by that.
+func ErrorMessage(body js.Value) string {
+	msg := body.Get("error").String()
+	if id := body.Get("requestId"); id.Truthy() {
+		msg += " (reference " + id.String() + ")"
+	}
+	return msg
+}
@@ -0,0 +1,230 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/goccy/go-yaml"
+	"github.com/pelletier/go-toml/v2"
+)
+
+// menv holds the settings read from the file MENV names, keyed by their
+// environment names. It is read once, before any flag is registered, since
+// the flags take their defaults from it.
+var menv, menvErr = loadConfigFile(menvfile)
+
+// configErrs collects the settings whose values could not be used, so that a
+// command can refuse to run and `config check` can list them all.
+var configErrs []error
+
+func init() {
+	if menvErr != nil {
+		configError(menvErr)
+	}
+	for _, key := range unknownKeys(menv) {
+		configError(fmt.Errorf("%s: unknown setting %s", menvfile, key))
+	}
+}
+
+// configError records a problem once, however many commands read the setting.
+func configError(err error) {
+	for _, e := range configErrs {
+		if e.Error() == err.Error() {
+			return
+		}
+	}
+	configErrs = append(configErrs, err)
+}
+
+// loadConfigFile reads a flat file of settings. A .toml, .yaml or .yml file
+// is parsed as such; anything else is read in the KEY='value' form
+// server.conf has always had. An empty path is no file at all.
+func loadConfigFile(path string) (map[string]string, error) {
+	if path == "" {
+		return map[string]string{}, nil
+	}
+	data, err := os.ReadFile(path) //nolint:gosec // the operator's own config file
+	if err != nil {
+		return nil, err
+	}
+	var raw map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	default:
+		return parseShellConfig(path, data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	settings := map[string]string{}
+	for k, v := range raw {
+		switch v.(type) {
+		case map[string]interface{}, []interface{}:
+			return nil, fmt.Errorf("%s: %s must be a plain value, not a table or list", path, strings.ToUpper(k))
+		}
+		settings[strings.ToUpper(k)] = fmt.Sprint(v)
+	}
+	return settings, nil
+}
+
+var shellKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseShellConfig reads KEY=value lines the way a shell would for the cases
+// that turn up in a config file: comments, blank lines, an optional export,
+// and single-, double- or unquoted values. Nothing is expanded or run.
+func parseShellConfig(path string, data []byte) (map[string]string, error) {
+	settings := map[string]string{}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, val, found := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !found || !shellKey.MatchString(key) {
+			return nil, fmt.Errorf("%s:%d: expected KEY=value", path, n)
+		}
+		v, err := unquote(val)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %w", path, n, key, err)
+		}
+		settings[strings.ToUpper(key)] = v
+	}
+	return settings, sc.Err()
+}
+
+func unquote(val string) (string, error) {
+	switch {
+	case strings.HasPrefix(val, "'"):
+		end := strings.Index(val[1:], "'")
+		if end < 0 {
+			return "", errors.New("unterminated single quote")
+		}
+		return val[1 : end+1], trailing(val[end+2:])
+	case strings.HasPrefix(val, `"`):
+		var b strings.Builder
+		for i := 1; i < len(val); i++ {
+			switch c := val[i]; {
+			case c == '\\' && i+1 < len(val):
+				i++
+				b.WriteByte(val[i])
+			case c == '"':
+				return b.String(), trailing(val[i+1:])
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return "", errors.New("unterminated double quote")
+	default:
+		if i := strings.Index(val, " #"); i >= 0 {
+			val = val[:i]
+		}
+		val = strings.TrimSpace(val)
+		if strings.ContainsAny(val, " \t") {
+			return "", errors.New("unquoted value contains whitespace")
+		}
+		return val, nil
+	}
+}
+
+// trailing allows nothing after a closing quote but a comment.
+func trailing(rest string) error {
+	rest = strings.TrimSpace(rest)
+	if rest != "" && !strings.HasPrefix(rest, "#") {
+		return fmt.Errorf("unexpected %q after the closing quote", rest)
+	}
+	return nil
+}
+
+// unknownKeys lists the settings a file has that no flag reads — most likely
+// a typo, which would otherwise leave the real setting quietly at its default.
+func unknownKeys(settings map[string]string) []string {
+	known := map[string]bool{}
+	t := reflect.TypeOf(FlagVars{})
+	for i := 0; i < t.NumField(); i++ {
+		known[strings.ToUpper(t.Field(i).Name)] = true
+	}
+	var unknown []string
+	for k := range settings {
+		if !known[k] {
+			unknown = append(unknown, k)
+		}
+	}
+	sort.Strings(unknown)
+	return unknown
+}
+
+// configValue is the value a setting has before any flag: the environment
+// first, then the MENV file. The second result says which, for config check.
+func configValue(name string) (string, string, bool) {
+	if v, ok := os.LookupEnv(name); ok {
+		return v, "env", true
+	}
+	if v, ok := menv[name]; ok {
+		return v, menvfile, true
+	}
+	return "", "", false
+}
+
+func configString(name, def string) string {
+	if v, _, ok := configValue(name); ok {
+		return v
+	}
+	return def
+}
+
+func configBool(name string, def bool) bool {
+	v, from, ok := configValue(name)
+	if !ok {
+		return def
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		configError(fmt.Errorf("%s: %q from %s is not true or false", name, v, from))
+		return def
+	}
+	return b
+}
+
+func configInt(name string, def int) int {
+	v, from, ok := configValue(name)
+	if !ok {
+		return def
+	}
+	i, err := strconv.Atoi(v)
+	if err != nil {
+		configError(fmt.Errorf("%s: %q from %s is not a whole number", name, v, from))
+		return def
+	}
+	return i
+}
+
+func configDuration(name string, def time.Duration) time.Duration {
+	v, from, ok := configValue(name)
+	if !ok {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		configError(fmt.Errorf("%s: %q from %s is not a duration like 30s or 2m", name, v, from))
+		return def
+	}
+	return d
+}
@@ -0,0 +1,153 @@
+//go:build !wasm
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ── server.conf ──────────────────────────────────────────────────────────────
+
+// The file that ships with the repo has to read the same as it did when bash
+// sourced it.
+func TestTheShippedServerConfParses(t *testing.T) {
+	got, err := loadConfigFile("server.conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{"WEBPORT": "8080", "TESTSTRIPEKEY": "true", "STRIPETESTPK": "pk_test_..."} {
+		if got[k] != want {
+			t.Errorf("%s = %q, want %q", k, got[k], want)
+		}
+	}
+	if unknown := unknownKeys(got); len(unknown) != 0 {
+		t.Errorf("server.conf has settings nothing reads: %v", unknown)
+	}
+}
+
+func TestShellConfigQuoting(t *testing.T) {
+	got, err := parseShellConfig("x.conf", []byte(strings.Join([]string{
+		"# a comment",
+		"",
+		"A='single # not a comment'",
+		`B="double \"quoted\""`,
+		"export C=bare # a comment",
+		"D='$HOME'",
+		"E=",
+	}, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for k, want := range map[string]string{
+		"A": "single # not a comment",
+		"B": `double "quoted"`,
+		"C": "bare",
+		"D": "$HOME", // read, never expanded
+		"E": "",
+	} {
+		if got[k] != want {
+			t.Errorf("%s = %q, want %q", k, got[k], want)
+		}
+	}
+}
+
+// A line that would mean something else to a shell is an error with a line
+// number, not a guess.
+func TestShellConfigErrorsSayWhere(t *testing.T) {
+	for _, tc := range []struct{ line, want string }{
+		{"A='open", "x.conf:1: A: unterminated"},
+		{"not a setting", "x.conf:1: expected KEY=value"},
+		{"A=two words", "x.conf:1: A: unquoted"},
+		{"A='x' y", "x.conf:1: A: unexpected"},
+		{"1A=x", "x.conf:1: expected"},
+	} {
+		_, err := parseShellConfig("x.conf", []byte(tc.line))
+		if err == nil || !strings.HasPrefix(err.Error(), tc.want) {
+			t.Errorf("%q: err = %v, want %s...", tc.line, err, tc.want)
+		}
+	}
+}
+
+// ── toml and yaml ────────────────────────────────────────────────────────────
+
+func TestTOMLAndYAMLReadTheSameSettings(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"c.toml": "webport = 9090\nteststripekey = true\nSTRIPETESTPK = 'pk_test_x'\n",
+		"c.yaml": "webport: 9090\nteststripekey: true\nSTRIPETESTPK: pk_test_x\n",
+	}
+	for name, body := range files {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		got, err := loadConfigFile(path)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if got["WEBPORT"] != "9090" || got["TESTSTRIPEKEY"] != "true" || got["STRIPETESTPK"] != "pk_test_x" {
+			t.Errorf("%s read as %v", name, got)
+		}
+	}
+}
+
+func TestNestedValuesAreRejectedByName(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "c.toml")
+	if err := os.WriteFile(path, []byte("[webport]\nx = 1\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadConfigFile(path); err == nil || !strings.Contains(err.Error(), "WEBPORT") {
+		t.Errorf("err = %v, want one naming WEBPORT", err)
+	}
+}
+
+// ── precedence ───────────────────────────────────────────────────────────────
+
+// The environment wins over the file; flags win over both, which cobra sees to
+// by taking these values only as defaults.
+func TestEnvironmentBeatsTheFile(t *testing.T) {
+	saved := menv
+	defer func() { menv = saved }()
+	menv = map[string]string{"WEBPORT": "7000", "CATALOG": "file.json"}
+	t.Setenv("WEBPORT", "7001")
+
+	if got := configInt("WEBPORT", 1); got != 7001 {
+		t.Errorf("WEBPORT = %d, want the environment's 7001", got)
+	}
+	if got := configString("CATALOG", "default.json"); got != "file.json" {
+		t.Errorf("CATALOG = %q, want the file's", got)
+	}
+	if got := configString("ORDERSDIR", "orders"); got != "orders" {
+		t.Errorf("ORDERSDIR = %q, want the default", got)
+	}
+}
+
+// A value that does not parse keeps the default and is reported by the name
+// of the setting, not silently read as zero.
+func TestABadValueIsReportedByName(t *testing.T) {
+	saved, savedErrs := menv, configErrs
+	defer func() { menv, configErrs = saved, savedErrs }()
+	menv, configErrs = map[string]string{"WEBPORT": "eighty", "TESTSTRIPEKEY": "yes please"}, nil
+
+	if got := configInt("WEBPORT", 8080); got != 8080 {
+		t.Errorf("WEBPORT = %d, want the default kept", got)
+	}
+	configBool("TESTSTRIPEKEY", false)
+	configBool("TESTSTRIPEKEY", false) // read again by another command
+	if len(configErrs) != 2 {
+		t.Fatalf("got %d errors, want one per setting: %v", len(configErrs), configErrs)
+	}
+	if !strings.HasPrefix(configErrs[0].Error(), "WEBPORT:") || !strings.HasPrefix(configErrs[1].Error(), "TESTSTRIPEKEY:") {
+		t.Errorf("errors do not lead with the setting: %v", configErrs)
+	}
+}
+
+func TestUnknownKeysCatchesATypo(t *testing.T) {
+	got := unknownKeys(map[string]string{"WEBPORT": "1", "WEBPROT": "2"})
+	if len(got) != 1 || got[0] != "WEBPROT" {
+		t.Errorf("unknownKeys = %v, want [WEBPROT]", got)
+	}
+}
@@ -0,0 +1,80 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/0magnet/cart/pow"
+	"github.com/gin-gonic/gin"
+)
+
+// corsOrigins splits the CORSORIGINS setting into the origins it allows.
+func corsOrigins(spec string) []string {
+	var origins []string
+	for _, o := range strings.Split(spec, ",") {
+		if o = strings.TrimSuffix(strings.TrimSpace(o), "/"); o != "" {
+			origins = append(origins, o)
+		}
+	}
+	return origins
+}
+
+// checkCORSOrigins reports each of origins that is neither * nor an origin:
+// a scheme and a host, with no path. A browser sends exactly that, so
+// anything more would never match.
+func checkCORSOrigins(origins []string) []error {
+	var errs []error
+	for _, o := range origins {
+		if o == "*" {
+			continue
+		}
+		u, err := url.Parse(o)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" || u.RawQuery != "" {
+			errs = append(errs, fmt.Errorf("CORSORIGINS: %q is not an origin like https://shop.example.com", o))
+		}
+	}
+	return errs
+}
+
+// corsMiddleware lets pages served from origins, a static site exported with
+// srv export say, call the api from the browser. A preflight from one of them
+// is answered here; any other request goes on with the headers that let the
+// page read the response. Requests from anywhere else get no CORS headers,
+// which the browser takes as a refusal.
+func corsMiddleware(origins []string) gin.HandlerFunc {
+	anyOrigin := slices.Contains(origins, "*")
+	return func(c *gin.Context) {
+		h := c.Writer.Header()
+		if !anyOrigin {
+			// What is sent depends on who asks, so a cache has to keep
+			// the answers apart.
+			h.Add("Vary", "Origin")
+		}
+		origin := c.GetHeader("Origin")
+		if origin == "" || (!anyOrigin && !slices.Contains(origins, origin)) {
+			c.Next()
+			return
+		}
+		if anyOrigin {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			h.Set("Access-Control-Allow-Methods", "GET, POST")
+			// The JSON the pages post, the CSRF token and a solved proof of
+			// work all come in headers a page may only send if allowed.
+			h.Set("Access-Control-Allow-Headers", strings.Join([]string{"Content-Type", csrfHeader, pow.ChallengeHeader, pow.SolutionHeader}, ", "))
+			h.Set("Access-Control-Max-Age", "600")
+			h.Set("Server", "")
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,72 @@
+//go:build !wasm
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ── CORS ─────────────────────────────────────────────────────────────────────
+
+func corsRequest(t *testing.T, origins []string, method, origin string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(corsMiddleware(origins))
+	r.POST("/submit-order", func(c *gin.Context) { c.Status(http.StatusOK) })
+	req := httptest.NewRequest(method, "/submit-order", nil)
+	req.Header.Set("Origin", origin)
+	if method == http.MethodOptions {
+		req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestPreflightFromAnAllowedOrigin(t *testing.T) {
+	w := corsRequest(t, []string{"https://shop.example.com"}, http.MethodOptions, "https://shop.example.com")
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("preflight = %d", w.Code)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://shop.example.com" {
+		t.Errorf("Allow-Origin = %q", got)
+	}
+	if got := w.Header().Get("Access-Control-Allow-Headers"); got != "Content-Type, X-CSRF-Token, X-PoW-Challenge, X-PoW-Solution" {
+		t.Errorf("Allow-Headers = %q: the JSON, the CSRF token or the proof of work the pages send would be refused", got)
+	}
+	w = corsRequest(t, []string{"https://shop.example.com"}, http.MethodPost, "https://shop.example.com")
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://shop.example.com" {
+		t.Errorf("the request itself = %d, %v", w.Code, w.Header())
+	}
+}
+
+func TestOtherOriginsGetNoCORSHeaders(t *testing.T) {
+	for _, method := range []string{http.MethodOptions, http.MethodPost} {
+		w := corsRequest(t, []string{"https://shop.example.com"}, method, "https://elsewhere.example.com")
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got != "" {
+			t.Errorf("%s: Allow-Origin = %q", method, got)
+		}
+		if w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s: a cache could hand this answer to the allowed origin", method)
+		}
+	}
+	w := corsRequest(t, []string{"*"}, http.MethodOptions, "https://anywhere.example.com")
+	if w.Code != http.StatusNoContent || w.Header().Get("Access-Control-Allow-Origin") != "*" {
+		t.Errorf("* = %d, %v", w.Code, w.Header())
+	}
+}
+
+func TestCORSOriginsMustBeOrigins(t *testing.T) {
+	origins := corsOrigins(" https://shop.example.com/ , *, http://localhost:8080,shop.example.com,https://x.example.com/shop")
+	if len(origins) != 5 || origins[0] != "https://shop.example.com" {
+		t.Fatalf("origins = %q", origins)
+	}
+	if errs := checkCORSOrigins(origins); len(errs) != 2 {
+		t.Errorf("got %v, want the bare host and the one with a path", errs)
+	}
+}
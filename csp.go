@@ -0,0 +1,106 @@
+//go:build !wasm
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// cspReportPath is where browsers send what the policy blocked.
+const cspReportPath = "/csp-report"
+
+// newNonce is the nonce for one page: the inline scripts and styles that
+// carry it run, and any other, injected into the page say, does not.
+func newNonce() string {
+	return rand.Text()
+}
+
+// contentSecurityPolicy is the policy a page rendered with nonce is served
+// with. Besides the page's own origin it allows what Stripe.js needs, as
+// Stripe documents it: its script, the frames the Payment Element and 3D
+// Secure run in, and its api. 'wasm-unsafe-eval' lets the page compile the
+// wasm without allowing eval itself.
+func contentSecurityPolicy(nonce string) string {
+	connect := "'self' https://api.stripe.com"
+	if f.APIBase != "" {
+		connect += " " + f.APIBase
+	}
+	return strings.Join([]string{
+		"default-src 'self'",
+		"script-src 'self' 'nonce-" + nonce + "' 'wasm-unsafe-eval' https://js.stripe.com https://*.js.stripe.com",
+		"style-src 'self' 'nonce-" + nonce + "'",
+		"frame-src https://js.stripe.com https://*.js.stripe.com https://hooks.stripe.com",
+		"connect-src " + connect,
+		"img-src 'self' data: https://*.stripe.com",
+		"object-src 'none'",
+		"base-uri 'none'",
+		"form-action 'self'",
+		"frame-ancestors 'none'",
+		"report-uri " + cspReportPath,
+	}, "; ")
+}
+
+// setCSP sends the policy for a page rendered with nonce; with CSPREPORTONLY
+// it is only reported against, for trying a theme's changes under it before
+// it blocks anything.
+func setCSP(c *gin.Context, nonce string) {
+	header := "Content-Security-Policy"
+	if f.CSPReportOnly {
+		header = "Content-Security-Policy-Report-Only"
+	}
+	c.Writer.Header().Set(header, contentSecurityPolicy(nonce))
+}
+
+// cspViolation is the part of a report-uri report worth logging.
+type cspViolation struct {
+	DocumentURI        string `json:"document-uri"`
+	EffectiveDirective string `json:"effective-directive"`
+	ViolatedDirective  string `json:"violated-directive"`
+	BlockedURI         string `json:"blocked-uri"`
+	SourceFile         string `json:"source-file"`
+	LineNumber         int    `json:"line-number"`
+	Disposition        string `json:"disposition"`
+}
+
+// cspReport logs a violation a browser reports. The reports come from any
+// page, unauthenticated, so the body is bounded and nothing is kept.
+func cspReport(c *gin.Context) {
+	c.Writer.Header().Set("Server", "")
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, 16*KB))
+	var report struct {
+		Violation *cspViolation `json:"csp-report"`
+	}
+	if err == nil {
+		err = json.Unmarshal(body, &report)
+	}
+	if err != nil || report.Violation == nil {
+		c.Status(http.StatusBadRequest)
+		return
+	}
+	v := report.Violation
+	directive := v.EffectiveDirective
+	if directive == "" {
+		directive = v.ViolatedDirective
+	}
+	blocked := v.BlockedURI
+	if blocked == "" {
+		blocked = "inline"
+	}
+	if v.SourceFile != "" && v.LineNumber > 0 {
+		blocked += fmt.Sprintf(" at %s:%d", v.SourceFile, v.LineNumber)
+	}
+	verb := "blocked"
+	if v.Disposition == "report" {
+		verb = "would have blocked"
+	}
+	slog.WarnContext(c.Request.Context(), fmt.Sprintf("CSP violation: %s %s %s on %s", directive, verb, blocked, v.DocumentURI))
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,128 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ── content security policy ──────────────────────────────────────────────────
+
+func servePage(t *testing.T, route, name string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET(route, pageHandler(route, name, nil))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, route, nil))
+	return w
+}
+
+// Every inline script and style carries the nonce the policy names, and it is
+// a new one each time.
+func TestPagesCarryTheNonceTheirPolicyNames(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.Dev = true // the live reload script is inline too
+
+	nonces := map[string]bool{}
+	for range 2 {
+		w := servePage(t, "/complete", "complete")
+		policy := w.Header().Get("Content-Security-Policy")
+		m := regexp.MustCompile(`script-src 'self' 'nonce-([^']+)' 'wasm-unsafe-eval'`).FindStringSubmatch(policy)
+		if m == nil {
+			t.Fatalf("policy = %q", policy)
+		}
+		nonces[m[1]] = true
+		body := w.Body.String()
+		for _, tag := range regexp.MustCompile(`<(script|style)[^>]*>`).FindAllString(body, -1) {
+			if !strings.Contains(tag, "src=") && !strings.Contains(tag, "nonce='"+m[1]+"'") {
+				t.Errorf("%s runs without the nonce", tag)
+			}
+		}
+		if !strings.Contains(policy, "report-uri "+cspReportPath) || !strings.Contains(policy, "https://js.stripe.com") {
+			t.Errorf("policy = %q", policy)
+		}
+	}
+	if len(nonces) != 2 {
+		t.Error("two pages were served the same nonce")
+	}
+}
+
+// An inline handler is blocked like any other inline script, so the theme
+// has none.
+func TestTheThemeHasNoInlineHandlers(t *testing.T) {
+	handler := regexp.MustCompile(`\son[a-z]+=`)
+	for _, name := range []string{"index", "product", "complete"} {
+		out, err := defaultStore.renderPage(name, htmlTemplateData{Categories: categories([]product{{ID: "VT-1", Name: "one", Price: 1}})})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m := handler.Find(out); m != nil {
+			t.Errorf("%s has an inline handler: %s", name, m)
+		}
+		if bytes.Contains(out, []byte(" style=")) {
+			t.Errorf("%s has a style attribute", name)
+		}
+	}
+}
+
+func TestThePolicyCanBeReportOnlyAndAllowsAPIBase(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.CSPReportOnly, f.APIBase = true, "https://api.example.com"
+	w := servePage(t, "/complete", "complete")
+	if w.Header().Get("Content-Security-Policy") != "" {
+		t.Error("the policy is enforced")
+	}
+	if !strings.Contains(w.Header().Get("Content-Security-Policy-Report-Only"), "connect-src 'self' https://api.stripe.com https://api.example.com") {
+		t.Errorf("policy = %q", w.Header().Get("Content-Security-Policy-Report-Only"))
+	}
+}
+
+func TestErrorPagesCarryTheNonce(t *testing.T) {
+	if got := string(htmlErr("broken", "abc")); !strings.Contains(got, "<style nonce='abc'>") || strings.Contains(got, " style=") {
+		t.Errorf("error page = %s", got)
+	}
+}
+
+// ── violation reports ────────────────────────────────────────────────────────
+
+func postReport(t *testing.T, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST(cspReportPath, cspReport)
+	req := httptest.NewRequest(http.MethodPost, cspReportPath, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/csp-report")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func TestViolationsAreLogged(t *testing.T) {
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	w := postReport(t, `{"csp-report": {"document-uri": "https://shop.example.com/", "effective-directive": "script-src-elem", "blocked-uri": "https://evil.example.com/x.js", "disposition": "enforce"}}`)
+	if w.Code != http.StatusNoContent {
+		t.Errorf("report = %d", w.Code)
+	}
+	if got := logged.String(); !strings.Contains(got, "script-src-elem blocked https://evil.example.com/x.js on https://shop.example.com/") {
+		t.Errorf("logged %q", got)
+	}
+	for _, body := range []string{`not json`, `{"other": {}}`, `{"csp-report": {"blocked-uri": "` + strings.Repeat("x", 20*KB) + `"}}`} {
+		if w := postReport(t, body); w.Code != http.StatusBadRequest {
+			t.Errorf("%.20s… = %d", body, w.Code)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+//go:build !wasm
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// sessionCookie holds a random id the CSRF token is made from. It
+	// identifies nothing else: the cart lives in the browser.
+	sessionCookie = "srv_session"
+	// csrfHeader is where the wasm sends the token with each POST.
+	csrfHeader = "X-CSRF-Token"
+)
+
+// csrfKey signs the tokens. It is CSRFKEY when that is set, and otherwise
+// made at startup, in which case a restart turns the tokens of pages already
+// open into ones that are refused.
+var csrfKey []byte
+
+func initCSRFKey() {
+	if f.CSRFKey != "" {
+		csrfKey = []byte(f.CSRFKey)
+		return
+	}
+	csrfKey = []byte(rand.Text())
+}
+
+// csrfToken is the token for the session id: what only a page this server
+// rendered, or a same-origin fetch of /client-config, is given to read.
+func csrfToken(session string) string {
+	mac := hmac.New(sha256.New, csrfKey)
+	mac.Write([]byte(session)) //nolint:errcheck,gosec // a hash.Hash cannot fail to write
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// csrfSession returns the token for the session the request belongs to,
+// starting one if it has none. The cookie is SameSite=Lax, so a page
+// elsewhere cannot post with it, while following a link here, as Stripe's
+// return to /complete does, still sends it. It is Secure whenever the
+// browser is on https, here or at a proxy in front.
+func csrfSession(c *gin.Context) string {
+	session, err := c.Cookie(sessionCookie)
+	if err != nil || len(session) != 26 {
+		session = rand.Text()
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     sessionCookie,
+			Value:    session,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   overHTTPS(c),
+			SameSite: http.SameSiteLaxMode,
+		})
+	}
+	return csrfToken(session)
+}
+
+// csrfProtect refuses a state-changing request that a page on another site
+// could have made. The browser says where a request comes from in
+// Sec-Fetch-Site and Origin, or in older browsers only Referer; anything
+// other than this server or one of the CORSORIGINS is refused. A request
+// from this server's own pages must also carry the token of its session.
+// One from a CORSORIGINS page cannot, as that page was not rendered here, so
+// for those the origin is the whole check. With CORSORIGINS=* any origin
+// may post: that is what it says.
+func csrfProtect(origins []string) gin.HandlerFunc {
+	anyOrigin := slices.Contains(origins, "*")
+	cop := http.NewCrossOriginProtection()
+	for _, o := range origins {
+		if o != "*" {
+			if err := cop.AddTrustedOrigin(o); err != nil {
+				log.Printf("CORSORIGINS: %v", err)
+			}
+		}
+	}
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		crossOrigin := origin != "" && originHost(origin) != c.Request.Host
+		if !anyOrigin {
+			if err := cop.Check(c.Request); err != nil {
+				reason := "this request came from another site"
+				if origin != "" {
+					reason += ": " + origin
+				}
+				refuse(c, reason)
+				return
+			}
+			if err := checkReferer(c.Request, origins); err != nil {
+				refuse(c, err.Error())
+				return
+			}
+		}
+		if crossOrigin {
+			c.Next()
+			return
+		}
+		token := c.GetHeader(csrfHeader)
+		session, err := c.Cookie(sessionCookie)
+		if err != nil || token == "" || !hmac.Equal([]byte(token), []byte(csrfToken(session))) {
+			refuse(c, "this page has expired: reload it and try again")
+			return
+		}
+		c.Next()
+	}
+}
+
+// checkReferer is the check for a browser that sends neither Sec-Fetch-Site
+// nor Origin, which CrossOriginProtection lets through: its Referer, if it
+// sent one, has to be this server or a trusted origin.
+func checkReferer(r *http.Request, origins []string) error {
+	if r.Header.Get("Origin") != "" || r.Header.Get("Sec-Fetch-Site") != "" || r.Referer() == "" {
+		return nil
+	}
+	u, err := url.Parse(r.Referer())
+	if err != nil || u.Host == "" {
+		return errors.New("this request has a Referer that is not a url")
+	}
+	if u.Host == r.Host || slices.Contains(origins, u.Scheme+"://"+u.Host) {
+		return nil
+	}
+	return fmt.Errorf("this request came from another site: %s", u.Scheme+"://"+u.Host)
+}
+
+func originHost(origin string) string {
+	u, err := url.Parse(origin)
+	if err != nil {
+		return ""
+	}
+	return u.Host
+}
+
+// refuse answers 403 with the reason, which the wasm shows as it is.
+func refuse(c *gin.Context, reason string) {
+	slog.WarnContext(c.Request.Context(), "Refused "+c.Request.Method+" "+c.Request.URL.Path, "ip", clientIP(c), "reason", reason)
+	c.AbortWithStatusJSON(http.StatusForbidden, errorBody(c, reason))
+}
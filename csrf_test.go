@@ -0,0 +1,148 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// protected is a POST behind csrfProtect(origins), answering 200 when it
+// gets through.
+func protected(origins ...string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	initCSRFKey()
+	r := gin.New()
+	r.POST("/submit-order", csrfProtect(origins), func(c *gin.Context) { c.Status(http.StatusOK) })
+	return r
+}
+
+// post makes a POST from a browser on shop.example.com, as the session
+// session, with the given headers on top.
+func post(r *gin.Engine, session string, headers map[string]string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/submit-order", strings.NewReader("{}"))
+	req.Host = "shop.example.com"
+	if session != "" {
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: session})
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+func refusal(t *testing.T, w *httptest.ResponseRecorder) string {
+	t.Helper()
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("status = %d, want 403", w.Code)
+	}
+	var body struct{ Error string }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.Error == "" {
+		t.Fatalf("body = %s", w.Body)
+	}
+	return body.Error
+}
+
+// ── tokens ───────────────────────────────────────────────────────────────────
+
+func TestASameOriginPostNeedsItsSessionsToken(t *testing.T) {
+	r := protected()
+	session := "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	sameOrigin := map[string]string{"Origin": "https://shop.example.com", "Sec-Fetch-Site": "same-origin"}
+
+	with := func(token string) map[string]string {
+		h := map[string]string{csrfHeader: token}
+		for k, v := range sameOrigin {
+			h[k] = v
+		}
+		return h
+	}
+	if w := post(r, session, with(csrfToken(session))); w.Code != http.StatusOK {
+		t.Errorf("with the token: %d %s", w.Code, w.Body)
+	}
+	if got := refusal(t, post(r, session, sameOrigin)); !strings.Contains(got, "expired") {
+		t.Errorf("without the token: %q", got)
+	}
+	refusal(t, post(r, session, with(csrfToken("another session"))))
+	refusal(t, post(r, "", with(csrfToken(session))))
+}
+
+func TestTheSessionCookieIsLaxAndKept(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	initCSRFKey()
+	var token string
+	r := gin.New()
+	r.GET("/", func(c *gin.Context) { token = csrfSession(c) })
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Name != sessionCookie || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	if token != csrfToken(cookies[0].Value) {
+		t.Error("the token is not the new session's")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.AddCookie(cookies[0])
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if len(w.Result().Cookies()) != 0 || token != csrfToken(cookies[0].Value) {
+		t.Error("an existing session was replaced")
+	}
+}
+
+func TestPagesAndClientConfigCarryTheToken(t *testing.T) {
+	w := servePage(t, "/complete", "complete")
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("cookies = %v", cookies)
+	}
+	if want := `"csrfToken":"` + csrfToken(cookies[0].Value) + `"`; !strings.Contains(w.Body.String(), want) {
+		t.Errorf("the page has no %s", want)
+	}
+}
+
+// ── origins ──────────────────────────────────────────────────────────────────
+
+func TestAPostFromAnotherSiteIsRefused(t *testing.T) {
+	r := protected()
+	session := "ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+	token := map[string]string{csrfHeader: csrfToken(session)}
+	for _, headers := range []map[string]string{
+		{"Sec-Fetch-Site": "cross-site"},
+		{"Origin": "https://evil.example.com"},
+		{"Referer": "https://evil.example.com/page"},
+	} {
+		for k, v := range token {
+			headers[k] = v
+		}
+		if got := refusal(t, post(r, session, headers)); !strings.Contains(got, "another site") {
+			t.Errorf("%v: %q", headers, got)
+		}
+	}
+	if w := post(r, session, map[string]string{csrfHeader: token[csrfHeader], "Referer": "https://shop.example.com/checkout"}); w.Code != http.StatusOK {
+		t.Errorf("a same-site Referer was refused: %s", w.Body)
+	}
+}
+
+// A page on a CORSORIGINS origin was not rendered here and has no token: its
+// origin is what lets it in.
+func TestATrustedOriginPostsWithoutAToken(t *testing.T) {
+	headers := map[string]string{"Origin": "https://front.example.com", "Sec-Fetch-Site": "cross-site"}
+	if w := post(protected("https://front.example.com"), "", headers); w.Code != http.StatusOK {
+		t.Errorf("trusted origin: %d %s", w.Code, w.Body)
+	}
+	if w := post(protected("*"), "", headers); w.Code != http.StatusOK {
+		t.Errorf("CORSORIGINS=*: %d %s", w.Code, w.Body)
+	}
+	refusal(t, post(protected("https://other.example.com"), "", headers))
+}
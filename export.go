@@ -0,0 +1,117 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+// exportPage is one page of the static site: the route it is served at by
+// serve, and the file it is written to so a static host serves it there.
+type exportPage struct {
+	Route string
+	Page  string
+	File  string
+	Fill  func(h *htmlTemplateData) error
+}
+
+// exportPages lists every page of the storefront: the shop, the page Stripe
+// returns to, and one for each product in the catalog. Each is written as
+// index.html in a directory named for its route, which every static host
+// serves at that route.
+func exportPages() ([]exportPage, error) {
+	products, err := defaultStore.loadCatalog()
+	if err != nil {
+		return nil, fmt.Errorf("could not load the catalog: %w", err)
+	}
+	pages := []exportPage{
+		{Route: "/", Page: "index", File: "index.html", Fill: func(h *htmlTemplateData) error {
+			h.Categories = categories(products)
+			return nil
+		}},
+		{Route: "/complete", Page: "complete", File: filepath.Join("complete", "index.html")},
+	}
+	for _, p := range products {
+		if p.ID == "" || strings.ContainsAny(p.ID, `/\`) || strings.HasPrefix(p.ID, ".") {
+			return nil, fmt.Errorf("product id %q cannot be a directory name", p.ID)
+		}
+		pages = append(pages, exportPage{Route: "/p/:id", Page: "product", File: filepath.Join("p", p.ID, "index.html"), Fill: func(h *htmlTemplateData) error {
+			h.Title, h.Product = p.Name, p
+			return nil
+		}})
+	}
+	return pages, nil
+}
+
+// exportSite renders every page into dir, and writes the wasm, wasm_exec.js
+// and stylesheets they load under dir/assets by the hashed names the pages
+// link to. Nothing already in dir is removed: assets from an earlier export
+// stay for the pages browsers still have open.
+func exportSite(dir string) error {
+	pages, err := exportPages()
+	if err != nil {
+		return err
+	}
+	for _, p := range pages {
+		// A static host serves every visitor the same page, so there is no
+		// nonce to give it; nothing serves /dev/events for it either.
+		h := defaultStore.pageData(p.Route, "")
+		h.LiveReload = ""
+		if p.Fill != nil {
+			if err := p.Fill(&h); err != nil {
+				return err
+			}
+		}
+		page, err := defaultStore.renderPage(p.Page, h)
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.File, err)
+		}
+		out := filepath.Join(dir, p.File)
+		if err := os.MkdirAll(filepath.Dir(out), 0o755); err != nil { //nolint:gosec // a public site
+			return err
+		}
+		if err := os.WriteFile(out, page, 0o644); err != nil { //nolint:gosec // as above
+			return err
+		}
+	}
+	if err := writeAssets(filepath.Join(dir, "assets")); err != nil {
+		return err
+	}
+	fmt.Printf("wrote %d pages to %s\n", len(pages), dir)
+	return nil
+}
+
+var exportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "render the storefront into a static site, for an api-only server elsewhere",
+	Args:  cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		if f.APIBase == "" {
+			log.Println("APIBASE is unset: the pages will send api requests to the static host itself")
+		}
+		selectStripeKeys()
+		if err := applyWasmRoutes(f.WasmRoutes); err != nil {
+			log.Fatal(err)
+		}
+		prepareWasm()
+		if err := loadThemes(); err != nil {
+			log.Fatal(err)
+		}
+		if f.Dev {
+			initJSFiles()
+			initFiles()
+			if msg := buildError(); msg != "" {
+				log.Fatal(msg)
+			}
+		}
+		if err := exportSite(f.ExportDir); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
@@ -0,0 +1,64 @@
+//go:build !wasm
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ── static export ────────────────────────────────────────────────────────────
+
+func TestExportWritesEveryPageAndWhatTheyLink(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	t.Chdir(t.TempDir())
+	catalog := `[{"id": "VT-1", "name": "one tube", "category": "tube", "price": 650, "stock": 4}]`
+	if err := os.WriteFile(f.Catalog, []byte(catalog), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f.Dev, f.APIBase = true, "https://api.example.com"
+
+	dir := filepath.Join(t.TempDir(), "site")
+	if err := exportSite(dir); err != nil {
+		t.Fatal(err)
+	}
+	for _, page := range []string{"index.html", "complete/index.html", "p/VT-1/index.html"} {
+		data, err := os.ReadFile(filepath.Join(dir, page))
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		if strings.Contains(string(data), "EventSource") {
+			t.Errorf("%s listens for a dev server", page)
+		}
+		if !strings.Contains(string(data), `"apiBase":"https://api.example.com"`) {
+			t.Errorf("%s does not send api requests to APIBASE", page)
+		}
+		// Every asset a page links to is in the export.
+		for _, part := range strings.Split(string(data), "'/assets/")[1:] {
+			name := part[:strings.IndexAny(part, "'")]
+			if _, err := os.Stat(filepath.Join(dir, "assets", name)); err != nil {
+				t.Errorf("%s links to %s, which was not written", page, name)
+			}
+		}
+	}
+	product, _ := os.ReadFile(filepath.Join(dir, "p", "VT-1", "index.html")) //nolint:errcheck // checked above
+	if !strings.Contains(string(product), "<title>one tube</title>") || !strings.Contains(string(product), "$6.50") {
+		t.Error("the product page does not show the product")
+	}
+}
+
+// A product id becomes a directory, so one that would land outside p/ is
+// refused rather than written wherever it points.
+func TestExportRefusesAProductIDThatIsAPath(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := os.WriteFile(f.Catalog, []byte(`[{"id": "../../x", "name": "x", "price": 1}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := exportPages(); err == nil {
+		t.Error("a product id with a / was exported")
+	}
+}
@@ -0,0 +1,164 @@
+//go:build !wasm
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// healthCheck is one thing /readyz looks at: whether it is fine and, if it
+// is not, why.
+type healthCheck struct {
+	Name   string `json:"name"`
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// healthz answers as long as the process does, for a load balancer to know
+// it is alive.
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// readyz is 200 when the server can take orders and 503 when it cannot,
+// with the checks either way: a page whose wasm has not been built, or
+// failed to build, would load blank, and an order that cannot be written
+// or paid for would be lost.
+func readyz(c *gin.Context) {
+	checks := readinessChecks()
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(code, gin.H{"status": status, "checks": checks})
+}
+
+// readinessChecks checks the wasm, which every store shares, and then the
+// orders directory and Stripe keys of each store that has its own.
+func readinessChecks() []healthCheck {
+	var checks []healthCheck
+	if !f.APIOnly {
+		checks = append(checks, checkWasm(), checkJS())
+	}
+	for _, s := range allStores() {
+		if s.Host == "" || s.OrdersDir != "" {
+			checks = append(checks, s.checkOrdersWritable())
+		}
+		if s.Host == "" || s.ownKeys() {
+			checks = append(checks, s.checkStripe())
+		}
+	}
+	return checks
+}
+
+// checkName is a check's name, with the host of the store it is of unless
+// that is defaultStore.
+func (s *store) checkName(name string) string {
+	return strings.TrimSpace(name + " " + s.Host)
+}
+
+// checkWasm is whether each wasm entrypoint has a build being served and its
+// last build did not fail. A failed rebuild leaves the last good one being
+// served, but in dev mode only, where the failure is worth knowing about.
+func checkWasm() healthCheck {
+	check := healthCheck{Name: "wasm", OK: true}
+	var problems []string
+	for i := range wasmFiles {
+		if !wasmFiles[i].Cmp {
+			continue
+		}
+		wasmFiles[i].Mu.Lock()
+		url, buildErr := wasmFiles[i].URL, wasmFiles[i].Err
+		wasmFiles[i].Mu.Unlock()
+		switch {
+		case buildErr != "":
+			// The first line names the entrypoint and the compiler's
+			// exit; the rest is its output, which is for the page.
+			first, _, _ := strings.Cut(buildErr, "\n")
+			problems = append(problems, "build failed: "+first)
+		case url == "":
+			problems = append(problems, wasmFiles[i].Name+": not built yet")
+		}
+	}
+	if len(problems) > 0 {
+		check.OK, check.Detail = false, strings.Join(problems, "; ")
+	}
+	return check
+}
+
+// checkJS is whether the wasm_exec.js of each compiler in use is loaded.
+func checkJS() healthCheck {
+	check := healthCheck{Name: "js", OK: true}
+	var missing []string
+	for _, i := range wasmExecInUse() {
+		jsFiles[i].Mu.Lock()
+		url := jsFiles[i].URL
+		jsFiles[i].Mu.Unlock()
+		if url == "" {
+			missing = append(missing, wasmExecName(i))
+		}
+	}
+	if len(missing) > 0 {
+		check.OK, check.Detail = false, "not loaded yet: "+strings.Join(missing, ", ")
+	}
+	return check
+}
+
+// checkOrdersWritable is whether orders can be written to the store's orders
+// directory. Nothing is written to find out, since a load balancer probes
+// every few seconds: the directory is looked at, and whether this process
+// may write to it.
+func (s *store) checkOrdersWritable() healthCheck {
+	check := healthCheck{Name: s.checkName("orders"), OK: true}
+	dir := s.ordersDir()
+	if err := dirWritable(dir); err != nil {
+		check.OK, check.Detail = false, fmt.Sprintf("%s is not writable: %v", dir, err)
+	}
+	return check
+}
+
+// dirWritable reports why files could not be made in dir or, when it does
+// not exist yet, in the directory writeOrder would make it in.
+func dirWritable(dir string) error {
+	for {
+		fi, err := os.Stat(dir)
+		switch {
+		case err == nil && !fi.IsDir():
+			return fmt.Errorf("%s is not a directory", dir)
+		case err == nil:
+			return canWrite(dir)
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return err
+		}
+		dir = parent
+	}
+}
+
+// checkStripe is whether the store has keys to take payments with. Whether
+// Stripe itself is up is not asked: it is not something restarting this
+// server, or sending its traffic elsewhere, would fix.
+func (s *store) checkStripe() healthCheck {
+	check := healthCheck{Name: s.checkName("stripe"), OK: true}
+	var problems []string
+	for _, err := range s.checkStripeKeys() {
+		problems = append(problems, err.Error())
+	}
+	if len(problems) > 0 {
+		check.OK, check.Detail = false, strings.Join(problems, "; ")
+	}
+	return check
+}
@@ -0,0 +1,20 @@
+//go:build !wasm && !unix
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// canWrite goes by dir's permission bits where there is no access(2) to ask.
+func canWrite(dir string) error {
+	fi, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+	if fi.Mode().Perm()&0o200 == 0 {
+		return errors.New("permission denied")
+	}
+	return nil
+}
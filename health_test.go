@@ -0,0 +1,149 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ready sets up everything /readyz looks at as it is once the server is up,
+// putting it all back afterwards.
+func ready(t *testing.T) {
+	t.Helper()
+	saved := f
+	urls, errs := make([]string, len(wasmFiles)), make([]string, len(wasmFiles))
+	js := make([]string, len(jsFiles))
+	for i := range wasmFiles {
+		urls[i], errs[i] = wasmFiles[i].URL, wasmFiles[i].Err
+		wasmFiles[i].URL, wasmFiles[i].Err = "/assets/"+wasmName(wasmFiles[i].Name), ""
+	}
+	for i := range jsFiles {
+		js[i] = jsFiles[i].URL
+		jsFiles[i].URL = "/assets/" + wasmExecName(i)
+	}
+	t.Cleanup(func() {
+		f = saved
+		for i := range wasmFiles {
+			wasmFiles[i].URL, wasmFiles[i].Err = urls[i], errs[i]
+		}
+		for i := range jsFiles {
+			jsFiles[i].URL = js[i]
+		}
+	})
+	f.APIOnly, f.OrdersDir = false, filepath.Join(t.TempDir(), "orders")
+	f.Teststripekey, f.StripetestSK, f.StripetestPK = true, "sk_test_abc", "pk_test_abc"
+}
+
+// probe is what path answers, and its checks by name.
+func probe(t *testing.T, path string) (int, map[string]healthCheck) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/healthz", healthz)
+	r.GET("/readyz", readyz)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+	var body struct {
+		Status string
+		Checks []healthCheck
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: %v: %s", path, err, w.Body)
+	}
+	checks := map[string]healthCheck{}
+	for _, c := range body.Checks {
+		checks[c.Name] = c
+	}
+	return w.Code, checks
+}
+
+// ── readiness ────────────────────────────────────────────────────────────────
+
+func TestReadyOnceEverythingIs(t *testing.T) {
+	ready(t)
+	code, checks := probe(t, "/readyz")
+	if code != http.StatusOK || len(checks) != 4 {
+		t.Errorf("%d %v", code, checks)
+	}
+	for name, c := range checks {
+		if !c.OK {
+			t.Errorf("%s: %s", name, c.Detail)
+		}
+	}
+	if entries, _ := os.ReadDir(f.OrdersDir); len(entries) != 0 { //nolint:errcheck // none either way
+		t.Errorf("the check left %v behind", entries)
+	}
+}
+
+// A wasm build that failed is not ready, so a broken build takes the server
+// out of the pool rather than serving a blank page.
+func TestNotReadyWhenAWasmBuildFailed(t *testing.T) {
+	ready(t)
+	wasmFiles[0].Err = wasmFiles[0].Name + ": exit status 1\nmain.go:3:1: expected declaration"
+	code, checks := probe(t, "/readyz")
+	if code != http.StatusServiceUnavailable || checks["wasm"].OK || !strings.Contains(checks["wasm"].Detail, "exit status 1") {
+		t.Errorf("%d %+v", code, checks["wasm"])
+	}
+	if strings.Contains(checks["wasm"].Detail, "expected declaration") {
+		t.Error("the compiler's output is in the detail")
+	}
+	wasmFiles[0].Err, wasmFiles[0].URL = "", ""
+	if _, checks := probe(t, "/readyz"); checks["wasm"].OK || !strings.Contains(checks["wasm"].Detail, "not built yet") {
+		t.Errorf("unbuilt: %+v", checks["wasm"])
+	}
+}
+
+func TestNotReadyWithoutKeysOrAnOrdersDir(t *testing.T) {
+	ready(t)
+	f.StripetestSK = ""
+	blocker := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(blocker, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f.OrdersDir = filepath.Join(blocker, "orders")
+	code, checks := probe(t, "/readyz")
+	if code != http.StatusServiceUnavailable || checks["stripe"].OK || checks["orders"].OK || !checks["wasm"].OK {
+		t.Errorf("%d %v", code, checks)
+	}
+}
+
+// A probe writes nothing: an orders directory not made yet is ready, since
+// the first order makes it, and is still not there afterwards.
+func TestProbingWritesNothing(t *testing.T) {
+	ready(t)
+	code, checks := probe(t, "/readyz")
+	if code != http.StatusOK || !checks["orders"].OK {
+		t.Fatalf("%d %v", code, checks)
+	}
+	if _, err := os.Stat(f.OrdersDir); !os.IsNotExist(err) {
+		t.Errorf("the probe made %s: %v", f.OrdersDir, err)
+	}
+}
+
+// An API-only server serves no wasm and is not held up by it.
+func TestAPIOnlyIsReadyWithoutWasm(t *testing.T) {
+	ready(t)
+	f.APIOnly = true
+	wasmFiles[0].URL = ""
+	if code, checks := probe(t, "/readyz"); code != http.StatusOK || len(checks) != 2 {
+		t.Errorf("%d %v", code, checks)
+	}
+}
+
+// ── liveness ─────────────────────────────────────────────────────────────────
+
+func TestHealthyWhileNotReady(t *testing.T) {
+	ready(t)
+	f.StripetestSK = ""
+	if code, _ := probe(t, "/healthz"); code != http.StatusOK {
+		t.Errorf("healthz = %d", code)
+	}
+}
@@ -0,0 +1,131 @@
+//go:build !wasm
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listen opens what LISTEN names: unset for tcp on WEBPORT, unix:<path> for
+// a unix socket a proxy on the same host connects to, or systemd for the
+// socket systemd opened and passed on, from a .socket unit.
+func listen(spec string) (net.Listener, string, error) {
+	switch {
+	case spec == "":
+		ln, err := net.Listen("tcp", fmt.Sprintf(":%d", f.WebPort))
+		return ln, fmt.Sprintf("127.0.0.1:%d", f.WebPort), err
+	case spec == "systemd":
+		ln, err := systemdListener()
+		return ln, "the socket systemd passed", err
+	case strings.HasPrefix(spec, "unix:"):
+		path := strings.TrimPrefix(spec, "unix:")
+		ln, err := unixListener(path)
+		return ln, "unix socket " + path, err
+	}
+	return nil, "", fmt.Errorf("LISTEN: %q is none of unset, unix:<path> or systemd", spec)
+}
+
+// checkListen reports a LISTEN that listen would refuse, without opening it.
+func checkListen(spec string) error {
+	if spec == "" || spec == "systemd" || (strings.HasPrefix(spec, "unix:") && len(spec) > len("unix:")) {
+		return nil
+	}
+	return fmt.Errorf("LISTEN: %q is none of unset, unix:<path> or systemd", spec)
+}
+
+// unixListener listens on a socket at path. A socket left there by a server
+// that was killed is removed first; one that another server still answers
+// on is not.
+func unixListener(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("LISTEN: %s exists and is not a socket", path)
+		}
+		if c, err := net.DialTimeout("unix", path, time.Second); err == nil {
+			c.Close() //nolint:errcheck,gosec // only dialled to see
+			return nil, fmt.Errorf("LISTEN: %s is in use by another server", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// The socket is removed again when the listener is closed.
+	return net.Listen("unix", path)
+}
+
+// systemdListener takes the first socket passed by systemd's socket
+// activation protocol: the fds from 3 on, counted by LISTEN_FDS, for the
+// process LISTEN_PID names.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, errors.New("LISTEN: systemd, but systemd passed no socket; start srv from a .socket unit")
+	}
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("LISTEN: systemd, but LISTEN_FDS is %q", os.Getenv("LISTEN_FDS"))
+	}
+	if n > 1 {
+		log.Printf("systemd passed %d sockets; serving on the first", n)
+	}
+	// Not for any process this one starts, like the compiler.
+	for _, name := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(name) //nolint:errcheck // cannot fail for these names
+	}
+	const firstFD = 3
+	file := os.NewFile(firstFD, "systemd socket")
+	defer file.Close() //nolint:errcheck // the listener has its own copy
+	return net.FileListener(file)
+}
+
+// startServers starts serving handler where LISTEN says, over TLS if
+// TLSCERT is set, and redirecting REDIRECTPORT to it. Each server's end is
+// sent on served; the servers are returned for shutdown.
+func startServers(handler http.Handler, served chan<- error) ([]*http.Server, error) {
+	ln, where, err := listen(f.Listen)
+	if err != nil {
+		return nil, err
+	}
+	srv := newHTTPServer(handler)
+	scheme := "http"
+	if f.TLSCert != "" {
+		certs, err := newCertReloader(f.TLSCert, f.TLSKey)
+		if err != nil {
+			ln.Close() //nolint:errcheck,gosec // not served on
+			return nil, err
+		}
+		srv.TLSConfig, scheme = tlsConfig(certs), "https"
+	}
+	servers := []*http.Server{srv}
+	go func() {
+		fmt.Printf("listening on %s using gin router, serving %s\n", where, scheme)
+		if srv.TLSConfig != nil {
+			served <- srv.ServeTLS(ln, "", "")
+		} else {
+			served <- srv.Serve(ln)
+		}
+	}()
+	if f.RedirectPort != 0 {
+		// A unix or systemd socket has a proxy or a port in front of it
+		// that this server does not know, so the redirect is to 443.
+		port := 443
+		if f.Listen == "" {
+			port = f.WebPort
+		}
+		redirect := newHTTPServer(redirectToHTTPS(port))
+		redirect.Addr = fmt.Sprintf(":%d", f.RedirectPort)
+		servers = append(servers, redirect)
+		go func() {
+			fmt.Printf("redirecting http on port %d to https\n", f.RedirectPort)
+			served <- redirect.ListenAndServe()
+		}()
+	}
+	return servers, nil
+}
@@ -0,0 +1,76 @@
+//go:build !wasm
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// ── listeners ────────────────────────────────────────────────────────────────
+
+// unixSocketPath is short, since a socket's path has to fit in about a
+// hundred bytes and t.TempDir's can be longer.
+func unixSocketPath(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "srv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) }) //nolint:errcheck,gosec // a temp dir
+	return filepath.Join(dir, "srv.sock")
+}
+
+func TestAUnixSocketLeftByAKilledServerIsReplaced(t *testing.T) {
+	path := unixSocketPath(t)
+	// A socket file with nothing listening on it, as a kill leaves.
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close() //nolint:errcheck,gosec // only the file is wanted
+
+	ln, where, err := listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close() //nolint:errcheck // a test listener
+	if !strings.Contains(where, path) {
+		t.Errorf("listening on %q", where)
+	}
+	if _, _, err := listen("unix:" + path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Errorf("a second server took the socket: %v", err)
+	}
+}
+
+func TestAUnixSocketIsNotPutOverAFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "orders.json")
+	if err := os.WriteFile(path, []byte("{}"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := listen("unix:" + path); err == nil {
+		t.Error("listened over a file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "{}" { //nolint:errcheck,gosec // compared
+		t.Error("the file was removed")
+	}
+}
+
+func TestSystemdWithoutASocketSaysHowToStart(t *testing.T) {
+	t.Setenv("LISTEN_PID", "")
+	if _, _, err := listen("systemd"); err == nil || !strings.Contains(err.Error(), ".socket unit") {
+		t.Errorf("err = %v", err)
+	}
+}
+
+func TestListenSettingsAreChecked(t *testing.T) {
+	for spec, ok := range map[string]bool{"": true, "systemd": true, "unix:/run/srv.sock": true, "unix:": false, "tcp:8080": false} {
+		if err := checkListen(spec); (err == nil) != ok {
+			t.Errorf("checkListen(%q) = %v", spec, err)
+		}
+	}
+}
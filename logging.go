@@ -0,0 +1,235 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDHeader carries a request's id in, from a proxy that made one, and
+// out in every response.
+const requestIDHeader = "X-Request-ID"
+
+// accessLog is where the line for each request goes: logOut, where it always
+// went, in the format of the rest of the log.
+var accessLog = slog.New(newLogHandler(logOut, "text", slog.LevelInfo, true))
+
+// initLogging sets up the log as LOGFORMAT and LOGLEVEL say: text, the lines
+// as they have always looked with the fields of each after them, or JSON, a
+// record a line for a log collector. Everything goes through it, the log
+// package included, and through the redaction of secrets first.
+func initLogging() error {
+	if errs := checkLogging(); len(errs) > 0 {
+		return errs[0]
+	}
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(f.LogLevel)) //nolint:errcheck // checked above
+	if f.LogFormat == "json" {
+		// gin's own lines, the routes at startup, are not JSON.
+		gin.SetMode(gin.ReleaseMode)
+	}
+	slog.SetDefault(slog.New(newLogHandler(redactor{os.Stderr}, f.LogFormat, level, false)))
+	accessLog = slog.New(newLogHandler(logOut, f.LogFormat, level, true))
+	return nil
+}
+
+// checkLogging reports a LOGFORMAT or LOGLEVEL there is no such thing as.
+func checkLogging() []error {
+	var errs []error
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(f.LogLevel)); err != nil {
+		errs = append(errs, fmt.Errorf("LOGLEVEL: %q is not debug, info, warn or error", f.LogLevel))
+	}
+	if f.LogFormat != "text" && f.LogFormat != "json" {
+		errs = append(errs, fmt.Errorf("LOGFORMAT: %q is not text or json", f.LogFormat))
+	}
+	return errs
+}
+
+// newLogHandler is a handler writing format to w, adding to each record the
+// id of the request it was logged for. An access handler writes the request
+// lines.
+func newLogHandler(w io.Writer, format string, level slog.Level, access bool) slog.Handler {
+	if format == "json" {
+		return requestIDHandler{slog.NewJSONHandler(w, &slog.HandlerOptions{Level: level})}
+	}
+	return requestIDHandler{&textHandler{w: w, level: level, access: access, mu: &sync.Mutex{}}}
+}
+
+type requestIDKey struct{}
+
+// requestID is the id of the request ctx belongs to, or "".
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string) //nolint:errcheck // not a request, no id
+	return id
+}
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// requestIDMiddleware gives each request an id: the one a proxy in front
+// sent in X-Request-ID, so that its log and this one can be matched up, or
+// a new one. It goes back in the response, and with every line logged for
+// the request and every error it is answered with.
+func requestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = rand.Text()
+		}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestIDKey{}, id))
+		c.Writer.Header().Set(requestIDHeader, id)
+		c.Next()
+	}
+}
+
+// errorBody is the JSON an error is answered with: the message, and the
+// request's id, to quote when asking what went wrong.
+func errorBody(c *gin.Context, msg string) gin.H {
+	return gin.H{"error": msg, "requestId": requestID(c.Request.Context())}
+}
+
+// requestIDHandler adds the request's id to a record logged with its context.
+type requestIDHandler struct{ slog.Handler }
+
+func (h requestIDHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := requestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIDHandler) WithGroup(name string) slog.Handler {
+	return requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+// textHandler writes a record as the log package did, date, time and
+// message, with its level before the message when that is not info and its
+// fields after it as key=value. An access handler writes the colored request
+// line loggingMiddleware always wrote, with the request's id at the end.
+type textHandler struct {
+	w      io.Writer
+	level  slog.Level
+	access bool
+	attrs  []slog.Attr
+	group  string
+	mu     *sync.Mutex
+}
+
+func (h *textHandler) Enabled(_ context.Context, level slog.Level) bool { return level >= h.level }
+
+func (h *textHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr(nil), h.attrs...), h.grouped(attrs)...)
+	return &h2
+}
+
+func (h *textHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+func (h *textHandler) grouped(attrs []slog.Attr) []slog.Attr {
+	if h.group == "" {
+		return attrs
+	}
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = slog.Attr{Key: h.group + a.Key, Value: a.Value}
+	}
+	return out
+}
+
+func (h *textHandler) Handle(_ context.Context, r slog.Record) error {
+	attrs := append([]slog.Attr(nil), h.attrs...)
+	var own []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		own = append(own, a)
+		return true
+	})
+	attrs = append(attrs, h.grouped(own)...)
+
+	var buf bytes.Buffer
+	if h.access {
+		writeAccessLine(&buf, r.Time, attrs)
+	} else {
+		buf.WriteString(r.Time.Format("2006/01/02 15:04:05 "))
+		if r.Level != slog.LevelInfo {
+			buf.WriteString(r.Level.String() + " ")
+		}
+		buf.WriteString(strings.TrimSuffix(r.Message, "\n"))
+		for _, a := range attrs {
+			buf.WriteString(" " + a.Key + "=" + quoteIfNeeded(a.Value.Resolve().String()))
+		}
+	}
+	buf.WriteByte('\n')
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := h.w.Write(buf.Bytes())
+	return err
+}
+
+func quoteIfNeeded(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// writeAccessLine is the request line, from the fields loggingMiddleware
+// logs it with.
+func writeAccessLine(buf *bytes.Buffer, t time.Time, attrs []slog.Attr) {
+	fields := map[string]slog.Value{}
+	for _, a := range attrs {
+		fields[a.Key] = a.Value.Resolve()
+	}
+	status, method := int(fields["status"].Int64()), fields["method"].String()
+	fmt.Fprintf(buf, "[GIN] | %s |%s %3d %s| %13v | %15s | %72s |%s %-7s %s %s", t.Format("2006/01/02 - 15:04:05"),
+		getBackgroundColor(status), status, resetColor(), fields["latency"].Duration(), fields["ip"].String(), fields["peer"].String(),
+		getMethodColor(method), method, resetColor(), fields["path"].String())
+	if id := fields["request_id"]; id.Kind() == slog.KindString {
+		buf.WriteString(" " + id.String())
+	}
+}
+
+// loggingMiddleware logs each request once it has been answered: server
+// errors as errors, everything else as info.
+func loggingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		latency := time.Since(start)
+		if latency > time.Minute {
+			latency = latency.Truncate(time.Second)
+		}
+		level := slog.LevelInfo
+		if c.Writer.Status() >= 500 {
+			level = slog.LevelError
+		}
+		accessLog.LogAttrs(c.Request.Context(), level, "request",
+			slog.Int("status", c.Writer.Status()),
+			slog.String("method", c.Request.Method),
+			slog.String("path", c.Request.URL.Path),
+			slog.Duration("latency", latency),
+			slog.String("ip", clientIP(c)),
+			slog.String("peer", c.Request.RemoteAddr),
+		)
+	}
+}
@@ -0,0 +1,137 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keepLogging puts the loggers back after a test that sets them up.
+func keepLogging(t *testing.T) {
+	t.Helper()
+	savedDefault, savedAccess, savedOut, savedFlags := slog.Default(), accessLog, log.Writer(), log.Flags()
+	t.Cleanup(func() {
+		// Setting the default logger points the log package at it; setting
+		// the original back does not undo that.
+		slog.SetDefault(savedDefault)
+		log.SetOutput(savedOut)
+		log.SetFlags(savedFlags)
+		accessLog = savedAccess
+	})
+}
+
+// loggedRequest serves a request through the request id and logging
+// middleware to a handler that logs a line and fails, with both logs in
+// format written to the buffers returned.
+func loggedRequest(t *testing.T, format string, headers ...string) (w *httptest.ResponseRecorder, lines, access *bytes.Buffer) {
+	t.Helper()
+	lines, access = &bytes.Buffer{}, &bytes.Buffer{}
+	keepLogging(t)
+	slog.SetDefault(slog.New(newLogHandler(lines, format, slog.LevelInfo, false)))
+	accessLog = slog.New(newLogHandler(access, format, slog.LevelInfo, true))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(requestIDMiddleware(), loggingMiddleware())
+	r.POST("/submit-order", func(c *gin.Context) {
+		slog.ErrorContext(c.Request.Context(), "Error writing order", "payment_intent", "pi_1", "err", "disk full")
+		c.JSON(http.StatusInternalServerError, errorBody(c, "Unable to save order"))
+	})
+	req := httptest.NewRequest(http.MethodPost, "/submit-order", nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Set(headers[i], headers[i+1])
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w, lines, access
+}
+
+// ── request ids ──────────────────────────────────────────────────────────────
+
+// The id in the response, in the error and in each line logged for the
+// request is the same, so a shopper's reference finds the lines.
+func TestARequestsIDIsInItsErrorAndItsLogLines(t *testing.T) {
+	w, lines, access := loggedRequest(t, "json")
+	id := w.Header().Get(requestIDHeader)
+	if len(id) != 26 {
+		t.Fatalf("X-Request-ID = %q", id)
+	}
+	var body struct{ Error, RequestID string }
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body.RequestID != id {
+		t.Errorf("body = %s", w.Body)
+	}
+	for name, buf := range map[string]*bytes.Buffer{"line": lines, "request": access} {
+		var rec map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &rec); err != nil {
+			t.Fatalf("%s: %v: %s", name, err, buf)
+		}
+		if rec["request_id"] != id || rec["level"] != "ERROR" {
+			t.Errorf("%s = %v", name, rec)
+		}
+	}
+	if !strings.Contains(lines.String(), `"payment_intent":"pi_1"`) || !strings.Contains(access.String(), `"status":500`) {
+		t.Errorf("fields missing:\n%s%s", lines, access)
+	}
+}
+
+func TestAProxysRequestIDIsKept(t *testing.T) {
+	if w, _, _ := loggedRequest(t, "json", requestIDHeader, "edge-4f2a.9"); w.Header().Get(requestIDHeader) != "edge-4f2a.9" {
+		t.Errorf("X-Request-ID = %q", w.Header().Get(requestIDHeader))
+	}
+	// One that could break a log line is replaced.
+	if w, _, _ := loggedRequest(t, "json", requestIDHeader, "a b\"c"); w.Header().Get(requestIDHeader) == "a b\"c" {
+		t.Error("kept an id with a space and a quote in it")
+	}
+}
+
+// ── formats ──────────────────────────────────────────────────────────────────
+
+func TestTheTextLogLooksAsItDid(t *testing.T) {
+	w, lines, access := loggedRequest(t, "text")
+	id := w.Header().Get(requestIDHeader)
+	line := lines.String()
+	if !strings.Contains(line, " ERROR Error writing order payment_intent=pi_1 err=\"disk full\" request_id="+id+"\n") {
+		t.Errorf("line = %q", line)
+	}
+	request := access.String()
+	if !strings.HasPrefix(request, "[GIN] | ") || !strings.Contains(request, getBackgroundColor(500)+" 500 ") || !strings.HasSuffix(request, "/submit-order "+id+"\n") {
+		t.Errorf("request line = %q", request)
+	}
+}
+
+func TestLinesBelowLogLevelAreDropped(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newLogHandler(&buf, "text", slog.LevelWarn, false))
+	logger.Info("dropped")
+	logger.With("store", "main").WithGroup("order").Warn("kept", "id", 7)
+	if got := buf.String(); strings.Contains(got, "dropped") || !strings.HasSuffix(got, " WARN kept store=main order.id=7\n") {
+		t.Errorf("log = %q", got)
+	}
+	logger.InfoContext(context.Background(), "still dropped")
+	if strings.Contains(buf.String(), "still") {
+		t.Error("an info line was written at warn")
+	}
+}
+
+func TestCheckLoggingNamesEachBadSetting(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.LogFormat, f.LogLevel = "xml", "loud"
+	if errs := checkLogging(); len(errs) != 2 || !strings.Contains(errs[0].Error(), "LOGLEVEL") || !strings.Contains(errs[1].Error(), "LOGFORMAT") {
+		t.Errorf("errs = %v", errs)
+	}
+	f.LogFormat, f.LogLevel = "json", "DEBUG"
+	if errs := checkLogging(); len(errs) != 0 {
+		t.Errorf("errs = %v", errs)
+	}
+}
@@ -0,0 +1,103 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// sendMail is smtp.SendMail, which a test replaces to see what would be sent.
+var sendMail = smtp.SendMail
+
+// mailSettings is where a store's order notices go and how they get there.
+type mailSettings struct {
+	addr, user, password string
+	from                 string
+	to                   []string
+}
+
+// mail is the store's mail server, with the login that goes with it, or the
+// flags' when it names none of its own; the addresses fall back one by one.
+func (s *store) mail() mailSettings {
+	m := mailSettings{addr: f.SMTPAddr, user: f.SMTPUser, password: f.SMTPPassword}
+	if s.SMTPAddr != "" {
+		m.addr, m.user, m.password = s.SMTPAddr, s.SMTPUser, s.SMTPPassword
+	}
+	m.from = cmp.Or(s.EmailFrom, f.EmailFrom)
+	for _, to := range strings.Split(cmp.Or(s.EmailTo, f.EmailTo), ",") {
+		if to = strings.TrimSpace(to); to != "" {
+			m.to = append(m.to, to)
+		}
+	}
+	return m
+}
+
+// checkMail reports mail settings that would keep order notices from being
+// sent: the store's own, or all of them for defaultStore, once a mail server
+// is set at all.
+func (s *store) checkMail() []error {
+	m := s.mail()
+	if m.addr == "" || (s.Host != "" && s.SMTPAddr == "" && s.EmailFrom == "" && s.EmailTo == "") {
+		return nil
+	}
+	var errs []error
+	if _, _, err := net.SplitHostPort(m.addr); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %w", s.setting("SMTPADDR", "smtpAddr"), err))
+	}
+	if _, err := mail.ParseAddress(m.from); err != nil {
+		errs = append(errs, fmt.Errorf("%s: %q: %w", s.setting("EMAILFROM", "emailFrom"), m.from, err))
+	}
+	if len(m.to) == 0 {
+		errs = append(errs, fmt.Errorf("%s: no address to send order notices to", s.setting("EMAILTO", "emailTo")))
+	}
+	for _, to := range m.to {
+		if _, err := mail.ParseAddress(to); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %q: %w", s.setting("EMAILTO", "emailTo"), to, err))
+		}
+	}
+	if m.user != "" && m.password == "" {
+		errs = append(errs, fmt.Errorf("%s: no password for %s", s.setting("SMTPPASSWORD", "smtpPassword"), m.user))
+	}
+	return errs
+}
+
+// orderNotice is the mail telling the shop a new order came in: what was
+// bought, for how much and where it is to be shipped.
+func orderNotice(m mailSettings, piid string, order map[string]interface{}, amount int64, currency string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "From: %s\r\n", m.from)
+	fmt.Fprintf(&b, "To: %s\r\n", strings.Join(m.to, ", "))
+	fmt.Fprintf(&b, "Subject: New order %s\r\n", piid)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	fmt.Fprintf(&b, "Order %s for %.2f %s\r\n\r\n", piid, float64(amount)/100, strings.ToUpper(currency))
+	fmt.Fprintf(&b, "Items: %s\r\n", itemList(orderItems(order)))
+	for id := range orderItems(order) {
+		if to, ok := strings.CutPrefix(id, "shipping-to|"); ok {
+			fmt.Fprintf(&b, "Ship to: %s\r\n", strings.NewReplacer("|", ", ", "\r", " ", "\n", " ").Replace(to))
+		}
+	}
+	return b.Bytes()
+}
+
+// notifyOrder mails the store's notice of a new order, when it has a mail
+// server to send it through.
+func (s *store) notifyOrder(piid string, order map[string]interface{}, amount int64, currency string) error {
+	m := s.mail()
+	if m.addr == "" {
+		return nil
+	}
+	var auth smtp.Auth
+	if m.user != "" {
+		host, _, _ := net.SplitHostPort(m.addr) //nolint:errcheck // checked by config check; PlainAuth then refuses the login
+		auth = smtp.PlainAuth("", m.user, m.password, host)
+	}
+	return sendMail(m.addr, auth, m.from, m.to, orderNotice(m, piid, order, amount, currency))
+}
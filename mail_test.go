@@ -0,0 +1,116 @@
+//go:build !wasm
+
+package main
+
+import (
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+// sentMail is one call to sendMail.
+type sentMail struct {
+	addr string
+	auth bool
+	from string
+	to   []string
+	body string
+}
+
+// catchMail replaces sendMail for a test and returns what it was given.
+func catchMail(t *testing.T) *[]sentMail {
+	t.Helper()
+	var sent []sentMail
+	saved := sendMail
+	sendMail = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, sentMail{addr: addr, auth: auth != nil, from: from, to: to, body: string(msg)})
+		return nil
+	}
+	t.Cleanup(func() { sendMail = saved })
+	return &sent
+}
+
+var noticeOrder = map[string]interface{}{"cartItems": []interface{}{
+	map[string]interface{}{"id": "VT-8AW8A", "amount": 1999.0, "quantity": 2.0},
+	map[string]interface{}{"id": "shipping-to|John Q. Public|123 Skidoo Street|Philadelphia|PA|19129|United States|555", "amount": 700.0, "quantity": 1.0},
+}}
+
+// ── sending ──────────────────────────────────────────────────────────────────
+
+func TestAStoreMailsItsOwnOrderNotices(t *testing.T) {
+	keepStores(t)
+	sent := catchMail(t)
+	f.SMTPAddr, f.SMTPUser, f.SMTPPassword, f.EmailFrom, f.EmailTo = "mail.example:587", "shop", "secret", "shop@example.com", "owner@example.com"
+	radios := &store{Host: "radios.example", SMTPAddr: "mail.radios.example:25", EmailTo: "radios@example.com, parts@example.com"}
+	if err := radios.notifyOrder("pi_1", noticeOrder, 4698, "eur"); err != nil {
+		t.Fatal(err)
+	}
+	if err := defaultStore.notifyOrder("pi_2", noticeOrder, 4698, "usd"); err != nil {
+		t.Fatal(err)
+	}
+	if len(*sent) != 2 {
+		t.Fatalf("sent %d mails, want 2", len(*sent))
+	}
+	r, d := (*sent)[0], (*sent)[1]
+	if r.addr != "mail.radios.example:25" || r.auth || r.from != "shop@example.com" || strings.Join(r.to, " ") != "radios@example.com parts@example.com" {
+		t.Errorf("radios.example's notice went %+v, want its own server, without the flags' login", r)
+	}
+	if d.addr != "mail.example:587" || !d.auth || strings.Join(d.to, " ") != "owner@example.com" {
+		t.Errorf("the flags' store's notice went %+v", d)
+	}
+	for _, want := range []string{"Subject: New order pi_1\r\n", "Order pi_1 for 46.98 EUR", "Items: VT-8AW8A x2\r\n", "Ship to: John Q. Public, 123 Skidoo Street, Philadelphia"} {
+		if !strings.Contains(r.body, want) {
+			t.Errorf("the notice does not say %q:\n%s", want, r.body)
+		}
+	}
+}
+
+func TestNoMailServerSendsNothing(t *testing.T) {
+	keepStores(t)
+	sent := catchMail(t)
+	f.SMTPAddr, f.EmailTo = "", "owner@example.com"
+	if err := (&store{Host: "radios.example", EmailTo: "radios@example.com"}).notifyOrder("pi_1", noticeOrder, 100, "usd"); err != nil || len(*sent) > 0 {
+		t.Errorf("sent %d mails, err %v, with no SMTPADDR", len(*sent), err)
+	}
+}
+
+// ── settings ─────────────────────────────────────────────────────────────────
+
+// A store's SMTP password is read from where it points, as its Stripe keys are.
+func TestAStoresSMTPPasswordComesFromTheEnvironmentOrAFile(t *testing.T) {
+	keepStores(t)
+	t.Setenv("RADIOS_SMTP", "hunter2")
+	writeStores(t, `{"radios.example": {"smtpAddr": "mail.radios.example:587", "smtpUser": "radios", "smtpPasswordEnv": "RADIOS_SMTP"}}`)
+	if err := initStores(); err != nil {
+		t.Fatal(err)
+	}
+	if m := stores["radios.example"].mail(); m.user != "radios" || m.password != "hunter2" {
+		t.Errorf("login %q, %q, want the store's", m.user, m.password)
+	}
+	writeStores(t, `{"radios.example": {"smtpPassword": "hunter2"}}`)
+	if err := initStores(); err == nil || !strings.Contains(err.Error(), "smtpPasswordFile") {
+		t.Errorf("got %v, want the inline password refused", err)
+	}
+}
+
+func TestMailCheckNamesTheSetting(t *testing.T) {
+	keepStores(t)
+	f.SMTPAddr, f.SMTPUser, f.SMTPPassword, f.EmailFrom, f.EmailTo = "mail.example", "shop", "", "not an address", ""
+	var got []string
+	for _, err := range defaultStore.checkMail() {
+		got = append(got, err.Error())
+	}
+	for _, want := range []string{"SMTPADDR: ", "EMAILFROM: ", "EMAILTO: no address", "SMTPPASSWORD: no password for shop"} {
+		if !strings.Contains(strings.Join(got, "\n"), want) {
+			t.Errorf("got %q, want %q among them", got, want)
+		}
+	}
+	s := &store{Host: "radios.example", SMTPAddr: "mail.radios.example:25", EmailFrom: "radios@example.com", EmailTo: "radios@, parts@example.com"}
+	if errs := s.checkMail(); len(errs) != 1 || !strings.HasPrefix(errs[0].Error(), `STORES: radios.example: emailTo: "radios@"`) {
+		t.Errorf("got %v, want emailTo's bad address", errs)
+	}
+	// A store with no mail settings of its own is the flags', checked once.
+	if errs := (&store{Host: "tubes.example"}).checkMail(); len(errs) > 0 {
+		t.Errorf("a store without mail settings reports %v", errs)
+	}
+}
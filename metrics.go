@@ -0,0 +1,256 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"maps"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// The metrics /metrics serves, in the Prometheus text format. There are few
+// enough of them, and kinds of them, that they are kept here rather than
+// with a client library.
+var (
+	httpRequests = newCounter("srv_http_requests_total",
+		"HTTP requests answered, by route, method and status.", "route", "method", "status")
+	httpDuration = newHistogram("srv_http_request_duration_seconds",
+		"How long HTTP requests took to answer, by route and method.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "route", "method")
+	paymentIntents = newCounter("srv_payment_intents_total",
+		"Payment intents by outcome: created; succeeded, when its order is submitted; processing, when it is submitted still waiting on the bank; failed, when Stripe would not make one, or it is submitted declined or cancelled. Each intent counts once under each outcome.", "outcome")
+	ordersWritten = newCounter("srv_orders_written_total",
+		"Orders recorded.")
+	orderRevenue = newCounter("srv_order_revenue_minor_units_total",
+		"What the orders recorded were paid, in the currency's smallest unit, cents for usd.", "currency")
+	wasmBuildDuration = newHistogram("srv_wasm_build_duration_seconds",
+		"How long wasm builds took, from the cache or the compiler, by entrypoint and result.",
+		[]float64{.1, .5, 1, 2, 5, 10, 20, 30, 60, 120}, "entrypoint", "result")
+	wasmSize = newGauge("srv_wasm_size_bytes",
+		"Size of the wasm being served, by entrypoint.", "entrypoint")
+	watchErrors = newCounter("srv_watch_errors_total",
+		"Errors watching the sources for changes in dev mode.")
+)
+
+// intentOutcome is the outcome a payment intent submitted with an order that
+// has not succeeded is counted under: processing, failed if it was declined
+// or cancelled, and "" for one still waiting on the shopper.
+func intentOutcome(status stripe.PaymentIntentStatus) string {
+	switch status {
+	case stripe.PaymentIntentStatusProcessing:
+		return "processing"
+	case stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.PaymentIntentStatusCanceled:
+		return "failed"
+	}
+	return ""
+}
+
+// outcomesCounted are the intents counted under each outcome, by "id
+// outcome", and when. The complete page submits on every load, so without
+// them a reload would count the same intent again. They are forgotten after
+// a day, by when an intent is long settled.
+var outcomesCounted = struct {
+	sync.Mutex
+	seen      map[string]time.Time
+	lastSweep time.Time
+}{seen: map[string]time.Time{}}
+
+// countIntentOutcome counts the intent id under outcome, once.
+func countIntentOutcome(id, outcome string) {
+	now := time.Now()
+	outcomesCounted.Lock()
+	defer outcomesCounted.Unlock()
+	if now.Sub(outcomesCounted.lastSweep) >= time.Hour {
+		outcomesCounted.lastSweep = now
+		for key, seen := range outcomesCounted.seen {
+			if now.Sub(seen) >= 24*time.Hour {
+				delete(outcomesCounted.seen, key)
+			}
+		}
+	}
+	key := id + " " + outcome
+	if _, ok := outcomesCounted.seen[key]; ok {
+		return
+	}
+	outcomesCounted.seen[key] = now
+	paymentIntents.inc(outcome)
+}
+
+// metric is one metric and all its series.
+type metric struct {
+	name, help, kind string
+	labels           []string
+	buckets          []float64
+
+	mu     sync.Mutex
+	series map[string]*series
+}
+
+// series is one set of label values and what has been recorded for it: a
+// value, or for a histogram the count in each bucket, the sum and the count.
+type series struct {
+	labels  []string
+	value   float64
+	buckets []uint64
+	count   uint64
+}
+
+var registry []*metric
+
+func register(m *metric) *metric {
+	m.series = map[string]*series{}
+	if len(m.labels) == 0 {
+		m.get() // a metric without labels is 0 before anything happens
+	}
+	registry = append(registry, m)
+	return m
+}
+
+func newCounter(name, help string, labels ...string) *metric {
+	return register(&metric{name: name, help: help, kind: "counter", labels: labels})
+}
+
+func newGauge(name, help string, labels ...string) *metric {
+	return register(&metric{name: name, help: help, kind: "gauge", labels: labels})
+}
+
+func newHistogram(name, help string, buckets []float64, labels ...string) *metric {
+	return register(&metric{name: name, help: help, kind: "histogram", labels: labels, buckets: buckets})
+}
+
+// get is the series for the label values, made if there is none; m.mu is
+// held, or m is being registered.
+func (m *metric) get(values ...string) *series {
+	key := strings.Join(values, "\xff")
+	s, ok := m.series[key]
+	if !ok {
+		s = &series{labels: values, buckets: make([]uint64, len(m.buckets))}
+		m.series[key] = s
+	}
+	return s
+}
+
+// add adds to a counter.
+func (m *metric) add(delta float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values...).value += delta
+}
+
+func (m *metric) inc(values ...string) { m.add(1, values...) }
+
+// set sets a gauge.
+func (m *metric) set(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.get(values...).value = v
+}
+
+// observe records a value in a histogram.
+func (m *metric) observe(v float64, values ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := m.get(values...)
+	for i, le := range m.buckets {
+		if v <= le {
+			s.buckets[i]++
+		}
+	}
+	s.value += v
+	s.count++
+}
+
+func (m *metric) write(buf *bytes.Buffer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	buf.WriteString("# HELP " + m.name + " " + m.help + "\n")
+	buf.WriteString("# TYPE " + m.name + " " + m.kind + "\n")
+	for _, key := range slices.Sorted(maps.Keys(m.series)) {
+		s := m.series[key]
+		if m.kind != "histogram" {
+			writeSample(buf, m.name, m.labels, s.labels, "", s.value)
+			continue
+		}
+		for i, le := range m.buckets {
+			writeSample(buf, m.name+"_bucket", m.labels, s.labels, formatFloat(le), float64(s.buckets[i]))
+		}
+		writeSample(buf, m.name+"_bucket", m.labels, s.labels, "+Inf", float64(s.count))
+		writeSample(buf, m.name+"_sum", m.labels, s.labels, "", s.value)
+		writeSample(buf, m.name+"_count", m.labels, s.labels, "", float64(s.count))
+	}
+}
+
+func writeSample(buf *bytes.Buffer, name string, labels, values []string, le string, v float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 || le != "" {
+		buf.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(l + `="` + labelEscaper.Replace(values[i]) + `"`)
+		}
+		if le != "" {
+			if len(labels) > 0 {
+				buf.WriteByte(',')
+			}
+			buf.WriteString(`le="` + le + `"`)
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteString(" " + formatFloat(v) + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// serveMetrics is /metrics.
+func serveMetrics(c *gin.Context) {
+	var buf bytes.Buffer
+	for _, m := range registry {
+		m.write(&buf)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
+
+// metricsMiddleware counts and times each request by its route, the pattern
+// it matched, so that /p/:id is one series and not one per product. What
+// matched nothing is one series too, and a method HTTP does not define is
+// counted as "other", so that a client cannot make series by inventing them.
+func metricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		method := c.Request.Method
+		if !slices.Contains(httpMethods, method) {
+			method = "other"
+		}
+		httpRequests.inc(route, method, strconv.Itoa(c.Writer.Status()))
+		httpDuration.observe(time.Since(start).Seconds(), route, method)
+	}
+}
+
+// httpMethods are the methods the method label can take as they are.
+var httpMethods = []string{
+	http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch,
+	http.MethodDelete, http.MethodConnect, http.MethodOptions, http.MethodTrace,
+}
@@ -0,0 +1,159 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// scrape serves a request to path through the metrics middleware, then
+// /metrics, with the token given if any, and returns what it answered.
+func scrape(t *testing.T, path, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(requestIDMiddleware(), metricsMiddleware())
+	r.GET("/p/:id", func(c *gin.Context) { c.String(http.StatusOK, "product") })
+	if token != "" {
+		r.GET("/metrics", adminAuth(token), serveMetrics)
+	} else {
+		r.GET("/metrics", serveMetrics)
+	}
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, path, nil))
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	return w
+}
+
+// ── requests ─────────────────────────────────────────────────────────────────
+
+// Requests are counted by the route they matched, not their path, so that
+// each product is not a series of its own.
+func TestRequestsAreCountedByRoute(t *testing.T) {
+	scrape(t, "/p/shirt", "")
+	w := scrape(t, "/p/hat", "")
+	body := w.Body.String()
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("%d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+	for _, want := range []string{
+		`srv_http_requests_total{route="/p/:id",method="GET",status="200"} `,
+		`srv_http_request_duration_seconds_bucket{route="/p/:id",method="GET",le="+Inf"} `,
+		`srv_http_request_duration_seconds_count{route="/p/:id",method="GET"} `,
+		"# TYPE srv_http_request_duration_seconds histogram\n",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("no %q in\n%s", want, body)
+		}
+	}
+	if strings.Contains(body, "/p/hat") || strings.Contains(body, "/p/shirt") {
+		t.Error("a product's path is a label")
+	}
+	if !strings.Contains(scrape(t, "/nowhere", "").Body.String(), `route="unmatched",method="GET",status="404"`) {
+		t.Error("a 404 is not counted as unmatched")
+	}
+}
+
+// A made-up method is not a series of its own.
+func TestAnUnknownMethodIsCountedAsOther(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(metricsMiddleware())
+	r.GET("/metrics", serveMetrics)
+	for _, method := range []string{"BREW", "PROPFIND", "X-7f3a"} {
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(method, "/nowhere", nil))
+	}
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := w.Body.String()
+	if !strings.Contains(body, `route="unmatched",method="other",status="404"`) {
+		t.Errorf("made-up methods are not counted as other:\n%s", body)
+	}
+	for _, method := range []string{"BREW", "PROPFIND", "X-7f3a"} {
+		if strings.Contains(body, `method="`+method+`"`) {
+			t.Errorf("%s is a label", method)
+		}
+	}
+}
+
+// The complete page submits on every load: an intent still processing is not
+// a failure, and a reload does not count it again.
+func TestIntentOutcomesAreCountedOncePerIntent(t *testing.T) {
+	value := func(outcome string) float64 {
+		paymentIntents.mu.Lock()
+		defer paymentIntents.mu.Unlock()
+		return paymentIntents.get(outcome).value
+	}
+	processing, failed := value("processing"), value("failed")
+	for range 3 {
+		if outcome := intentOutcome(stripe.PaymentIntentStatusProcessing); outcome != "" {
+			countIntentOutcome("pi_outcome", outcome)
+		}
+	}
+	countIntentOutcome("pi_outcome", intentOutcome(stripe.PaymentIntentStatusRequiresPaymentMethod))
+	countIntentOutcome("pi_outcome", intentOutcome(stripe.PaymentIntentStatusCanceled))
+	if got := value("processing") - processing; got != 1 {
+		t.Errorf("processing counted %v times, want once", got)
+	}
+	if got := value("failed") - failed; got != 1 {
+		t.Errorf("failed counted %v times, want once", got)
+	}
+	if outcome := intentOutcome(stripe.PaymentIntentStatusRequiresAction); outcome != "" {
+		t.Errorf("an intent waiting on the shopper is counted as %s", outcome)
+	}
+}
+
+func TestMetricsAskForTheTokenWhenThereIsOne(t *testing.T) {
+	if w := scrape(t, "/p/shirt", "s3cret"); w.Code != http.StatusOK {
+		t.Errorf("with the token: %d", w.Code)
+	}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(requestIDMiddleware())
+	r.GET("/metrics", adminAuth("s3cret"), serveMetrics)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusUnauthorized || strings.Contains(w.Body.String(), "srv_") {
+		t.Errorf("without the token: %d %s", w.Code, w.Body)
+	}
+}
+
+// ── exposition ───────────────────────────────────────────────────────────────
+
+func TestMetricsAreWrittenInTheTextFormat(t *testing.T) {
+	saved := registry
+	defer func() { registry = saved }()
+	h := newHistogram("t_seconds", "A test.", []float64{1, 5}, "name")
+	h.observe(0.5, `a"b\c`)
+	h.observe(3, `a"b\c`)
+	var buf bytes.Buffer
+	h.write(&buf)
+	want := `# HELP t_seconds A test.
+# TYPE t_seconds histogram
+t_seconds_bucket{name="a\"b\\c",le="1"} 1
+t_seconds_bucket{name="a\"b\\c",le="5"} 2
+t_seconds_bucket{name="a\"b\\c",le="+Inf"} 2
+t_seconds_sum{name="a\"b\\c"} 3.5
+t_seconds_count{name="a\"b\\c"} 2
+`
+	if buf.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", &buf, want)
+	}
+	// A counter without labels is there, at 0, before anything is counted.
+	buf.Reset()
+	newCounter("t_total", "Another.").write(&buf)
+	if !strings.HasSuffix(buf.String(), "\nt_total 0\n") {
+		t.Errorf("counter = %q", &buf)
+	}
+}
@@ -0,0 +1,452 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/stripe/stripe-go/v80"
+)
+
+// ordersMu serializes the read-modify-write of an order file, so a refund and
+// a resubmitted order cannot each write back a copy missing the other.
+var ordersMu sync.Mutex
+
+// orderEvent is one entry in an order's history, which is kept in the order
+// file itself under "history".
+type orderEvent struct {
+	Time     time.Time        `json:"time"`
+	Action   string           `json:"action"`
+	Amount   int64            `json:"amount,omitempty"`
+	RefundID string           `json:"refundId,omitempty"`
+	Reason   string           `json:"reason,omitempty"`
+	Restock  map[string]int64 `json:"restock,omitempty"`
+}
+
+// refundRequest is what the CLI and the admin endpoint both hand to
+// refundOrder. An Amount of zero refunds whatever is left of the payment.
+type refundRequest struct {
+	Amount     int64            `json:"amount"`
+	Reason     string           `json:"reason"`
+	Restock    map[string]int64 `json:"restock"`
+	RestockAll bool             `json:"restockAll"`
+}
+
+// A payment intent id becomes a file name, so it may not contain anything that
+// would take it outside the orders directory.
+var piidPattern = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+
+func (s *store) orderPath(piid string) (string, error) {
+	if !piidPattern.MatchString(piid) {
+		return "", fmt.Errorf("invalid payment intent id %q", piid)
+	}
+	return filepath.Join(s.ordersDir(), piid+".json"), nil
+}
+
+func (s *store) readOrder(piid string) (map[string]interface{}, error) {
+	path, err := s.orderPath(piid)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path) //nolint:gosec // the id is checked against piidPattern
+	if err != nil {
+		return nil, err
+	}
+	var order map[string]interface{}
+	if err := json.Unmarshal(data, &order); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return order, nil
+}
+
+func (s *store) writeOrder(piid string, order map[string]interface{}) error {
+	path, err := s.orderPath(piid)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.ordersDir(), 0o750); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(order, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileSynced(path, data)
+}
+
+// orderItems counts the quantity of each line in the cart the order was placed
+// with. The cart is stored as the client sent it, so the numbers are JSON
+// float64s.
+func orderItems(order map[string]interface{}) map[string]int64 {
+	counts := map[string]int64{}
+	lines, _ := order["cartItems"].([]interface{}) //nolint:errcheck // a missing cart is an empty one
+	for _, l := range lines {
+		line, ok := l.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		id, _ := line["id"].(string)         //nolint:errcheck // skipped below when empty
+		qty, _ := line["quantity"].(float64) //nolint:errcheck // as above
+		if id != "" && qty > 0 {
+			counts[id] += int64(qty)
+		}
+	}
+	return counts
+}
+
+func orderHistory(order map[string]interface{}) []orderEvent {
+	var history []orderEvent
+	data, err := json.Marshal(order["history"])
+	if err != nil {
+		return nil
+	}
+	if err := json.Unmarshal(data, &history); err != nil {
+		return nil
+	}
+	return history
+}
+
+func appendHistory(order map[string]interface{}, ev orderEvent) {
+	order["history"] = append(orderHistory(order), ev)
+}
+
+// refundIdempotencyKey names a refund to Stripe by the order, the amount and
+// how many refunds the order already records. A refund retried because its
+// answer was lost, or because it could not be recorded, has the same key, and
+// Stripe hands back the refund it already made instead of making another; a
+// second refund of the same amount, asked for once the first is recorded, has
+// a key of its own.
+func refundIdempotencyKey(piid string, amount int64, order map[string]interface{}) string {
+	n := 0
+	for _, ev := range orderHistory(order) {
+		if ev.Action == "refund" {
+			n++
+		}
+	}
+	return fmt.Sprintf("refund-%s-%d-%d", piid, amount, n)
+}
+
+// restockable is what has been ordered less what earlier refunds already put
+// back, so the same item cannot be restocked twice.
+func restockable(order map[string]interface{}) map[string]int64 {
+	left := orderItems(order)
+	for _, ev := range orderHistory(order) {
+		for id, n := range ev.Restock {
+			left[id] -= n
+		}
+	}
+	for id, n := range left {
+		if n <= 0 {
+			delete(left, id)
+		}
+	}
+	return left
+}
+
+// parseRestock reads --restock values, each an item id optionally followed by
+// :quantity. A bare id means one.
+func parseRestock(specs []string) (map[string]int64, error) {
+	restock := map[string]int64{}
+	for _, s := range specs {
+		id, qty, found := strings.Cut(s, ":")
+		n := int64(1)
+		if found {
+			var err error
+			n, err = strconv.ParseInt(qty, 10, 64)
+			if err != nil || n < 1 {
+				return nil, fmt.Errorf("invalid restock quantity in %q", s)
+			}
+		}
+		if id == "" {
+			return nil, fmt.Errorf("missing item id in %q", s)
+		}
+		restock[id] += n
+	}
+	return restock, nil
+}
+
+var refundReasons = map[string]bool{
+	string(stripe.RefundReasonDuplicate):           true,
+	string(stripe.RefundReasonFraudulent):          true,
+	string(stripe.RefundReasonRequestedByCustomer): true,
+}
+
+// refundOrder refunds all or part of the payment for an order, records the
+// refund on the order's history and puts any restocked items back into the
+// catalog. Everything that can be checked is checked before Stripe is called,
+// because once the money has moved there is no undoing it.
+func (s *store) refundOrder(piid string, req refundRequest) (orderEvent, error) {
+	ordersMu.Lock()
+	defer ordersMu.Unlock()
+	order, err := s.readOrder(piid)
+	if err != nil {
+		return orderEvent{}, err
+	}
+	if req.Amount < 0 {
+		return orderEvent{}, errors.New("refund amount cannot be negative")
+	}
+	if req.Reason != "" && !refundReasons[req.Reason] {
+		return orderEvent{}, fmt.Errorf("invalid refund reason %q: use duplicate, fraudulent or requested_by_customer", req.Reason)
+	}
+	left := restockable(order)
+	if req.RestockAll {
+		req.Restock = left
+	}
+	for id, n := range req.Restock {
+		if n < 1 || n > left[id] {
+			return orderEvent{}, fmt.Errorf("cannot restock %d of %s: %d left on the order", n, id, left[id])
+		}
+	}
+
+	params := &stripe.RefundParams{PaymentIntent: stripe.String(piid)}
+	if req.Amount > 0 {
+		params.Amount = stripe.Int64(req.Amount)
+	}
+	if req.Reason != "" {
+		params.Reason = stripe.String(req.Reason)
+	}
+	params.SetIdempotencyKey(refundIdempotencyKey(piid, req.Amount, order))
+	r, err := s.refunds().New(params)
+	if err != nil {
+		return orderEvent{}, err
+	}
+
+	ev := orderEvent{
+		Time:     time.Now().UTC(),
+		Action:   "refund",
+		Amount:   r.Amount,
+		RefundID: r.ID,
+		Reason:   req.Reason,
+		Restock:  req.Restock,
+	}
+	appendHistory(order, ev)
+	if err := s.writeOrder(piid, order); err != nil {
+		return ev, fmt.Errorf("refund %s was made but could not be recorded on the order: %w", r.ID, err)
+	}
+	if err := s.adjustStock(req.Restock, 1); err != nil {
+		return ev, fmt.Errorf("refund %s was made but the items could not be restocked: %w", r.ID, err)
+	}
+	return ev, nil
+}
+
+var ordersCmd = &cobra.Command{
+	Use:   "orders",
+	Short: "manage orders",
+}
+
+var refundFlags struct {
+	amount     int64
+	reason     string
+	restock    []string
+	restockAll bool
+}
+
+var refundCmd = &cobra.Command{
+	Use:   "refund <payment-intent-id>",
+	Short: "refund all or part of an order",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		restock, err := parseRestock(refundFlags.restock)
+		if err != nil {
+			log.Fatal(err)
+		}
+		selectStripeKeys()
+		s, err := storeNamed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		ev, err := s.refundOrder(args[0], refundRequest{
+			Amount:     refundFlags.amount,
+			Reason:     refundFlags.reason,
+			Restock:    restock,
+			RestockAll: refundFlags.restockAll,
+		})
+		if err != nil {
+			log.Fatal("refund failed: ", err)
+		}
+		fmt.Printf("refunded $%.2f of %s as %s\n", float64(ev.Amount)/100, args[0], ev.RefundID)
+		for id, n := range ev.Restock {
+			fmt.Printf("restocked %d x %s\n", n, id)
+		}
+	},
+}
+
+// orderSummary is one order as `orders list` and the csv export show it.
+type orderSummary struct {
+	ID       string
+	Created  time.Time
+	Amount   int64
+	Refunded int64
+	Items    map[string]int64
+}
+
+// summarizeOrder reads the totals off an order's history. Orders written before
+// there was a history have neither, so they fall back to the file's time and
+// the sum of the cart.
+func summarizeOrder(piid string, order map[string]interface{}, modTime time.Time) orderSummary {
+	s := orderSummary{ID: piid, Created: modTime, Items: orderItems(order)}
+	created := false
+	for _, ev := range orderHistory(order) {
+		switch ev.Action {
+		case "created":
+			s.Created, s.Amount, created = ev.Time, ev.Amount, true
+		case "refund":
+			s.Refunded += ev.Amount
+		}
+	}
+	if !created {
+		lines, _ := order["cartItems"].([]interface{}) //nolint:errcheck // a missing cart is an empty one
+		for _, l := range lines {
+			if line, ok := l.(map[string]interface{}); ok {
+				amount, _ := line["amount"].(float64) //nolint:errcheck // a line without one adds nothing
+				s.Amount += int64(amount)
+			}
+		}
+	}
+	return s
+}
+
+// listOrders reads every order in the orders directory, oldest first.
+func (s *store) listOrders() ([]orderSummary, error) {
+	paths, err := filepath.Glob(filepath.Join(s.ordersDir(), "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	var orders []orderSummary
+	for _, path := range paths {
+		piid := strings.TrimSuffix(filepath.Base(path), ".json")
+		order, err := s.readOrder(piid)
+		if err != nil {
+			log.Printf("skipping %s: %v", path, err)
+			continue
+		}
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		orders = append(orders, summarizeOrder(piid, order, fi.ModTime()))
+	}
+	sort.SliceStable(orders, func(i, j int) bool { return orders[i].Created.Before(orders[j].Created) })
+	return orders, nil
+}
+
+// itemList writes an order's items in one column: "VT-8AW8A x2; VT-12CU5 x1".
+// The shipping line is left out, its id being the customer's address.
+func itemList(items map[string]int64) string {
+	var parts []string
+	for id, n := range items {
+		if strings.HasPrefix(id, "shipping-to|") {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s x%d", id, n))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, "; ")
+}
+
+var ordersFormat string
+
+var ordersListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "list orders, oldest first",
+	Args:  cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		s, err := storeNamed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		orders, err := s.listOrders()
+		if err != nil {
+			log.Fatal(err)
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tCREATED\tAMOUNT\tREFUNDED\tITEMS") //nolint:errcheck // stdout
+		for _, o := range orders {
+			fmt.Fprintf(w, "%s\t%s\t$%.2f\t$%.2f\t%s\n", o.ID, o.Created.Local().Format("2006/01/02 15:04"), //nolint:errcheck // stdout
+				float64(o.Amount)/100, float64(o.Refunded)/100, itemList(o.Items))
+		}
+		if err := w.Flush(); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var ordersShowCmd = &cobra.Command{
+	Use:   "show <payment-intent-id>",
+	Short: "print an order with its history",
+	Args:  cobra.ExactArgs(1),
+	Run: func(_ *cobra.Command, args []string) {
+		s, err := storeNamed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		order, err := s.readOrder(args[0])
+		if err != nil {
+			log.Fatal(err)
+		}
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(order); err != nil {
+			log.Fatal(err)
+		}
+	},
+}
+
+var ordersExportCmd = &cobra.Command{
+	Use:   "export",
+	Short: "write every order to stdout: json in full, or csv one row per order",
+	Args:  cobra.NoArgs,
+	Run: func(_ *cobra.Command, _ []string) {
+		s, err := storeNamed()
+		if err != nil {
+			log.Fatal(err)
+		}
+		orders, err := s.listOrders()
+		if err != nil {
+			log.Fatal(err)
+		}
+		switch ordersFormat {
+		case "json":
+			var all []map[string]interface{}
+			for _, o := range orders {
+				order, err := s.readOrder(o.ID)
+				if err != nil {
+					log.Fatal(err)
+				}
+				order["paymentIntentId"] = o.ID
+				all = append(all, order)
+			}
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			err = enc.Encode(all)
+		case "csv":
+			cw := csv.NewWriter(os.Stdout)
+			_ = cw.Write([]string{"id", "created", "amount", "refunded", "items"}) //nolint:errcheck // checked by cw.Error below
+			for _, o := range orders {
+				_ = cw.Write([]string{o.ID, o.Created.UTC().Format(time.RFC3339), //nolint:errcheck // as above
+					strconv.FormatInt(o.Amount, 10), strconv.FormatInt(o.Refunded, 10), itemList(o.Items)})
+			}
+			cw.Flush()
+			err = cw.Error()
+		default:
+			err = fmt.Errorf("unknown format %q: use json or csv", ordersFormat)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+	},
+}
@@ -0,0 +1,161 @@
+//go:build !wasm
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// ── order files ──────────────────────────────────────────────────────────────
+
+// The payment intent id comes from a URL and becomes a file name.
+func TestOrderPathRejectsAnythingButAnID(t *testing.T) {
+	if _, err := defaultStore.orderPath("pi_3Qcu9cCAQwDfFjHh04TXIz1Q"); err != nil {
+		t.Errorf("a real id was rejected: %v", err)
+	}
+	for _, bad := range []string{"", "..", "../server", "pi_1/../../x", "pi 1"} {
+		if _, err := defaultStore.orderPath(bad); err == nil {
+			t.Errorf("%q was accepted as an order id", bad)
+		}
+	}
+}
+
+func TestOrdersRoundTripWithTheirHistory(t *testing.T) {
+	t.Chdir(t.TempDir())
+	order := map[string]interface{}{"cartItems": []interface{}{}}
+	appendHistory(order, orderEvent{Action: "created", Amount: 700})
+	if err := defaultStore.writeOrder("pi_1", order); err != nil {
+		t.Fatal(err)
+	}
+	got, err := defaultStore.readOrder("pi_1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendHistory(got, orderEvent{Action: "refund", Amount: 300})
+	h := orderHistory(got)
+	if len(h) != 2 || h[0].Action != "created" || h[1].Action != "refund" || h[1].Amount != 300 {
+		t.Errorf("history = %+v", h)
+	}
+}
+
+// ── restocking ───────────────────────────────────────────────────────────────
+
+// The order is stored as the browser sent it, numbers and all.
+func testOrder() map[string]interface{} {
+	return map[string]interface{}{
+		"cartItems": []interface{}{
+			map[string]interface{}{"id": "VT-8AW8A", "amount": 1200.0, "quantity": 2.0},
+			map[string]interface{}{"id": "VT-12CU5", "amount": 300.0, "quantity": 1.0},
+			map[string]interface{}{"id": "shipping-to|John Q. Public", "amount": 700.0, "quantity": 1.0},
+		},
+	}
+}
+
+func TestOrderItemsCountsTheCart(t *testing.T) {
+	got := orderItems(testOrder())
+	if got["VT-8AW8A"] != 2 || got["VT-12CU5"] != 1 || len(got) != 3 {
+		t.Errorf("orderItems = %v", got)
+	}
+	if n := len(orderItems(map[string]interface{}{})); n != 0 {
+		t.Errorf("an order with no cart has %d items", n)
+	}
+}
+
+// Whatever an earlier refund put back cannot be put back again.
+func TestRestockableSubtractsEarlierRestocks(t *testing.T) {
+	order := testOrder()
+	appendHistory(order, orderEvent{Action: "refund", Restock: map[string]int64{"VT-8AW8A": 1, "VT-12CU5": 1}})
+	got := restockable(order)
+	if got["VT-8AW8A"] != 1 {
+		t.Errorf("VT-8AW8A restockable = %d, want 1", got["VT-8AW8A"])
+	}
+	if _, ok := got["VT-12CU5"]; ok {
+		t.Error("VT-12CU5 was fully restocked but is still offered")
+	}
+}
+
+func TestParseRestock(t *testing.T) {
+	got, err := parseRestock([]string{"VT-8AW8A", "VT-12CU5:3", "VT-8AW8A:2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got["VT-8AW8A"] != 3 || got["VT-12CU5"] != 3 {
+		t.Errorf("parseRestock = %v", got)
+	}
+	for _, bad := range []string{":1", "VT-1:0", "VT-1:-2", "VT-1:x"} {
+		if _, err := parseRestock([]string{bad}); err == nil {
+			t.Errorf("%q parsed", bad)
+		}
+	}
+}
+
+// Nothing reaches Stripe when the request is wrong on its face: a refund that
+// was made cannot be taken back because the restock turned out to be invalid.
+func TestRefundOrderChecksBeforeCallingStripe(t *testing.T) {
+	t.Chdir(t.TempDir())
+	if err := defaultStore.writeOrder("pi_1", testOrder()); err != nil {
+		t.Fatal(err)
+	}
+	for name, req := range map[string]refundRequest{
+		"negative amount": {Amount: -1},
+		"unknown reason":  {Reason: "changed_my_mind"},
+		"over-restock":    {Restock: map[string]int64{"VT-12CU5": 2}},
+		"not on order":    {Restock: map[string]int64{"VT-NOPE": 1}},
+	} {
+		if _, err := defaultStore.refundOrder("pi_1", req); err == nil {
+			t.Errorf("%s: refund went ahead", name)
+		}
+	}
+	if _, err := defaultStore.refundOrder("pi_missing", refundRequest{}); err == nil {
+		t.Error("a refund of an order that does not exist went ahead")
+	}
+}
+
+// A retried refund is the same refund to Stripe; one asked for after the
+// first was recorded is another.
+func TestRefundIdempotencyKeyFollowsTheHistory(t *testing.T) {
+	order := testOrder()
+	first := refundIdempotencyKey("pi_1", 300, order)
+	if again := refundIdempotencyKey("pi_1", 300, order); again != first {
+		t.Errorf("a retry has key %q, want %q", again, first)
+	}
+	if other := refundIdempotencyKey("pi_1", 400, order); other == first {
+		t.Error("a refund of another amount has the same key")
+	}
+	appendHistory(order, orderEvent{Action: "refund", Amount: 300, RefundID: "re_1"})
+	if next := refundIdempotencyKey("pi_1", 300, order); next == first {
+		t.Error("a second refund of the same amount has the first one's key")
+	}
+}
+
+// ── listing ──────────────────────────────────────────────────────────────────
+
+func TestSummarizeOrderReadsTheHistory(t *testing.T) {
+	order := testOrder()
+	created := time.Date(2025, 1, 2, 13, 34, 14, 0, time.UTC)
+	appendHistory(order, orderEvent{Time: created, Action: "created", Amount: 2200})
+	appendHistory(order, orderEvent{Action: "refund", Amount: 300})
+	appendHistory(order, orderEvent{Action: "refund", Amount: 200})
+	s := summarizeOrder("pi_1", order, time.Now())
+	if !s.Created.Equal(created) || s.Amount != 2200 || s.Refunded != 500 {
+		t.Errorf("summary = %+v", s)
+	}
+}
+
+// Orders from before there was a history still list, with the cart's total.
+func TestSummarizeOrderWithoutAHistory(t *testing.T) {
+	mod := time.Date(2025, 1, 2, 0, 0, 0, 0, time.UTC)
+	s := summarizeOrder("pi_1", testOrder(), mod)
+	if !s.Created.Equal(mod) || s.Amount != 2200 {
+		t.Errorf("summary = %+v, want the file time and 2200", s)
+	}
+}
+
+// The shipping line's id is the customer's name and address.
+func TestItemListLeavesOutTheAddress(t *testing.T) {
+	got := itemList(orderItems(testOrder()))
+	if got != "VT-12CU5 x1; VT-8AW8A x2" {
+		t.Errorf("itemList = %q", got)
+	}
+}
@@ -0,0 +1,43 @@
+// Package pow is the proof of work the server can ask for before it creates
+// a payment intent: a solution that, hashed after the server's challenge,
+// gives a SHA-256 starting with some number of zero bits. Finding one takes
+// about 2^bits hashes, a moment for a shopper's browser and a real cost to a
+// bot creating intents by the thousand; checking one takes a single hash.
+package pow
+
+import (
+	"crypto/sha256"
+	"math/bits"
+	"strconv"
+)
+
+// The headers a solved challenge is sent back in.
+const (
+	ChallengeHeader = "X-PoW-Challenge"
+	SolutionHeader  = "X-PoW-Solution"
+)
+
+// Solve finds a solution to challenge with n zero bits.
+func Solve(challenge string, n int) string {
+	for i := 0; ; i++ {
+		if s := strconv.Itoa(i); Check(challenge, s, n) {
+			return s
+		}
+	}
+}
+
+// Check reports whether solution solves challenge with n zero bits.
+func Check(challenge, solution string, n int) bool {
+	return zeroBits(sha256.Sum256([]byte(challenge+":"+solution))) >= n
+}
+
+func zeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -0,0 +1,12 @@
+//go:build !wasm && !release
+
+package main
+
+import "io/fs"
+
+// prebuilt is what `srv build` wrote to dist, compiled into the binary by a
+// `-tags release` build. This one was built without it, so serve compiles the
+// wasm from source.
+//
+//go:generate go run . build
+var prebuilt fs.FS
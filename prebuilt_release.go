@@ -0,0 +1,22 @@
+//go:build !wasm && release
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// dist is the output of `srv build` (or go generate). It has to be there
+// before a release build: the embed pattern fails the build when it is not.
+//
+//go:embed dist
+var dist embed.FS
+
+var prebuilt = func() fs.FS {
+	sub, err := fs.Sub(dist, "dist")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}()
@@ -0,0 +1,173 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The proxies in front of the server, from TRUSTEDPROXIES, and the headers
+// they name the client in, from CLIENTIPHEADERS, in the order to look.
+var (
+	trustedProxies  []netip.Prefix
+	clientIPHeaders []string
+)
+
+// parseProxies reads TRUSTEDPROXIES: IP addresses and CIDR ranges,
+// comma-separated.
+func parseProxies(list string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+		if strings.Contains(entry, "/") {
+			p, err := netip.ParsePrefix(entry)
+			if err != nil {
+				return nil, fmt.Errorf("TRUSTEDPROXIES: %w", err)
+			}
+			prefixes = append(prefixes, p.Masked())
+			continue
+		}
+		a, err := netip.ParseAddr(entry)
+		if err != nil {
+			return nil, fmt.Errorf("TRUSTEDPROXIES: %w", err)
+		}
+		prefixes = append(prefixes, netip.PrefixFrom(a.Unmap(), a.Unmap().BitLen()))
+	}
+	return prefixes, nil
+}
+
+func initProxies() error {
+	prefixes, err := parseProxies(f.TrustedProxies)
+	if err != nil {
+		return err
+	}
+	trustedProxies, clientIPHeaders = prefixes, nil
+	for _, h := range strings.Split(f.ClientIPHeaders, ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			clientIPHeaders = append(clientIPHeaders, http.CanonicalHeaderKey(h))
+		}
+	}
+	return nil
+}
+
+func trusted(a netip.Addr) bool {
+	for _, p := range trustedProxies {
+		if p.Contains(a) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP is the address a request came from, which the rate limits, the
+// fraud checks and the log go by. It is the peer's address unless the peer
+// is a trusted proxy; then it is read from the first of CLIENTIPHEADERS the
+// request has. A header lists the addresses the request came through, each
+// proxy adding the one it had it from, and only what trusted proxies added
+// is believed: the address is the last in the list that is not a trusted
+// proxy's, since anything before it the client could have written itself. A
+// peer on a unix socket has no address and is the proxy on this host.
+func clientIP(c *gin.Context) string {
+	peer, err := netip.ParseAddrPort(c.Request.RemoteAddr)
+	if err == nil && !trusted(peer.Addr().Unmap()) {
+		return peer.Addr().Unmap().String()
+	}
+	for _, h := range clientIPHeaders {
+		values := c.Request.Header.Values(h)
+		if len(values) == 0 {
+			continue
+		}
+		var hops []string
+		for _, v := range values {
+			if h == "Forwarded" {
+				hops = append(hops, forwardedFor(v)...)
+			} else {
+				hops = append(hops, strings.Split(v, ",")...)
+			}
+		}
+		if a, ok := lastUntrusted(hops); ok {
+			return a.String()
+		}
+	}
+	if err != nil {
+		return c.Request.RemoteAddr
+	}
+	return peer.Addr().Unmap().String()
+}
+
+// overHTTPS reports whether the browser reached the server over https: with
+// this server's own TLS, or through a trusted proxy that ended it and says
+// so in X-Forwarded-Proto or the proto= of Forwarded. Of either header only
+// the nearest proxy's value counts, as the client could have written the
+// rest itself.
+func overHTTPS(c *gin.Context) bool {
+	if c.Request.TLS != nil || f.TLSCert != "" {
+		return true
+	}
+	peer, err := netip.ParseAddrPort(c.Request.RemoteAddr)
+	if err == nil && !trusted(peer.Addr().Unmap()) {
+		return false
+	}
+	proto := ""
+	if v := c.Request.Header.Values("X-Forwarded-Proto"); len(v) > 0 {
+		hops := strings.Split(v[len(v)-1], ",")
+		proto = hops[len(hops)-1]
+	} else if v := c.Request.Header.Values("Forwarded"); len(v) > 0 {
+		elements := strings.Split(v[len(v)-1], ",")
+		for _, pair := range strings.Split(elements[len(elements)-1], ";") {
+			if key, value, _ := strings.Cut(strings.TrimSpace(pair), "="); strings.EqualFold(key, "proto") {
+				proto = strings.Trim(value, `"`)
+			}
+		}
+	}
+	return strings.EqualFold(strings.TrimSpace(proto), "https")
+}
+
+// lastUntrusted walks the hops from the nearest back, stopping at the first
+// that is not a trusted proxy. A hop that is not an address, before that,
+// makes the whole header unbelievable.
+func lastUntrusted(hops []string) (netip.Addr, bool) {
+	var a netip.Addr
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		var err error
+		if a, err = netip.ParseAddr(hop); err != nil {
+			ap, err := netip.ParseAddrPort(hop)
+			if err != nil {
+				return netip.Addr{}, false
+			}
+			a = ap.Addr()
+		}
+		if a = a.Unmap(); !trusted(a) {
+			return a, true
+		}
+	}
+	return a, a.IsValid()
+}
+
+// forwardedFor is the for= of each element of a Forwarded header (RFC 7239),
+// as in for=192.0.2.60;proto=https, for="[2001:db8::17]:4711".
+func forwardedFor(v string) []string {
+	var hops []string
+	for _, element := range strings.Split(v, ",") {
+		hop := ""
+		for _, pair := range strings.Split(element, ";") {
+			key, value, _ := strings.Cut(strings.TrimSpace(pair), "=")
+			if strings.EqualFold(key, "for") {
+				hop = strings.Trim(value, `"`)
+				if strings.HasPrefix(hop, "[") && strings.HasSuffix(hop, "]") {
+					hop = hop[1 : len(hop)-1]
+				}
+			}
+		}
+		hops = append(hops, hop)
+	}
+	return hops
+}
@@ -0,0 +1,136 @@
+//go:build !wasm
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ipOf is clientIP of a request from peer with headers, behind the proxies
+// and headers given.
+func ipOf(t *testing.T, proxies, headerNames, peer string, headers ...string) string {
+	t.Helper()
+	saved := f
+	defer func() { f, trustedProxies, clientIPHeaders = saved, nil, nil }()
+	f.TrustedProxies, f.ClientIPHeaders = proxies, headerNames
+	if err := initProxies(); err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.RemoteAddr = peer
+	for i := 0; i+1 < len(headers); i += 2 {
+		req.Header.Add(headers[i], headers[i+1])
+	}
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = req
+	return clientIP(c)
+}
+
+// ── client IP ────────────────────────────────────────────────────────────────
+
+func TestHeadersAreBelievedOnlyFromTrustedProxies(t *testing.T) {
+	const headers = "X-Forwarded-For,X-Real-IP"
+	for _, tc := range []struct {
+		name, proxies, peer string
+		headers             []string
+		want                string
+	}{
+		{"no proxies", "", "203.0.113.9:5000", []string{"X-Forwarded-For", "198.51.100.1"}, "203.0.113.9"},
+		{"untrusted peer", "10.0.0.0/8", "203.0.113.9:5000", []string{"X-Forwarded-For", "198.51.100.1"}, "203.0.113.9"},
+		{"through a proxy", "10.0.0.0/8", "10.0.0.2:5000", []string{"X-Forwarded-For", "198.51.100.1"}, "198.51.100.1"},
+		// The client wrote the first address itself; the proxy added the
+		// second, which is where the request really came from.
+		{"spoofed", "10.0.0.0/8", "10.0.0.2:5000", []string{"X-Forwarded-For", "1.2.3.4, 198.51.100.1"}, "198.51.100.1"},
+		{"two proxies", "10.0.0.0/8", "10.0.0.2:5000", []string{"X-Forwarded-For", "198.51.100.1, 10.0.0.3"}, "198.51.100.1"},
+		{"repeated header", "10.0.0.0/8", "10.0.0.2:5000", []string{"X-Forwarded-For", "1.2.3.4", "X-Forwarded-For", "198.51.100.1"}, "198.51.100.1"},
+		{"garbage", "10.0.0.0/8", "10.0.0.2:5000", []string{"X-Forwarded-For", "nonsense", "X-Real-IP", "198.51.100.1"}, "198.51.100.1"},
+		{"no header", "10.0.0.0/8", "10.0.0.2:5000", nil, "10.0.0.2"},
+		{"ipv6", "::1", "[::1]:5000", []string{"X-Real-IP", "2001:db8::7"}, "2001:db8::7"},
+		{"mapped", "10.0.0.0/8", "[::ffff:10.0.0.2]:5000", []string{"X-Real-IP", "::ffff:198.51.100.1"}, "198.51.100.1"},
+		{"unix socket", "", "@", []string{"X-Forwarded-For", "198.51.100.1"}, "198.51.100.1"},
+	} {
+		if got := ipOf(t, tc.proxies, headers, tc.peer, tc.headers...); got != tc.want {
+			t.Errorf("%s: %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestOtherHeadersCanBeNamed(t *testing.T) {
+	for _, tc := range []struct {
+		names, header, value, want string
+	}{
+		{"Forwarded", "Forwarded", `for=1.2.3.4, for=198.51.100.1;proto=https;by=10.0.0.2`, "198.51.100.1"},
+		{"Forwarded", "Forwarded", `for="[2001:db8::17]:4711"`, "2001:db8::17"},
+		{"Forwarded", "Forwarded", `for=unknown`, "10.0.0.2"},
+		{"cf-connecting-ip", "CF-Connecting-IP", "198.51.100.1", "198.51.100.1"},
+		// A header not named is not read, however it looks.
+		{"CF-Connecting-IP", "X-Forwarded-For", "198.51.100.1", "10.0.0.2"},
+	} {
+		if got := ipOf(t, "10.0.0.0/8", tc.names, "10.0.0.2:5000", tc.header, tc.value); got != tc.want {
+			t.Errorf("%s: %s: %s, want %s", tc.header, tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestTrustedProxiesMustParse(t *testing.T) {
+	if _, err := parseProxies("10.0.0.0/8, 192.168.1.1,::1"); err != nil {
+		t.Error(err)
+	}
+	for _, bad := range []string{"10.0.0.0/33", "proxy.example.com"} {
+		if _, err := parseProxies(bad); err == nil {
+			t.Errorf("%s parsed", bad)
+		}
+	}
+}
+
+// ── scheme ───────────────────────────────────────────────────────────────────
+
+// The session cookie is Secure behind a proxy that ended TLS, when the proxy
+// is trusted to say so.
+func TestTheSessionCookieIsSecureBehindAnHTTPSProxy(t *testing.T) {
+	saved := f
+	defer func() { f, trustedProxies, clientIPHeaders = saved, nil, nil }()
+	f.TrustedProxies = "10.0.0.0/8"
+	if err := initProxies(); err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name, peer string
+		headers    []string
+		want       bool
+	}{
+		{"plain http", "203.0.113.9:5000", nil, false},
+		{"untrusted peer", "203.0.113.9:5000", []string{"X-Forwarded-Proto", "https"}, false},
+		{"trusted proxy", "10.0.0.2:5000", []string{"X-Forwarded-Proto", "https"}, true},
+		{"proxy on http", "10.0.0.2:5000", []string{"X-Forwarded-Proto", "http"}, false},
+		{"spoofed", "10.0.0.2:5000", []string{"X-Forwarded-Proto", "https, http"}, false},
+		{"forwarded", "10.0.0.2:5000", []string{"Forwarded", "for=198.51.100.1;proto=https"}, true},
+		{"unix socket", "@", []string{"X-Forwarded-Proto", "https"}, true},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/client-config", nil)
+		req.RemoteAddr = tc.peer
+		for i := 0; i+1 < len(tc.headers); i += 2 {
+			req.Header.Add(tc.headers[i], tc.headers[i+1])
+		}
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = req
+		csrfSession(c)
+		cookies := w.Result().Cookies()
+		if len(cookies) != 1 || cookies[0].Secure != tc.want {
+			t.Errorf("%s: cookies %v, want Secure %v", tc.name, cookies, tc.want)
+		}
+	}
+	f.TLSCert = "cert.pem"
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/client-config", nil)
+	csrfSession(c)
+	if cookies := w.Result().Cookies(); len(cookies) != 1 || !cookies[0].Secure {
+		t.Errorf("with TLSCERT the cookie is %v, want Secure", cookies)
+	}
+}
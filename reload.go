@@ -0,0 +1,149 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	htmpl "html/template"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// reloadEvent is one message to the open pages: "reload" when a rebuild
+// succeeded, "builderror" with the report when one failed. The name is not
+// "error", which EventSource already uses for a dropped connection.
+type reloadEvent struct {
+	Name string
+	Data string
+}
+
+var (
+	reloadMu   sync.Mutex
+	reloadSubs = map[chan reloadEvent]bool{}
+)
+
+func subscribeReload() chan reloadEvent {
+	ch := make(chan reloadEvent, 4)
+	reloadMu.Lock()
+	reloadSubs[ch] = true
+	reloadMu.Unlock()
+	return ch
+}
+
+func unsubscribeReload(ch chan reloadEvent) {
+	reloadMu.Lock()
+	delete(reloadSubs, ch)
+	reloadMu.Unlock()
+}
+
+// notifyReload tells every open page what the last rebuild came to. A page
+// too slow to take it misses it rather than holding up the rest.
+func notifyReload() {
+	ev := reloadEvent{Name: "reload"}
+	if msg := buildError(); msg != "" {
+		ev = reloadEvent{Name: "builderror", Data: htmlErrBody(msg)}
+	}
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	for ch := range reloadSubs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// buildError is why the last build of any page or wasm entrypoint failed, or
+// nothing when they all built.
+func buildError() string {
+	var msgs []string
+	for _, files := range [][]FileAsset{htmlFiles, wasmFiles} {
+		for i := range files {
+			files[i].Mu.Lock()
+			if files[i].Err != "" {
+				msgs = append(msgs, files[i].Err)
+			}
+			files[i].Mu.Unlock()
+		}
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// devEvents is the Server-Sent Events stream the pages listen on in dev mode.
+// A page that connects while the build is broken is told so straight away.
+func devEvents(c *gin.Context) {
+	ch := subscribeReload()
+	defer unsubscribeReload(ch)
+	h := c.Writer.Header()
+	h.Set("Server", "")
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	// The stream stays open for as long as the page does, well past
+	// WRITETIMEOUT.
+	_ = http.NewResponseController(c.Writer).SetWriteDeadline(time.Time{}) //nolint:errcheck // a recorder in tests has none to clear
+	c.Writer.WriteHeader(http.StatusOK)
+	if msg := buildError(); msg != "" {
+		writeEvent(c.Writer, reloadEvent{Name: "builderror", Data: htmlErrBody(msg)})
+	}
+	c.Writer.Flush()
+	// A comment now and then keeps an idle connection from being closed
+	// by anything in between.
+	ping := time.NewTicker(25 * time.Second)
+	defer ping.Stop()
+	for {
+		select {
+		case ev := <-ch:
+			writeEvent(c.Writer, ev)
+		case <-ping.C:
+			_, _ = fmt.Fprint(c.Writer, ": ping\n\n") //nolint:errcheck // a gone client shows up as the context ending
+		case <-c.Request.Context().Done():
+			return
+		case <-stopping:
+			return
+		}
+		c.Writer.Flush()
+	}
+}
+
+func writeEvent(w gin.ResponseWriter, ev reloadEvent) {
+	_, _ = fmt.Fprintf(w, "event: %s\n", ev.Name) //nolint:errcheck // a gone client shows up as the context ending
+	for _, line := range strings.Split(ev.Data, "\n") {
+		_, _ = fmt.Fprintf(w, "data: %s\n", line) //nolint:errcheck // as above
+	}
+	_, _ = fmt.Fprint(w, "\n") //nolint:errcheck // as above
+}
+
+// liveReload is the script dev mode adds to every page: reload when a
+// rebuild succeeds, cover the page with the report when one fails, and reload
+// when the server comes back after a restart.
+const liveReload = `(() => {
+  const es = new EventSource('/dev/events');
+  let dropped = false;
+  es.onerror = () => { dropped = true; };
+  es.onopen = () => { if (dropped) location.reload(); };
+  es.addEventListener('reload', () => location.reload());
+  es.addEventListener('builderror', (e) => {
+    let o = document.getElementById('dev-build-error');
+    if (!o) {
+      o = document.createElement('div');
+      o.id = 'dev-build-error';
+      o.style.cssText = 'position: fixed; inset: 0; z-index: 2147483647; overflow: auto; padding: 1em; font-family: monospace; background-color: black; color: white;';
+      document.body.appendChild(o);
+    }
+    o.innerHTML = e.data;
+  });
+})();
+`
+
+// liveReloadScript is liveReload, run with the page's nonce, in dev mode and
+// nothing otherwise.
+func liveReloadScript(nonce string) htmpl.HTML {
+	if !f.Dev {
+		return ""
+	}
+	return htmpl.HTML("<script nonce='" + htmpl.HTMLEscapeString(nonce) + "'>\n" + liveReload + "</script>") //nolint:gosec // a constant, and the escaped nonce
+}
@@ -0,0 +1,58 @@
+//go:build !wasm
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ── live reload ──────────────────────────────────────────────────────────────
+
+func TestNotifyReloadReportsTheBuildState(t *testing.T) {
+	saved := wasmFiles[0].Err
+	defer func() { wasmFiles[0].Err = saved }()
+	ch := subscribeReload()
+	defer unsubscribeReload(ch)
+
+	wasmFiles[0].Err = "checkout_wasm.go:3:1: expected <T>"
+	notifyReload()
+	ev := <-ch
+	if ev.Name != "builderror" || !strings.Contains(ev.Data, "expected &lt;T&gt;") {
+		t.Errorf("got %+v, want the escaped compiler output", ev)
+	}
+
+	wasmFiles[0].Err = ""
+	notifyReload()
+	if ev := <-ch; ev.Name != "reload" {
+		t.Errorf("got %+v after a good build, want reload", ev)
+	}
+}
+
+// A report spans lines, and each line of an event's data needs its own
+// data: field or the rest is read as fields of their own.
+func TestEventsCarryEveryLineOfTheirData(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	writeEvent(c.Writer, reloadEvent{Name: "builderror", Data: "one\ntwo"})
+	if got, want := w.Body.String(), "event: builderror\ndata: one\ndata: two\n\n"; got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+}
+
+func TestTheReloadScriptIsOnlyThereInDevMode(t *testing.T) {
+	saved := f.Dev
+	defer func() { f.Dev = saved }()
+	f.Dev = false
+	if liveReloadScript("") != "" || strings.Contains(string(htmlErr("x", "")), "EventSource") {
+		t.Error("a release page listens for rebuilds")
+	}
+	f.Dev = true
+	if !strings.Contains(string(htmlErr("x", "")), "/dev/events") {
+		t.Error("an error page in dev mode does not reload once it is fixed")
+	}
+}
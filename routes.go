@@ -0,0 +1,94 @@
+//go:build !wasm
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// wasmForRoute is the index into wasmFiles of the entrypoint the page at
+// route loads, or -1 when it loads none.
+func wasmForRoute(route string) int {
+	for i := range wasmFiles {
+		if wasmFiles[i].Cmp && slices.Contains(wasmFiles[i].Routes, route) {
+			return i
+		}
+	}
+	return -1
+}
+
+// applyWasmRoutes replaces the routes in the wasmFiles table with the ones
+// spec lists, as route=entrypoint pairs separated by commas. An entrypoint
+// the table does not have is added to it, compiled with whatever COMPILER
+// says; one that no route names is left out of the build. Nothing changes
+// unless all of spec is good, and an empty spec keeps the table as it is.
+func applyWasmRoutes(spec string) error {
+	if strings.TrimSpace(spec) == "" {
+		return nil
+	}
+	routes := map[string][]string{}
+	var order []string
+	seen := map[string]string{}
+	for _, pair := range strings.Split(spec, ",") {
+		route, name, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		route, name = strings.TrimSpace(route), strings.TrimSpace(name)
+		if !ok || !strings.HasPrefix(route, "/") || name == "" {
+			return fmt.Errorf("WASMROUTES: %q is not route=entrypoint", pair)
+		}
+		if prev, dup := seen[route]; dup {
+			return fmt.Errorf("WASMROUTES: %s is given both %s and %s", route, prev, name)
+		}
+		seen[route] = name
+		if _, ok := routes[name]; !ok {
+			order = append(order, name)
+		}
+		routes[name] = append(routes[name], route)
+	}
+	// Every entrypoint is written out under its base name, so two with the
+	// same one would overwrite each other.
+	out := map[string]string{}
+	for _, name := range order {
+		if prev, dup := out[wasmName(name)]; dup {
+			return fmt.Errorf("WASMROUTES: %s and %s would both be %s", prev, name, wasmName(name))
+		}
+		out[wasmName(name)] = name
+	}
+	for i := range wasmFiles {
+		wasmFiles[i].Routes = routes[wasmFiles[i].Name]
+		wasmFiles[i].Cmp = len(wasmFiles[i].Routes) > 0
+		delete(routes, wasmFiles[i].Name)
+	}
+	for _, name := range order {
+		if r, ok := routes[name]; ok {
+			wasmFiles = append(wasmFiles, FileAsset{Name: name, Cmp: true, Tiny: true, Routes: r})
+		}
+	}
+	return nil
+}
+
+// eachWasm runs fn for every entrypoint that is built, all at once. Each one
+// is its own compiler process, so there is nothing to gain by taking turns.
+func eachWasm(fn func(i int) error) error {
+	var built []int
+	for i := range wasmFiles {
+		if wasmFiles[i].Cmp {
+			built = append(built, i)
+		}
+	}
+	return inParallel(built, fn)
+}
+
+// inParallel runs fn for each of idx at once and waits for them all.
+func inParallel(idx []int, fn func(i int) error) error {
+	errs := make([]error, len(idx))
+	var wg sync.WaitGroup
+	for n, i := range idx {
+		wg.Go(func() { errs[n] = fn(i) })
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
@@ -0,0 +1,104 @@
+//go:build !wasm
+
+package main
+
+import (
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ── routes ───────────────────────────────────────────────────────────────────
+
+// keepWasmTable puts the routes of the wasm table back as they were, and
+// drops any entrypoint a test added to it.
+func keepWasmTable(t *testing.T) {
+	t.Helper()
+	n := len(wasmFiles)
+	routes := make([][]string, n)
+	cmp := make([]bool, n)
+	for i := range n {
+		routes[i], cmp[i] = wasmFiles[i].Routes, wasmFiles[i].Cmp
+	}
+	t.Cleanup(func() {
+		wasmFiles = wasmFiles[:n]
+		for i := range n {
+			wasmFiles[i].Routes, wasmFiles[i].Cmp = routes[i], cmp[i]
+		}
+	})
+}
+
+func TestEachPageLoadsOnlyItsOwnWasm(t *testing.T) {
+	for route, want := range map[string]string{"/": "checkout_wasm.go", "/complete": "complete/complete_wasm.go"} {
+		i := wasmForRoute(route)
+		if i < 0 || wasmFiles[i].Name != want {
+			t.Errorf("%s loads %d, want %s", route, i, want)
+		}
+	}
+	if i := wasmForRoute("/order"); i != -1 {
+		t.Errorf("/order loads %s", wasmFiles[i].Name)
+	}
+}
+
+func TestWasmRoutesReassignAddAndDrop(t *testing.T) {
+	keepWasmTable(t)
+	if err := applyWasmRoutes("/=checkout_wasm.go, /complete=checkout_wasm.go, /gift=gift/gift_wasm.go"); err != nil {
+		t.Fatal(err)
+	}
+	if i := wasmForRoute("/complete"); i < 0 || wasmFiles[i].Name != "checkout_wasm.go" {
+		t.Errorf("/complete loads %d", i)
+	}
+	if i := wasmForRoute("/gift"); i < 0 || wasmFiles[i].Name != "gift/gift_wasm.go" || !wasmFiles[i].Cmp {
+		t.Errorf("/gift was not added: %d", i)
+	}
+	for i := range wasmFiles {
+		if wasmFiles[i].Name == "complete/complete_wasm.go" && wasmFiles[i].Cmp {
+			t.Error("an entrypoint no route names is still built")
+		}
+	}
+}
+
+func TestBadWasmRoutesChangeNothing(t *testing.T) {
+	keepWasmTable(t)
+	n := len(wasmFiles)
+	for spec, want := range map[string]string{
+		"checkout_wasm.go":                           "route=entrypoint",
+		"/=checkout_wasm.go,/=other_wasm.go":         "both",
+		"/=checkout_wasm.go,/x=sub/checkout_wasm.go": "checkout.wasm",
+	} {
+		err := applyWasmRoutes(spec)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: err = %v, want one mentioning %q", spec, err, want)
+		}
+	}
+	if len(wasmFiles) != n || !slices.Equal(wasmFiles[0].Routes, []string{"/"}) {
+		t.Error("a rejected WASMROUTES changed the table")
+	}
+}
+
+// ── parallel builds ──────────────────────────────────────────────────────────
+
+// Each build waits for all the others to have started, which only finishes
+// if they really do run at once.
+func TestEntrypointsBuildAtOnce(t *testing.T) {
+	var started sync.WaitGroup
+	started.Add(3)
+	done := make(chan error)
+	go func() {
+		done <- inParallel([]int{0, 1, 2}, func(int) error {
+			started.Done()
+			started.Wait()
+			return nil
+		})
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the builds ran one after another")
+	}
+}
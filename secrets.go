@@ -0,0 +1,90 @@
+//go:build !wasm
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+// resolveSecrets reads each Stripe secret key from its file setting, when one
+// is given, and refuses a live secret key given as a flag: anything on the
+// command line is there for every user of the machine to read with ps. The
+// SMTP password has no flag at all, only SMTPPASSWORD and its file.
+func resolveSecrets(cmd *cobra.Command) error {
+	var errs []error
+	cmd.Flags().Visit(func(fl *pflag.Flag) {
+		if liveSecret.MatchString(fl.Value.String()) {
+			errs = append(errs, fmt.Errorf("--%s: a live secret key cannot be passed on the command line; set %s or %sFILE instead",
+				fl.Name, strings.ToUpper(fl.Name), strings.ToUpper(fl.Name)))
+		}
+	})
+	f.SMTPPassword = configString("SMTPPASSWORD", "")
+	for _, s := range []struct {
+		name string
+		key  *string
+		file string
+	}{
+		{"STRIPELIVESKFILE", &f.StripeliveSK, f.StripeliveSKFile},
+		{"STRIPETESTSKFILE", &f.StripetestSK, f.StripetestSKFile},
+		{"SMTPPASSWORDFILE", &f.SMTPPassword, f.SMTPPasswordFile},
+	} {
+		if s.file == "" {
+			continue
+		}
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.name, err))
+			continue
+		}
+		*s.key = strings.TrimSpace(string(data))
+	}
+	return errors.Join(errs...)
+}
+
+var liveSecret = regexp.MustCompile(`\b[sr]k_live_`)
+
+// redactions are applied, in order, to everything written to the log. Keys
+// keep their prefix so the log still says what kind of key was there.
+var redactions = []struct {
+	re   *regexp.Regexp
+	with string
+}{
+	{regexp.MustCompile(`\b(sk|pk|rk)_(live|test)_[A-Za-z0-9]+`), "${1}_${2}_[REDACTED]"},
+	{regexp.MustCompile(`\bwhsec_[A-Za-z0-9]+`), "whsec_[REDACTED]"},
+	{regexp.MustCompile(`\b(pi|seti)_[A-Za-z0-9]+_secret_[A-Za-z0-9]+`), "${1}_[REDACTED]"},
+	{regexp.MustCompile(`(?i)("?client_?secret"?\s*[:=]\s*"?)[^"\s&,}]+`), "${1}[REDACTED]"},
+	// The cart's shipping line is name|address|city|state|zip|country|phone.
+	{regexp.MustCompile(`shipping-to(\|[^|"\n]*){6}\|[^|"\s\]]*`), "shipping-to|[REDACTED]"},
+	{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[REDACTED]"},
+}
+
+func redact(s string) string {
+	for _, r := range redactions {
+		s = r.re.ReplaceAllString(s, r.with)
+	}
+	return s
+}
+
+// redactor masks secrets and customer details in whatever passes through it
+// on the way to the log. Every write is one log line, or one formatted
+// request line, so nothing is split across writes.
+type redactor struct{ w io.Writer }
+
+func (r redactor) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(r.w, redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// logOut is where request lines and other direct log output go, through the
+// same redaction as the log package.
+var logOut io.Writer = redactor{os.Stdout}
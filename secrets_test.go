@@ -0,0 +1,107 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// ── redaction ────────────────────────────────────────────────────────────────
+
+func TestRedactMasksKeysAndClientSecrets(t *testing.T) {
+	for in, want := range map[string]string{
+		"key sk_live_51HxyzABC done":                 "key sk_live_[REDACTED] done",
+		"pk_test_51Habc":                             "pk_test_[REDACTED]",
+		"rk_live_abc":                                "rk_live_[REDACTED]",
+		"whsec_abc123":                               "whsec_[REDACTED]",
+		"pi_3Qcu9c_secret_XYZ":                       "pi_[REDACTED]",
+		`{"clientSecret":"opaque"}`:                  `{"clientSecret":"[REDACTED]"}`,
+		"?payment_intent_client_secret=abc&x=1":      "?payment_intent_client_secret=[REDACTED]&x=1",
+		"created pi_3Qcu9cCAQwDfFjHh04TXIz1Q for 3":  "created pi_3Qcu9cCAQwDfFjHh04TXIz1Q for 3",
+		"mail jane.doe+shop@example.com now":         "mail [REDACTED] now",
+		"GET /order/pi_3Qcu9cCAQwDfFjHh04TXIz1Q 200": "GET /order/pi_3Qcu9cCAQwDfFjHh04TXIz1Q 200",
+	} {
+		if got := redact(in); got != want {
+			t.Errorf("redact(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+// The README's own log shows the shipping line going by in full — name,
+// street and phone number.
+func TestRedactMasksTheShippingLine(t *testing.T) {
+	in := `{"id":"shipping-to|John Q. Public|123 Skidoo Street|Philadelphia|PA|19129|United States|4696854921 X 1","amount":700}`
+	got := redact(in)
+	for _, pii := range []string{"John", "Skidoo", "Philadelphia", "19129", "4696854921"} {
+		if strings.Contains(got, pii) {
+			t.Errorf("%q survived: %s", pii, got)
+		}
+	}
+	if !strings.Contains(got, `"amount":700`) {
+		t.Errorf("redaction ate what followed the line: %s", got)
+	}
+}
+
+func TestRedactorPassesTheLengthThrough(t *testing.T) {
+	var buf bytes.Buffer
+	in := []byte("sk_test_abcdef\n")
+	n, err := redactor{&buf}.Write(in)
+	if err != nil || n != len(in) {
+		t.Errorf("Write = %d, %v; want %d, nil — the log package treats a short write as an error", n, err, len(in))
+	}
+	if strings.Contains(buf.String(), "abcdef") {
+		t.Errorf("wrote %q", buf.String())
+	}
+}
+
+// ── secret keys ──────────────────────────────────────────────────────────────
+
+func secretsCmd(t *testing.T, args ...string) *cobra.Command {
+	t.Helper()
+	cmd := &cobra.Command{}
+	cmd.Flags().StringVar(&f.StripeliveSK, "stripelivesk", "", "")
+	cmd.Flags().StringVar(&f.StripetestSK, "stripetestsk", "", "")
+	if err := cmd.ParseFlags(args); err != nil {
+		t.Fatal(err)
+	}
+	return cmd
+}
+
+func TestALiveKeyOnTheCommandLineIsRefused(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	err := resolveSecrets(secretsCmd(t, "--stripelivesk", "sk_live_123"))
+	if err == nil || !strings.Contains(err.Error(), "--stripelivesk") {
+		t.Errorf("err = %v, want a refusal naming --stripelivesk", err)
+	}
+	// Test keys move no money, so they are allowed.
+	if err := resolveSecrets(secretsCmd(t, "--stripetestsk", "sk_test_123")); err != nil {
+		t.Errorf("a test key was refused: %v", err)
+	}
+}
+
+func TestSecretKeysComeFromTheirFiles(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	path := filepath.Join(t.TempDir(), "sk")
+	if err := os.WriteFile(path, []byte("sk_live_fromfile\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	f.StripeliveSKFile = path
+	if err := resolveSecrets(secretsCmd(t)); err != nil {
+		t.Fatal(err)
+	}
+	if f.StripeliveSK != "sk_live_fromfile" {
+		t.Errorf("StripeliveSK = %q, want the file's contents without the newline", f.StripeliveSK)
+	}
+	f.StripetestSKFile = filepath.Join(t.TempDir(), "missing")
+	if err := resolveSecrets(secretsCmd(t)); err == nil || !strings.Contains(err.Error(), "STRIPETESTSKFILE") {
+		t.Errorf("err = %v, want one naming STRIPETESTSKFILE", err)
+	}
+}
@@ -3,62 +3,53 @@
 package main
 
 import (
-	"bytes"
-	_ "embed"
-	"encoding/base64"
-	"encoding/json"
+	"context"
+	"crypto/subtle"
 	"os/exec"
+	"os/signal"
 	"reflect"
+	"syscall"
 
+	"errors"
 	"fmt"
+	"html"
 	htmpl "html/template"
-	"io"
+	"io/fs"
 	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"path/filepath"
 	"runtime"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/0magnet/cart/clientconfig"
 	"github.com/bitfield/script"
 	"github.com/gin-gonic/gin"
 	cc "github.com/ivanpirog/coloredcobra"
 	"github.com/spf13/cobra"
 	"github.com/stripe/stripe-go/v80"
-	"github.com/stripe/stripe-go/v80/paymentintent"
 )
 
 const KB = 1024
 const MB = 1024 * KB
 
-//go:embed index.html
-var indexHTML []byte
-
-//go:embed complete.html
-var completeHTML []byte
-
-//go:embed checkout.css
-var checkoutCSS []byte
-
 var menvfile = os.Getenv("MENV")
 
 type FileAsset struct {
-	Name  string     //file name
-	Data  []byte     // file contents or compiled data
-	Mod   time.Time  //modification time of source file
-	Built time.Time  //built time or time source file was read
-	Mu    sync.Mutex //read / write lock
-	Cmp   bool       // should compile the file
-	Tiny  bool       // should compile with tinygo
-}
-
-var htmlFiles = []FileAsset{
-	{Name: "index.html", Data: indexHTML, Built: time.Now()},
-	{Name: "complete.html", Data: completeHTML, Built: time.Now()},
-	{Name: "public/checkout.css", Data: checkoutCSS, Built: time.Now()},
+	Name     string     //file name
+	Data     []byte     // file contents or compiled data
+	Mod      time.Time  //modification time of source file
+	Built    time.Time  //built time or time source file was read
+	Mu       sync.Mutex //read / write lock
+	Cmp      bool       // should compile the file
+	Tiny     bool       // should compile with tinygo
+	URL      string     // where the last good build is served, under /assets
+	Err      string     // why the last build failed; empty after a good one
+	Routes   []string   // the pages that load it, for a wasm entrypoint
+	Theme    string     // its name within the theme, for a theme file
+	ThemeTag string     // the themeTag of the stores it is a theme file of
 }
 
 // goroot locates the Go installation whose wasm_exec.js should be served.
@@ -79,14 +70,18 @@ func goroot() string {
 	return runtime.GOROOT() //nolint:staticcheck // the fallback when no go is installed
 }
 
+// jsFiles are the wasm_exec.js of Go and of TinyGo, in that order. Where each
+// is found depends on what is installed, so selectCompilers fills them in.
 var jsFiles = []FileAsset{
-	{Name: filepath.Join(goroot(), "misc", "wasm", "wasm_exec.js")},
-	{Name: strings.TrimSuffix(goroot(), "go") + "tinygo" + "/targets/wasm_exec.js"},
+	{Name: "wasm_exec.js"},
+	{Name: "wasm_exec_tinygo.js"},
 }
 
+// wasmFiles are the wasm entrypoints and the pages each one is loaded by.
+// WASMROUTES can change which page loads which.
 var wasmFiles = []FileAsset{
-	{Name: "checkout_wasm.go", Cmp: true, Tiny: true},
-	// {Name: "complete_wasm.go", Cmp: true, Tiny: true},
+	{Name: "checkout_wasm.go", Cmp: true, Tiny: true, Routes: []string{"/"}},
+	{Name: "complete/complete_wasm.go", Cmp: true, Tiny: true, Routes: []string{"/complete"}},
 }
 
 func readFile(files []FileAsset, i int) (ret []byte) {
@@ -98,24 +93,90 @@ func readFile(files []FileAsset, i int) (ret []byte) {
 	return ret
 }
 
+// readURL is the /assets URL of the last good build of files[i], or nothing
+// when there has not been one.
+func readURL(files []FileAsset, i int) (ret string) {
+	if i <= len(files)-1 && i >= 0 {
+		files[i].Mu.Lock()
+		ret = files[i].URL
+		files[i].Mu.Unlock()
+	}
+	return ret
+}
+
 type item struct {
-	Id     string
-	Amount int64
-	Qty    int64
+	Id     string `json:"id"`
+	Amount int64  `json:"amount"`
+	Qty    int64  `json:"quantity"`
 }
 
 type FlagVars struct {
-	Teststripekey bool
-	WebPort       int
-	StripelivePK  string
-	StripeliveSK  string
-	StripetestPK  string
-	StripetestSK  string
-	StripeSK      string
-	StripePK      string
+	Teststripekey     bool
+	WebPort           int
+	StripelivePK      string
+	StripeliveSK      string
+	StripetestPK      string
+	StripetestSK      string
+	StripeSK          string
+	StripePK          string
+	AdminToken        string
+	StripeliveSKFile  string
+	StripetestSKFile  string
+	Catalog           string
+	OrdersDir         string
+	OutDir            string
+	Dev               bool
+	WasmRoutes        string
+	Currency          string
+	APIBase           string
+	Features          string
+	Compiler          string
+	CacheDir          string
+	Theme             string
+	ExportDir         string
+	APIOnly           bool
+	CORSOrigins       string
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	WriteTimeout      time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+	ShutdownTimeout   time.Duration
+	TLSCert           string
+	TLSKey            string
+	RedirectPort      int
+	HSTSMaxAge        time.Duration
+	Listen            string
+	CSPReportOnly     bool
+	CSRFKey           string
+	IntentsPerIP      int
+	IntentsPerSession int
+	IntentWindow      time.Duration
+	FailedPayments    int
+	PoWBits           int
+	Blocklist         string
+	TrustedProxies    string
+	ClientIPHeaders   string
+	LogFormat         string
+	LogLevel          string
+	MetricsToken      string
+	MaxItems          int
+	MaxQuantity       int
+	Stores            string
+	Store             string
+	SMTPAddr          string
+	SMTPUser          string
+	SMTPPassword      string
+	SMTPPasswordFile  string
+	EmailFrom         string
+	EmailTo           string
 }
 
-var f = FlagVars{}
+var f = FlagVars{Catalog: "catalog.json", OrdersDir: "orders", OutDir: "dist", Currency: "usd", Compiler: "tinygo", CacheDir: ".wasmcache", Theme: "theme", ExportDir: "site",
+	ReadHeaderTimeout: 10 * time.Second, ReadTimeout: 30 * time.Second, WriteTimeout: time.Minute, IdleTimeout: 2 * time.Minute,
+	MaxHeaderBytes: 64 * KB, ShutdownTimeout: 30 * time.Second,
+	IntentsPerIP: 20, IntentsPerSession: 10, IntentWindow: time.Hour, FailedPayments: 5, ClientIPHeaders: "X-Forwarded-For,X-Real-IP",
+	LogFormat: "text", LogLevel: "info", MaxItems: 50, MaxQuantity: 100}
 
 var (
 	// Hardcoded array of valid shorthand characters, excluding "h"
@@ -137,22 +198,16 @@ var a = true
 var b = false
 
 func addStringFlag(cmd *cobra.Command, f interface{}, fieldPtr *string, description string) {
-	cmd.Flags().StringVarP(fieldPtr, ccc(fieldPtr, f, b), getNextShortFlag(), scriptExecString(fmt.Sprintf("${%s%s}", ccc(fieldPtr, f, a), func(s string) string {
-		if s != "" {
-			s = "-" + s
-		}
-		return s
-	}(*fieldPtr))), fmt.Sprintf("%s env: %s\033[0m\n\r", description, ccc(fieldPtr, f, a)))
+	cmd.Flags().StringVarP(fieldPtr, ccc(fieldPtr, f, b), getNextShortFlag(), configString(ccc(fieldPtr, f, a), *fieldPtr), fmt.Sprintf("%s env: %s\033[0m\n\r", description, ccc(fieldPtr, f, a)))
 }
 func addBoolFlag(cmd *cobra.Command, f interface{}, fieldPtr *bool, description string) {
-	cmd.Flags().BoolVarP(fieldPtr, ccc(fieldPtr, f, b), getNextShortFlag(), scriptExecBool(fmt.Sprintf("${%s%s}", ccc(fieldPtr, f, a), func(b bool) string {
-		return "-" + strconv.FormatBool(b)
-	}(*fieldPtr))), fmt.Sprintf("%s env: %s\033[0m\n\r", description, ccc(fieldPtr, f, a)))
+	cmd.Flags().BoolVarP(fieldPtr, ccc(fieldPtr, f, b), getNextShortFlag(), configBool(ccc(fieldPtr, f, a), *fieldPtr), fmt.Sprintf("%s env: %s\033[0m\n\r", description, ccc(fieldPtr, f, a)))
 }
 func addIntFlag(cmd *cobra.Command, f interface{}, fieldPtr *int, description string) {
-	cmd.Flags().IntVarP(fieldPtr, ccc(fieldPtr, f, b), getNextShortFlag(), scriptExecInt(fmt.Sprintf("${%s%s}", ccc(fieldPtr, f, a), func(i int) string {
-		return fmt.Sprintf("-%d", i)
-	}(*fieldPtr))), fmt.Sprintf("%s env: %s\033[0m\n\r", description, ccc(fieldPtr, f, a)))
+	cmd.Flags().IntVarP(fieldPtr, ccc(fieldPtr, f, b), getNextShortFlag(), configInt(ccc(fieldPtr, f, a), *fieldPtr), fmt.Sprintf("%s env: %s\033[0m\n\r", description, ccc(fieldPtr, f, a)))
+}
+func addDurationFlag(cmd *cobra.Command, f interface{}, fieldPtr *time.Duration, description string) {
+	cmd.Flags().DurationVarP(fieldPtr, ccc(fieldPtr, f, b), getNextShortFlag(), configDuration(ccc(fieldPtr, f, a), *fieldPtr), fmt.Sprintf("%s env: %s\033[0m\n\r", description, ccc(fieldPtr, f, a)))
 }
 
 // change case
@@ -176,29 +231,26 @@ func ccc(val interface{}, strct interface{}, upper bool) string {
 	return ""
 }
 
-func init() {
-	stripe.EnableTelemetry = false
-	runCmd.Flags().SortFlags = false
-	runCmd.SetUsageTemplate(help)
-	addBoolFlag(runCmd, &f, &f.Teststripekey, "use stripe test api keys instead of live key")
-	addStringFlag(runCmd, &f, &f.StripeliveSK, "stripe live api sk")
-	addStringFlag(runCmd, &f, &f.StripelivePK, "stripe live api pk")
-	addStringFlag(runCmd, &f, &f.StripetestSK, "stripe test api sk")
-	addStringFlag(runCmd, &f, &f.StripetestPK, "stripe test api pk")
-	addIntFlag(runCmd, &f, &f.WebPort, "port to serve on")
-}
 func main() {
-	_, err = script.Exec(`go help`).Bytes()
-	if err != nil {
+	Execute()
+}
+
+// requireGo stops a command that compiles wasm before it gets anywhere when
+// there is no Go toolchain to compile it with. The commands that only read
+// and write orders and the catalog run without one.
+func requireGo() {
+	if _, err := script.Exec(`go help`).Bytes(); err != nil {
 		log.Fatal("error on golang invocation: ", err)
 	}
-	Execute()
 }
 
 // Execute executes root CLI command.
 func Execute() {
+	log.SetOutput(redactor{os.Stderr})
+	gin.DefaultWriter = logOut
+	gin.DefaultErrorWriter = redactor{os.Stderr}
 	cc.Init(&cc.Config{
-		RootCmd:         runCmd,
+		RootCmd:         rootCmd,
 		Headings:        cc.HiBlue + cc.Bold,
 		Commands:        cc.HiBlue + cc.Bold,
 		CmdShortDescr:   cc.HiBlue,
@@ -209,118 +261,137 @@ func Execute() {
 		NoExtraNewlines: true,
 		NoBottomNewline: true,
 	})
-	if err := runCmd.Execute(); err != nil {
+	if err := rootCmd.Execute(); err != nil {
 		log.Fatal("Failed to execute command: ", err)
 	}
 }
 
-var tmpl *htmpl.Template
-var err error
-var ldFlags string
-var runCmd = &cobra.Command{
-	Use:   "srv",
-	Short: "stripe test server for webassembly",
+// selectStripeKeys picks the live or the test key pair, hands the secret key
+// to the Stripe client and keeps the publishable key for the client config.
+func selectStripeKeys() {
+	f.StripeSK = f.StripeliveSK
+	f.StripePK = f.StripelivePK
+	if f.Teststripekey {
+		f.StripeSK = f.StripetestSK
+		f.StripePK = f.StripetestPK
+	}
+	stripe.Key = f.StripeSK
+}
+
+// clientConfig is what the wasm is told at runtime instead of having it
+// compiled in: the store's own publishable key and currency among it.
+func (s *store) clientConfig() clientconfig.Config {
+	features := map[string]bool{}
+	for _, name := range strings.Split(f.Features, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			features[name] = true
+		}
+	}
+	_, pk := s.stripeKeys()
+	return clientconfig.Config{
+		PublishableKey: pk,
+		Currency:       s.currency(),
+		APIBase:        strings.TrimSuffix(f.APIBase, "/"),
+		Features:       features,
+	}
+}
+
+var serveCmd = &cobra.Command{
+	Use:   "serve",
+	Short: "run the storefront server",
+	// Whatever config check would report stops the server before it starts,
+	// rather than turning up in the first request it breaks. Checking loads
+	// the stores, their guards, the themes and the wasm routes, and the
+	// server goes on with what it loaded rather than loading it again.
+	PreRunE: func(_ *cobra.Command, _ []string) error {
+		// The log is set up first, so what loading the themes logs is in its
+		// format; a LOGFORMAT or LOGLEVEL it cannot take is reported below.
+		_ = initLogging() //nolint:errcheck // checkConfig reports it
+		selectStripeKeys()
+		if errs := checkConfig(); len(errs) > 0 {
+			return fmt.Errorf("bad configuration:\n%w", errors.Join(errs...))
+		}
+		return nil
+	},
 	Run: func(_ *cobra.Command, _ []string) {
-		f.StripeSK = f.StripeliveSK
-		f.StripePK = f.StripelivePK
-		if f.Teststripekey {
-			f.StripeSK = f.StripetestSK
-			f.StripePK = f.StripetestPK
+		if !f.APIOnly {
+			prepareWasm()
+		}
+		if err := initProxies(); err != nil {
+			log.Fatal(err)
 		}
-		stripe.Key = f.StripeSK
-		ldFlags = `-ldflags="-X 'main.stripePK=` + f.StripePK + `'"`
 		r1 := gin.New()
+		// clientIP reads the proxy headers; gin is told to believe none,
+		// so that c.ClientIP() cannot be fooled by them either.
+		if err := r1.SetTrustedProxies(nil); err != nil {
+			log.Fatal(err)
+		}
+		r1.Use(requestIDMiddleware())
 		r1.Use(gin.Recovery())
 		r1.Use(loggingMiddleware())
-		r1.GET("/", func(c *gin.Context) {
-			var h htmlTemplateData
-			c.Writer.Header().Set("Server", "")
-			c.Writer.Header().Set("Content-Type", "text/html;charset=utf-8")
-			c.Writer.Header().Set("Transfer-Encoding", "chunked")
-			c.Writer.WriteHeader(http.StatusOK)
-			c.Writer.Flush()
-
-			tmpl, err = htmpl.New("index").Parse(string(readFile(htmlFiles, 0)))
-			if err != nil {
-				msg := fmt.Sprintf("Error parsing html template indexHTML:\n%s\n%v\n", readFile(htmlFiles, 0), err)
-				log.Println(msg)
-				_, _ = c.Writer.Write(htmlErr(msg)) //nolint:errcheck // the response is the error report; a failed write has nowhere to go
-				c.Writer.Flush()
-				return
-			}
+		r1.Use(metricsMiddleware())
+		if f.TLSCert != "" && f.HSTSMaxAge > 0 {
+			r1.Use(hstsMiddleware(f.HSTSMaxAge))
+		}
+		if f.CORSOrigins != "" {
+			r1.Use(corsMiddleware(corsOrigins(f.CORSOrigins)))
+		}
+		r1.GET("/healthz", healthz)
+		r1.GET("/readyz", readyz)
+		if !f.APIOnly {
+			r1.GET("/", pageHandler("/", "index", func(s *store, h *htmlTemplateData) error {
+				products, err := s.loadCatalog()
+				if err != nil {
+					return fmt.Errorf("could not load the catalog: %w", err)
+				}
+				h.Categories = categories(products)
+				return nil
+			}))
+			r1.GET("/complete", pageHandler("/complete", "complete", nil))
+			r1.GET("/p/:id", func(c *gin.Context) {
+				products, err := storeFor(c).loadCatalog()
+				p, ok := productByID(products, c.Param("id"))
+				if err == nil && !ok {
+					c.Writer.Header().Set("Server", "")
+					c.Status(http.StatusNotFound)
+					return
+				}
+				pageHandler("/p/:id", "product", func(_ *store, h *htmlTemplateData) error {
+					if err != nil {
+						return fmt.Errorf("could not load the catalog: %w", err)
+					}
+					h.Title, h.Product = p.Name, p
+					return nil
+				})(c)
+			})
 
-			h.WasmExecJs = htmpl.JS(readFile(jsFiles, 0)) //nolint:gosec // wasm_exec.js, read from the Go installation at startup — not request data
-			wasmFile := 0
-			if wasmFiles[wasmFile].Tiny {
-				h.WasmExecJs = htmpl.JS(readFile(jsFiles, 1)) //nolint:gosec // as above, the tinygo variant
+			r1.GET("/assets/:name", serveAsset)
+			r1.HEAD("/assets/:name", serveAsset)
+			r1.POST(cspReportPath, cspReport)
+			if f.Dev {
+				r1.GET("/dev/events", devEvents)
 			}
+		}
 
-			h.WasmBase64 = base64.StdEncoding.EncodeToString(readFile(wasmFiles, wasmFile))
-			tmplData := map[string]interface{}{
-				"Page": h,
-			}
-			var result bytes.Buffer
-			err = tmpl.Execute(&result, tmplData)
-			if err != nil {
-				msg := fmt.Sprintf("Could not execute html template %v\n", err)
-				log.Println(msg)
-				_, _ = c.Writer.Write(htmlErr(msg)) //nolint:errcheck // the response is the error report; a failed write has nowhere to go
-				c.Writer.Flush()
-				return
-			}
-			_, _ = c.Writer.Write(result.Bytes()) //nolint:errcheck // as above: the client has gone
-			c.Writer.Flush()
+		r1.GET("/client-config", func(c *gin.Context) {
+			c.Writer.Header().Set("Server", "")
+			c.Writer.Header().Set("Cache-Control", "no-store")
+			cfg := storeFor(c).clientConfig()
+			cfg.CSRFToken = csrfSession(c)
+			c.JSON(http.StatusOK, cfg)
 		})
 
-		r1.GET("/complete", func(c *gin.Context) {
-			var h htmlTemplateData
+		r1.GET("/order/:piid", func(c *gin.Context) {
 			c.Writer.Header().Set("Server", "")
-			c.Writer.Header().Set("Content-Type", "text/html;charset=utf-8")
+			c.Writer.Header().Set("Content-Type", "application/json;charset=utf-8")
 			c.Writer.Header().Set("Transfer-Encoding", "chunked")
-			c.Writer.WriteHeader(http.StatusOK)
-			c.Writer.Flush()
-
-			tmpl, err = htmpl.New("index").Parse(string(readFile(htmlFiles, 1)))
-			if err != nil {
-				msg := fmt.Sprintf("Error parsing html template indexHTML:\n%s\n%v\n", readFile(htmlFiles, 1), err)
-				log.Println(msg)
-				_, _ = c.Writer.Write(htmlErr(msg)) //nolint:errcheck // the response is the error report; a failed write has nowhere to go
-				c.Writer.Flush()
-				return
-			}
-
-			h.Css = htmpl.CSS(readFile(htmlFiles, 2)) //nolint:gosec // checkout.css, compiled into this binary by go:embed
-			h.CssName = "checkout.css"
-
-			h.WasmExecJs = htmpl.JS(readFile(jsFiles, 0)) //nolint:gosec // wasm_exec.js, read from the Go installation at startup — not request data
-			wasmFile := 0
-			if wasmFiles[wasmFile].Tiny {
-				h.WasmExecJs = htmpl.JS(readFile(jsFiles, 1)) //nolint:gosec // as above, the tinygo variant
-			}
-
-			h.WasmBase64 = base64.StdEncoding.EncodeToString(readFile(wasmFiles, wasmFile))
-			tmplData := map[string]interface{}{
-				"Page": h,
-			}
-			var result bytes.Buffer
-			err = tmpl.Execute(&result, tmplData)
+			path, err := storeFor(c).orderPath(c.Param("piid"))
 			if err != nil {
-				msg := fmt.Sprintf("Could not execute html template %v\n", err)
-				log.Println(msg)
-				_, _ = c.Writer.Write(htmlErr(msg)) //nolint:errcheck // the response is the error report; a failed write has nowhere to go
+				c.Writer.WriteHeader(http.StatusNotFound)
 				c.Writer.Flush()
 				return
 			}
-			_, _ = c.Writer.Write(result.Bytes()) //nolint:errcheck // as above: the client has gone
-			c.Writer.Flush()
-		})
-
-		r1.GET("/order/:piid", func(c *gin.Context) {
-			c.Writer.Header().Set("Server", "")
-			c.Writer.Header().Set("Content-Type", "application/json;charset=utf-8")
-			c.Writer.Header().Set("Transfer-Encoding", "chunked")
-			piid := c.Param("piid")
-			order, err := script.File("orders/" + piid + ".json").Bytes()
+			order, err := script.File(path).Bytes()
 			if err != nil {
 				c.Writer.WriteHeader(http.StatusNotFound)
 				c.Writer.Flush()
@@ -332,21 +403,15 @@ var runCmd = &cobra.Command{
 			c.Writer.Flush()
 		})
 
-		r1.POST("/create-payment-intent", func(c *gin.Context) {
-			rawBody, err := c.GetRawData()
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read request body"})
-				log.Printf("Failed to read raw request body: %v", err)
-				return
-			}
-			log.Printf("Raw request body: %s", string(rawBody))
-			c.Request.Body = io.NopCloser(bytes.NewBuffer(rawBody))
-			var req struct {
-				Items []item `json:"items"`
-			}
-			if err := c.ShouldBindJSON(&req); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-				log.Printf("Failed to bind JSON: %v", err)
+		initCSRFKey()
+		protect := csrfProtect(corsOrigins(f.CORSOrigins))
+		// Each store's Stripe account has a guard of its own, as only that
+		// account can say what became of the intents made with it.
+		guard := func(c *gin.Context) { storeFor(c).guard.check(c) }
+		r1.POST("/create-payment-intent", limitBody(intentBodyLimit), protect, guard, func(c *gin.Context) {
+			s := storeFor(c)
+			var req paymentIntentRequest
+			if !bindStrict(c, &req) {
 				return
 			}
 			total := int64(0)
@@ -355,18 +420,21 @@ var runCmd = &cobra.Command{
 			}
 			params := &stripe.PaymentIntentParams{
 				Amount:   stripe.Int64(total),
-				Currency: stripe.String(string(stripe.CurrencyUSD)),
+				Currency: stripe.String(s.currency()),
 				//						        AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
 				//						            Enabled: stripe.Bool(false),
 				//						        },
 			}
-			pi, err := paymentintent.New(params)
+			pi, err := s.intents().New(params)
 			if err != nil {
-				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-				log.Printf("Failed to create PaymentIntent: %v", err)
+				paymentIntents.inc("failed")
+				c.JSON(http.StatusInternalServerError, errorBody(c, err.Error()))
+				slog.ErrorContext(c.Request.Context(), "Failed to create PaymentIntent", "err", err)
 				return
 			}
-			log.Printf("Created PaymentIntent with ClientSecret: %v", pi.ClientSecret)
+			paymentIntents.inc("created")
+			slog.InfoContext(c.Request.Context(), "Created PaymentIntent", "payment_intent", pi.ID, "items", len(req.Items), "amount", total)
+			s.guard.created(c, pi.ID)
 			c.JSON(http.StatusOK, struct {
 				ClientSecret   string `json:"clientSecret"`
 				DpmCheckerLink string `json:"dpmCheckerLink"`
@@ -376,113 +444,218 @@ var runCmd = &cobra.Command{
 			})
 		})
 
-		r1.POST("/submit-order", func(c *gin.Context) {
-			var requestData struct {
-				LocalStorageData map[string]interface{} `json:"localStorageData"`
-				PaymentIntentId  string                 `json:"paymentIntentId"`
-			}
-
-			if err := c.ShouldBindJSON(&requestData); err != nil {
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request data"})
+		r1.POST("/submit-order", limitBody(orderBodyLimit), protect, func(c *gin.Context) {
+			s := storeFor(c)
+			var requestData orderRequest
+			if !bindStrict(c, &requestData) {
 				return
 			}
 
-			log.Printf("Received order data: %+v", requestData.LocalStorageData)
-			log.Printf("Received payment intent ID: %s", requestData.PaymentIntentId)
+			ctx := c.Request.Context()
+			slog.InfoContext(ctx, "Received order", "payment_intent", requestData.PaymentIntentId, "items", len(orderItems(requestData.LocalStorageData)))
 
-			paymentIntent, err := paymentintent.Get(requestData.PaymentIntentId, nil)
+			paymentIntent, err := s.intents().Get(requestData.PaymentIntentId, nil)
 			if err != nil {
-				log.Printf("Error retrieving payment intent: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to verify payment"})
+				slog.ErrorContext(ctx, "Error retrieving payment intent", "payment_intent", requestData.PaymentIntentId, "err", err)
+				c.JSON(http.StatusInternalServerError, errorBody(c, "Unable to verify payment"))
 				return
 			}
 
 			if paymentIntent.Status != stripe.PaymentIntentStatusSucceeded {
-				log.Printf("Payment was not successful, status: %s", paymentIntent.Status)
-				c.JSON(http.StatusBadRequest, gin.H{"error": "Payment not successful"})
+				slog.WarnContext(ctx, "Payment was not successful", "payment_intent", requestData.PaymentIntentId, "status", paymentIntent.Status)
+				if outcome := intentOutcome(paymentIntent.Status); outcome != "" {
+					countIntentOutcome(paymentIntent.ID, outcome)
+				}
+				c.JSON(http.StatusBadRequest, errorBody(c, "Payment not successful"))
 				return
 			}
-
-			ordersDir := "./orders"
-			if err := os.MkdirAll(ordersDir, 0o750); err != nil {
-				log.Printf("Error creating orders directory: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save order"})
-				return
+			s.guard.settled(paymentIntent.ID)
+
+			// The complete page submits again every time it is loaded, so an
+			// order that already exists keeps its history and is not taken
+			// out of stock a second time.
+			order := requestData.LocalStorageData
+			ordersMu.Lock()
+			existing, err := s.readOrder(requestData.PaymentIntentId)
+			isNew := err != nil
+			if isNew {
+				appendHistory(order, orderEvent{Time: time.Now().UTC(), Action: "created", Amount: paymentIntent.Amount})
+			} else {
+				order["history"] = existing["history"]
 			}
-
-			filePath := filepath.Join(ordersDir, fmt.Sprintf("%s.json", requestData.PaymentIntentId))
-
-			data, err := json.MarshalIndent(requestData.LocalStorageData, "", "  ")
+			err = s.writeOrder(requestData.PaymentIntentId, order)
+			ordersMu.Unlock()
 			if err != nil {
-				log.Printf("Error marshaling data: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save order"})
+				slog.ErrorContext(ctx, "Error writing order", "payment_intent", requestData.PaymentIntentId, "err", err)
+				c.JSON(http.StatusInternalServerError, errorBody(c, "Unable to save order"))
 				return
 			}
-
-			if err := os.WriteFile(filePath, data, 0o600); err != nil {
-				log.Printf("Error writing data to file: %v", err)
-				c.JSON(http.StatusInternalServerError, gin.H{"error": "Unable to save order"})
-				return
+			if isNew {
+				paymentIntents.inc("succeeded")
+				ordersWritten.inc()
+				orderRevenue.add(float64(paymentIntent.Amount), string(paymentIntent.Currency))
+				if err := s.adjustStock(orderItems(order), -1); err != nil {
+					slog.ErrorContext(ctx, "Error updating stock for order", "payment_intent", requestData.PaymentIntentId, "err", err)
+				}
+				// The shopper is not kept waiting on the mail server.
+				go func(ctx context.Context) {
+					if err := s.notifyOrder(paymentIntent.ID, order, paymentIntent.Amount, string(paymentIntent.Currency)); err != nil {
+						slog.ErrorContext(ctx, "Error mailing order notice", "payment_intent", paymentIntent.ID, "err", err)
+					}
+				}(context.WithoutCancel(ctx))
 			}
 
 			c.JSON(http.StatusOK, gin.H{"message": "Order submitted successfully"})
 		})
-		wg := new(sync.WaitGroup)
-		wg.Add(1)
-		go func() {
-			fmt.Printf("listening on http://127.0.0.1:%d using gin router\n", f.WebPort)
-			if err := r1.Run(fmt.Sprintf(":%d", f.WebPort)); err != nil {
-				log.Printf("gin router stopped: %v", err)
-			}
-			wg.Done()
-		}()
-		initJSFiles()
-		initFiles()
-		go func() {
-			for range time.Tick(time.Second) {
-				initHTMLFiles()
+
+		if f.MetricsToken != "" {
+			r1.GET("/metrics", adminAuth(f.MetricsToken), serveMetrics)
+		} else {
+			r1.GET("/metrics", serveMetrics)
+		}
+
+		if f.AdminToken != "" {
+			admin := r1.Group("/admin", adminAuth(f.AdminToken))
+			admin.POST("/orders/:piid/refund", limitBody(refundBodyLimit), func(c *gin.Context) {
+				var req refundRequest
+				if !bindStrict(c, &req) {
+					return
+				}
+				ev, err := storeFor(c).refundOrder(c.Param("piid"), req)
+				if err != nil {
+					slog.ErrorContext(c.Request.Context(), "Refund failed", "payment_intent", c.Param("piid"), "err", err)
+					c.JSON(http.StatusBadRequest, errorBody(c, err.Error()))
+					return
+				}
+				c.JSON(http.StatusOK, ev)
+			})
+		}
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		served := make(chan error, 2)
+		servers, err := startServers(r1, served)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// Dev mode compiles at startup and again whenever a source file
+		// changes. A release binary serves what was built into it.
+		if f.Dev && !f.APIOnly {
+			go func() {
+				initJSFiles()
 				initFiles()
-			}
-		}()
-		wg.Wait()
+				watchSources(ctx)
+			}()
+		}
+		select {
+		case err := <-served:
+			log.Fatal("gin router stopped: ", err)
+		case <-ctx.Done():
+		}
+		stop() // a second signal stops at once
+		shutdown(servers...)
 	},
 }
 
+// prepareWasm gets the wasm entrypoints, as applyWasmRoutes left them, ready
+// to be served: in dev mode the compilers are chosen, to be run once the
+// server is up; otherwise the prebuilt wasm is loaded.
+func prepareWasm() {
+	if f.Dev {
+		requireGo()
+	} else if prebuilt == nil {
+		log.Fatal("this binary has no prebuilt wasm in it: run with --dev, or `srv build` and then `go build -tags release`")
+	}
+	if f.Dev {
+		if err := selectCompilers(f.Compiler); err != nil {
+			log.Fatal(err)
+		}
+	} else if err := loadPrebuilt(prebuilt); err != nil {
+		log.Fatal("reading the prebuilt wasm: ", err)
+	}
+}
+
+// initJSFiles reads the wasm_exec.js of each compiler in use. A compiler
+// whose runtime cannot be found cannot be used, so that is fatal.
 func initJSFiles() {
-	for i := range jsFiles {
-		jsFiles[i].Data, err = script.File(jsFiles[i].Name).Bytes()
+	for _, i := range wasmExecInUse() {
+		data, err := os.ReadFile(jsFiles[i].Name)
 		if err != nil {
-			log.Fatal("Could not read file: ", jsFiles[i].Name, jsFiles[i].Data, err)
+			log.Fatal("Could not read file: ", jsFiles[i].Name, " ", err)
 		}
+		jsFiles[i].Mu.Lock()
+		jsFiles[i].Data, jsFiles[i].URL = data, publishAsset(wasmExecName(i), data)
+		jsFiles[i].Mu.Unlock()
 	}
 }
 
-func initHTMLFiles() {
+// initHTMLFiles rereads the theme files that changed on disk since they were
+// last read, and reports whether there were any. One that is not on disk is
+// the built-in theme's, unless it was overridden until now.
+func initHTMLFiles() (changed bool) {
 	for i := range htmlFiles {
 		fileInfo, err := os.Stat(htmlFiles[i].Name)
+		if errors.Is(err, fs.ErrNotExist) && htmlFiles[i].Theme != "" {
+			if !htmlFiles[i].Mod.IsZero() {
+				htmlFiles[i].Mod = time.Time{}
+				if err := reloadHTML(i); err != nil {
+					log.Printf("Failed to read html file %s: %v", htmlFiles[i].Name, err)
+				}
+				changed = true
+			}
+			continue
+		}
 		if err != nil {
 			log.Printf("Error accessing file %s: %v", htmlFiles[i].Name, err)
 			htmlFiles[i].Mod = time.Now()
 			continue
 		}
 		htmlFiles[i].Mod = fileInfo.ModTime()
-		if htmlFiles[i].Mod.After(htmlFiles[i].Built) || htmlFiles[i].Data == nil {
-			log.Println("reading html file", htmlFiles[i].Name)
-			htmlFiles[i].Mu.Lock()
-			htmlFiles[i].Data, err = script.File(htmlFiles[i].Name).Bytes()
-			if err != nil {
-				log.Printf("Failed to read html file %s:\n%s\n%v\n", htmlFiles[i].Name, string(htmlFiles[i].Data), err)
-				continue
+		if htmlFiles[i].Mod.After(htmlFiles[i].Built) || readFile(htmlFiles, i) == nil {
+			if err := reloadHTML(i); err != nil {
+				log.Printf("Failed to read html file %s: %v", htmlFiles[i].Name, err)
 			}
-			log.Println("read html file", htmlFiles[i].Name)
-			htmlFiles[i].Built = htmlFiles[i].Mod
-			htmlFiles[i].Mu.Unlock()
+			changed = true
 		}
 	}
+	return changed
+}
+
+// reloadHTML reads htmlFiles[i] from disk, or from the built-in theme when
+// it is a theme file not overridden there, and publishes it if it is a
+// stylesheet or script. The lock is held only for the swap, and a file that
+// cannot be read leaves the last copy in place.
+func reloadHTML(i int) error {
+	start := time.Now()
+	log.Println("reading html file", htmlFiles[i].Name)
+	data, err := os.ReadFile(htmlFiles[i].Name)
+	if errors.Is(err, fs.ErrNotExist) {
+		if def, ok := themeDefault(htmlFiles[i].Theme); ok {
+			data, err = def, nil
+		}
+	}
+	var url string
+	if err == nil && htmlFiles[i].Theme != "" && !isTemplate(htmlFiles[i].Theme) {
+		url = publishThemeAsset(i, data)
+	}
+	htmlFiles[i].Mu.Lock()
+	defer htmlFiles[i].Mu.Unlock()
+	if err != nil {
+		htmlFiles[i].Err = err.Error()
+		return err
+	}
+	htmlFiles[i].Data, htmlFiles[i].Built, htmlFiles[i].Err, htmlFiles[i].URL = data, start, "", url
+	log.Println("read html file", htmlFiles[i].Name)
+	return nil
 }
 
-func initFiles() {
+// initFiles recompiles the wasm entrypoints whose source changed since they
+// were last built, all at once, and reports whether there were any.
+func initFiles() (changed bool) {
+	var stale []int
 	for i := range wasmFiles {
+		if !wasmFiles[i].Cmp {
+			continue
+		}
 		fileInfo, err := os.Stat(wasmFiles[i].Name)
 		if err != nil {
 			log.Printf("Error accessing file %s: %v", wasmFiles[i].Name, err)
@@ -490,65 +663,130 @@ func initFiles() {
 			continue
 		}
 		wasmFiles[i].Mod = fileInfo.ModTime()
-		if (wasmFiles[i].Mod.After(wasmFiles[i].Built) || wasmFiles[i].Data == nil) && wasmFiles[i].Cmp {
-			wasmFiles[i].Mu.Lock()
-			var compileCmd string
-			startTime := time.Now()
-			buildWith := "go build"
-			if wasmFiles[i].Tiny {
-				buildWith = "tinygo build -target=wasm --no-debug"
-			}
-			log.Println("compiling wasm binary", func() string {
-				if wasmFiles[i].Tiny {
-					return "with tinygo"
-				}
-				return ""
-			}())
-			compileCmd = fmt.Sprintf(`bash -c 'GOOS=js GOARCH=wasm %s %s -o /dev/stdout %s'`, buildWith, ldFlags, wasmFiles[i].Name)
-			fmt.Println(compileCmd)
-			wasmFiles[i].Data, err = script.Exec(compileCmd).Bytes()
-			if err != nil {
-				log.Printf("Failed to compile wasm file %s:\n%s\n%v\n", wasmFiles[i].Name, string(wasmFiles[i].Data), err)
-			} else {
-				log.Printf("wasm binary size: %s\n", func() string {
-					binarySize := len(wasmFiles[i].Data)
-					if binarySize >= MB {
-						return fmt.Sprintf("%.2f MB", float64(binarySize)/MB)
-					} else if binarySize >= KB {
-						return fmt.Sprintf("%.2f KB", float64(binarySize)/KB)
-					}
-					return fmt.Sprintf("%d bytes", binarySize)
-				}())
-				log.Printf("compile time: %v\n", time.Since(startTime))
-			}
-			wasmFiles[i].Built = wasmFiles[i].Mod
-			wasmFiles[i].Mu.Unlock()
+		if wasmFiles[i].Mod.After(wasmFiles[i].Built) || readURL(wasmFiles, i) == "" {
+			stale = append(stale, i)
 		}
 	}
+	_ = inParallel(stale, func(i int) error { rebuildWasm(i); return nil }) //nolint:errcheck // rebuildWasm keeps its own errors
+	return len(stale) > 0
+}
+
+// rebuildWasm compiles wasmFiles[i] while the last good build goes on being
+// served, and swaps the new one in only if it compiled. If it did not, the
+// compiler's output is kept as the reason, for the pages to show.
+func rebuildWasm(i int) {
+	start := time.Now()
+	data, err := compileWasm(wasmFiles[i].Name, wasmFiles[i].Tiny)
+	var url string
+	if err == nil {
+		url = publishAsset(wasmName(wasmFiles[i].Name), data)
+	}
+	wasmFiles[i].Mu.Lock()
+	defer wasmFiles[i].Mu.Unlock()
+	wasmFiles[i].Built = start
+	if err != nil {
+		wasmBuildDuration.observe(time.Since(start).Seconds(), wasmFiles[i].Name, "failed")
+		wasmFiles[i].Err = fmt.Sprintf("%s: %v\n%s", wasmFiles[i].Name, err, data)
+		return
+	}
+	wasmBuildDuration.observe(time.Since(start).Seconds(), wasmFiles[i].Name, "ok")
+	wasmSize.set(float64(len(data)), wasmFiles[i].Name)
+	wasmFiles[i].Data, wasmFiles[i].URL, wasmFiles[i].Err = data, url, ""
+}
+
+// wasmBuildCommand is the shell command that compiles the entrypoint name.
+func wasmBuildCommand(name string, tiny bool) string {
+	buildWith := "go build"
+	if tiny {
+		buildWith = "tinygo build -target=wasm --no-debug"
+	}
+	return fmt.Sprintf(`bash -c 'GOOS=js GOARCH=wasm %s -o /dev/stdout %s'`, buildWith, name)
+}
+
+// compileWasm builds one wasm entrypoint, or takes it from the cache when it
+// has been built from the same sources before. On failure what comes back is
+// the compiler's output rather than a binary.
+func compileWasm(name string, tiny bool) ([]byte, error) {
+	startTime := time.Now()
+	var key string
+	if f.CacheDir != "" {
+		var err error
+		if key, err = cacheKeyFor(name, tiny); err != nil {
+			// Most likely it does not compile; the compiler will say why.
+			log.Printf("not caching %s: %v", name, err)
+			key = ""
+		} else if data, ok := cacheLoad(key); ok {
+			log.Printf("wasm binary for %s from cache %s", name, key[:16])
+			return data, nil
+		}
+	}
+	log.Println("compiling wasm binary", func() string {
+		if tiny {
+			return "with tinygo"
+		}
+		return ""
+	}())
+	compileCmd := wasmBuildCommand(name, tiny)
+	log.Println(compileCmd)
+	data, err := script.Exec(compileCmd).Bytes()
+	if err != nil {
+		log.Printf("Failed to compile wasm file %s:\n%s\n%v\n", name, string(data), err)
+		return data, err
+	}
+	if key != "" {
+		if err := cacheStore(key, data); err != nil {
+			log.Printf("caching %s: %v", name, err)
+		}
+	}
+	log.Printf("wasm binary size: %s\n", func() string {
+		binarySize := len(data)
+		if binarySize >= MB {
+			return fmt.Sprintf("%.2f MB", float64(binarySize)/MB)
+		} else if binarySize >= KB {
+			return fmt.Sprintf("%.2f KB", float64(binarySize)/KB)
+		}
+		return fmt.Sprintf("%d bytes", binarySize)
+	}())
+	log.Printf("compile time: %v\n", time.Since(startTime))
+	return data, nil
+}
+
+// wasmExecJS is the index into jsFiles of the wasm_exec.js that goes with a
+// module compiled with or without tinygo. The two are not interchangeable.
+func wasmExecJS(tiny bool) int {
+	if tiny {
+		return 1
+	}
+	return 0
 }
 
 type GinHandler struct{ Router *gin.Engine }
 
 func (h *GinHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) { h.Router.ServeHTTP(w, r) }
-func loggingMiddleware() gin.HandlerFunc {
+
+// adminAuth lets a request through only with the admin token as its bearer
+// token, compared in constant time.
+func adminAuth(token string) gin.HandlerFunc {
+	want := []byte("Bearer " + token)
 	return func(c *gin.Context) {
-		start := time.Now()
-		c.Next()
-		latency := time.Since(start)
-		if latency > time.Minute {
-			latency = latency.Truncate(time.Second)
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), want) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, errorBody(c, "unauthorized"))
+			return
 		}
-		statusCode := c.Writer.Status()
-		method := c.Request.Method
-		path := c.Request.URL.Path
-		statusCodeBackgroundColor := getBackgroundColor(statusCode)
-		methodColor := getMethodColor(method)
-		fmt.Printf("[GIN] | %s |%s %3d %s| %13v | %15s | %72s |%s %-7s %s %s\n", time.Now().Format("2006/01/02 - 15:04:05"), statusCodeBackgroundColor, statusCode, resetColor(), latency, c.ClientIP(), c.Request.RemoteAddr, methodColor, method, resetColor(), path)
+		c.Next()
 	}
 }
 
-func htmlErr(msg string) []byte {
-	return []byte(fmt.Sprintf(`<!DOCTYPE html><html><head><meta charset="utf-8"><title>Error</title></head><body style='background-color: black; color: white;'><div>%s</div></body></html>`, strings.ReplaceAll(msg, "\n", "<br>")))
+// htmlErr is the page shown in place of one that failed to render. Its
+// style and the live reload script carry the nonce of the page it replaces.
+func htmlErr(msg, nonce string) []byte {
+	return []byte(fmt.Sprintf(`<!DOCTYPE html><html><head><meta charset="utf-8"><title>Error</title><style nonce='%s'>body { background-color: black; color: white; }</style></head><body>%s%s</body></html>`, htmpl.HTMLEscapeString(nonce), htmlErrBody(msg), liveReloadScript(nonce)))
+}
+
+// htmlErrBody is an error report as it appears on a page, escaped so that
+// the template source or compiler output in it shows as text.
+func htmlErrBody(msg string) string {
+	return "<div>" + strings.ReplaceAll(html.EscapeString(msg), "\n", "<br>") + "</div>"
 }
 
 func getBackgroundColor(statusCode int) string {
@@ -597,48 +835,16 @@ const (
 )
 
 type htmlTemplateData struct {
-	Title      string
-	WasmExecJs htmpl.JS
-	WasmBase64 string
-	Css        htmpl.CSS
-	CssName    string
-	// Css        []htmpl.CSS
-	// CssName    []string
-	// Script     []htmpl.JS
-	// ScriptName []string
-}
-
-func scriptExecString(s string) string {
-	z, err := script.Exec(fmt.Sprintf(`bash -c 'MENV=%s ; if [[ $MENV != "" ]] && [[ -f $MENV ]] ; then source $MENV ; fi ; printf "%s"'`, menvfile, s)).String()
-	if err == nil {
-		return strings.TrimSpace(z)
-	}
-	return ""
-}
-
-func scriptExecBool(s string) bool {
-	z, err := script.Exec(fmt.Sprintf(`bash -c 'MENV=%s ; if [[ $MENV != "" ]] && [[ -f $MENV ]] ; then source $MENV ; fi ; printf "%s"'`, menvfile, s)).String()
-	if err == nil {
-		b, err := strconv.ParseBool(z)
-		if err == nil {
-			return b
-		}
-	}
-	return false
-}
-
-func scriptExecInt(s string) int {
-	z, err := script.Exec(fmt.Sprintf(`bash -c 'MENV=%s ; if [[ $MENV != "" ]] && [[ -f $MENV ]] ; then source $MENV ; fi ; printf "%s"'`, menvfile, s)).String()
-	if err == nil {
-		if z == "" {
-			return 0
-		}
-		i, err := strconv.Atoi(z)
-		if err == nil {
-			return i
-		}
-	}
-	return 0
+	Title        string
+	WasmExecURL  string
+	WasmURL      string
+	Styles       []string
+	Scripts      []string
+	Categories   []category
+	Product      product
+	LiveReload   htmpl.HTML
+	ClientConfig clientconfig.Config
+	Nonce        string
 }
 
 const help = "Usage:\r\n" +
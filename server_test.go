@@ -129,7 +129,7 @@ func TestCCCPanicsOnSomethingThatIsNotAStruct(t *testing.T) {
 // ── error page ───────────────────────────────────────────────────────────────
 
 func TestHTMLErrIsAWholeDocument(t *testing.T) {
-	got := string(htmlErr("something went wrong"))
+	got := string(htmlErr("something went wrong", ""))
 	for _, want := range []string{"<!DOCTYPE html>", "<html>", "</html>", "something went wrong"} {
 		if !strings.Contains(got, want) {
 			t.Errorf("the error page has no %q:\n%s", want, got)
@@ -140,7 +140,7 @@ func TestHTMLErrIsAWholeDocument(t *testing.T) {
 // The message is a compile error or a stack trace, so its newlines have to
 // survive into the page or it arrives as one unreadable line.
 func TestHTMLErrKeepsLineBreaks(t *testing.T) {
-	got := string(htmlErr("line one\nline two\nline three"))
+	got := string(htmlErr("line one\nline two\nline three", ""))
 	if n := strings.Count(got, "<br>"); n != 2 {
 		t.Errorf("two newlines became %d line breaks:\n%s", n, got)
 	}
@@ -237,3 +237,35 @@ func TestAssetsRecordWhenTheyWereBuilt(t *testing.T) {
 		}
 	}
 }
+
+// ── client config ────────────────────────────────────────────────────────────
+
+func TestClientConfigComesFromTheSettings(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.StripePK, f.Currency, f.APIBase, f.Features = "pk_test_x", "EUR", "https://api.example.com/", "gift, ,wrap"
+	c := defaultStore.clientConfig()
+	if c.PublishableKey != "pk_test_x" || c.Currency != "eur" || c.APIBase != "https://api.example.com" {
+		t.Errorf("got %+v", c)
+	}
+	if len(c.Features) != 2 || !c.Features["gift"] || !c.Features["wrap"] {
+		t.Errorf("features = %v", c.Features)
+	}
+}
+
+// Both pages carry the config, as JSON the wasm can read before it has
+// fetched anything.
+func TestPagesCarryTheClientConfig(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.StripePK, f.Currency = "pk_test_x", "usd"
+	for _, page := range []string{"index", "complete"} {
+		out, err := defaultStore.renderPage(page, htmlTemplateData{ClientConfig: defaultStore.clientConfig()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), `window.clientConfig = {"publishableKey":"pk_test_x","currency":"usd"`) {
+			t.Errorf("%s does not carry the client config", page)
+		}
+	}
+}
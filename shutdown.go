@@ -0,0 +1,89 @@
+//go:build !wasm
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// newHTTPServer is the server serve runs handler with. The timeouts bound
+// how long a slow or idle client can hold a connection; ReadHeaderTimeout is
+// the one that matters most, since without it a client that never finishes
+// its headers holds one for good.
+func newHTTPServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", f.WebPort),
+		Handler:           handler,
+		ReadHeaderTimeout: f.ReadHeaderTimeout,
+		ReadTimeout:       f.ReadTimeout,
+		WriteTimeout:      f.WriteTimeout,
+		IdleTimeout:       f.IdleTimeout,
+		MaxHeaderBytes:    f.MaxHeaderBytes,
+		ErrorLog:          log.Default(),
+	}
+}
+
+// stopping is closed when the server begins to shut down, for the handlers
+// that would otherwise never finish, like the dev mode event stream, to end.
+// srv.Shutdown does not wait for them, but it waits for their connections.
+var stopping = make(chan struct{})
+
+// shutdown stops each of servers taking new connections and waits up to
+// SHUTDOWNTIMEOUT for the requests in flight, a payment being submitted say,
+// to finish. Then it waits for any order or catalog write still going,
+// however long that takes: a file cut off halfway would be worse than a slow
+// exit.
+func shutdown(servers ...*http.Server) {
+	log.Printf("shutting down: finishing the requests in flight, for up to %v", f.ShutdownTimeout)
+	ctx, cancel := context.WithTimeout(context.Background(), f.ShutdownTimeout)
+	defer cancel()
+	close(stopping)
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Go(func() {
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Printf("requests still in flight after %v are cut off: %v", f.ShutdownTimeout, err)
+				_ = srv.Close() //nolint:errcheck // closing is all that is left to do
+			}
+		})
+	}
+	wg.Wait()
+	writesMu.Lock() // held until exit: nothing is written from here on
+	log.Println("stopped")
+}
+
+// writesMu is held for reading by every write of an order or the catalog,
+// and for writing by shutdown, which so waits for them.
+var writesMu sync.RWMutex
+
+// writeFileSynced writes data to path the way the orders and the catalog
+// have to be: to a file beside it that is synced to disk and then renamed
+// over it, so that a crash or a kill leaves either the old file or the new
+// one and never part of either.
+func writeFileSynced(path string, data []byte) error {
+	writesMu.RLock()
+	defer writesMu.RUnlock()
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck // gone already once it is renamed
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close() //nolint:errcheck,gosec // the write already failed
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close() //nolint:errcheck,gosec // as above
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
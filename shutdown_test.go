@@ -0,0 +1,171 @@
+//go:build !wasm
+
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ── http.Server ──────────────────────────────────────────────────────────────
+
+func TestTheServerHasTheConfiguredLimits(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.WebPort, f.ReadHeaderTimeout, f.MaxHeaderBytes = 8123, 3*time.Second, 4096
+	srv := newHTTPServer(http.NotFoundHandler())
+	if srv.Addr != ":8123" || srv.ReadHeaderTimeout != 3*time.Second || srv.MaxHeaderBytes != 4096 {
+		t.Errorf("server = %s, %v, %d", srv.Addr, srv.ReadHeaderTimeout, srv.MaxHeaderBytes)
+	}
+	if srv.ReadTimeout != f.ReadTimeout || srv.WriteTimeout != f.WriteTimeout || srv.IdleTimeout != f.IdleTimeout {
+		t.Error("a timeout was not carried over")
+	}
+}
+
+func TestADurationSettingIsParsed(t *testing.T) {
+	saved, savedErrs := menv, configErrs
+	defer func() { menv, configErrs = saved, savedErrs }()
+	menv, configErrs = map[string]string{"READTIMEOUT": "45s", "IDLETIMEOUT": "a while"}, nil
+
+	if got := configDuration("READTIMEOUT", time.Second); got != 45*time.Second {
+		t.Errorf("READTIMEOUT = %v", got)
+	}
+	if got := configDuration("IDLETIMEOUT", time.Minute); got != time.Minute {
+		t.Errorf("IDLETIMEOUT = %v, want the default kept", got)
+	}
+	if len(configErrs) != 1 {
+		t.Errorf("got %v, want IDLETIMEOUT reported", configErrs)
+	}
+}
+
+// ── shutdown ─────────────────────────────────────────────────────────────────
+
+// serveForShutdown serves handler on a port of its own and sets shutdown's
+// state back afterwards, since shutdown leaves writes held off for good.
+func serveForShutdown(t *testing.T, handler http.HandlerFunc) (*http.Server, string) {
+	t.Helper()
+	saved := f
+	stopping = make(chan struct{})
+	t.Cleanup(func() {
+		f = saved
+		writesMu = sync.RWMutex{}
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newHTTPServer(handler)
+	go srv.Serve(ln) //nolint:errcheck // ErrServerClosed once shut down
+	return srv, "http://" + ln.Addr().String()
+}
+
+// A payment being submitted when the signal comes is answered, not cut off.
+func TestShutdownFinishesTheRequestsInFlight(t *testing.T) {
+	started := make(chan struct{})
+	srv, url := serveForShutdown(t, func(w http.ResponseWriter, _ *http.Request) {
+		close(started)
+		time.Sleep(200 * time.Millisecond)
+		_, _ = io.WriteString(w, "paid") //nolint:errcheck // the client checks
+	})
+	f.ShutdownTimeout = 5 * time.Second
+
+	got := make(chan string, 1)
+	go func() {
+		resp, err := http.Get(url) //nolint:gosec,noctx // a test server
+		if err != nil {
+			got <- err.Error()
+			return
+		}
+		defer resp.Body.Close()          //nolint:errcheck // read below
+		body, _ := io.ReadAll(resp.Body) //nolint:errcheck // compared below
+		got <- string(body)
+	}()
+	<-started
+	shutdown(srv)
+	if body := <-got; body != "paid" {
+		t.Errorf("the request in flight got %q", body)
+	}
+	if _, err := http.Get(url); err == nil { //nolint:gosec,noctx,bodyclose // a test server
+		t.Error("a new request was taken after shutdown")
+	}
+	select {
+	case <-stopping:
+	default:
+		t.Error("the event streams were not told to stop")
+	}
+}
+
+func TestShutdownWaitsForAWriteInProgress(t *testing.T) {
+	srv, _ := serveForShutdown(t, http.NotFound)
+	f.ShutdownTimeout = time.Second
+	writesMu.RLock() // an order being written
+	done := make(chan struct{})
+	go func() { shutdown(srv); close(done) }()
+	select {
+	case <-done:
+		t.Fatal("shutdown returned in the middle of a write")
+	case <-time.After(100 * time.Millisecond):
+	}
+	writesMu.RUnlock()
+	<-done
+}
+
+func TestWritesReplaceTheFileWhole(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "order.json")
+	for _, data := range []string{"first", "second"} {
+		if err := writeFileSynced(path, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got, _ := os.ReadFile(path); string(got) != "second" { //nolint:errcheck,gosec // compared
+		t.Errorf("file = %q", got)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("file mode = %v, %v; orders are private", fi.Mode(), err)
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 1 { //nolint:errcheck // counted
+		t.Errorf("left behind: %v", entries)
+	}
+}
+
+// The dev mode event stream never ends on its own, so without this shutdown
+// would wait out SHUTDOWNTIMEOUT whenever a page was open.
+func TestEventStreamsEndOnShutdown(t *testing.T) {
+	saved := stopping
+	defer func() { stopping = saved }()
+	stopping = make(chan struct{})
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/dev/events", nil)
+	done := make(chan struct{})
+	go func() { devEvents(c); close(done) }()
+	close(stopping)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the event stream is still open")
+	}
+}
+
+func TestPollingStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	done := make(chan struct{})
+	go func() { pollSources(ctx); close(done) }()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Error("pollSources kept going")
+	}
+}
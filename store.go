@@ -0,0 +1,308 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/stripe/stripe-go/v80"
+	"github.com/stripe/stripe-go/v80/paymentintent"
+	"github.com/stripe/stripe-go/v80/refund"
+)
+
+// store is one shop: its catalog, theme, orders, currency, Stripe account
+// and where notices of its orders are mailed. STORES names a store for each
+// of the hosts it is served at, and the flags are defaultStore, served at
+// any other host. A setting a store leaves out is the flag's, so the stores
+// share whatever they do not set. The wasm is the same for every store.
+type store struct {
+	Host             string `json:"-"`
+	Catalog          string `json:"catalog"`
+	Theme            string `json:"theme"`
+	OrdersDir        string `json:"ordersDir"`
+	Currency         string `json:"currency"`
+	StripeliveSK     string `json:"-"`
+	StripelivePK     string `json:"stripeLivePK"`
+	StripetestSK     string `json:"-"`
+	StripetestPK     string `json:"stripeTestPK"`
+	StripeliveSKFile string `json:"stripeLiveSKFile"`
+	StripetestSKFile string `json:"stripeTestSKFile"`
+	StripeliveSKEnv  string `json:"stripeLiveSKEnv"`
+	StripetestSKEnv  string `json:"stripeTestSKEnv"`
+	SMTPAddr         string `json:"smtpAddr"`
+	SMTPUser         string `json:"smtpUser"`
+	SMTPPassword     string `json:"-"`
+	SMTPPasswordFile string `json:"smtpPasswordFile"`
+	SMTPPasswordEnv  string `json:"smtpPasswordEnv"`
+	EmailFrom        string `json:"emailFrom"`
+	EmailTo          string `json:"emailTo"`
+
+	guard *guard // the card testing guard of its Stripe account
+}
+
+// defaultStore is the store the flags describe, and stores those STORES
+// does, by host.
+var (
+	defaultStore = &store{}
+	stores       map[string]*store
+)
+
+// loadStores reads STORES: a JSON object of store definitions by host name.
+// A secret is never written into STORES itself, the same as it is never
+// given as a flag: a store names the file it is in, or the environment
+// variable that holds it, and it is read from there.
+func loadStores(path string) (map[string]*store, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path) //nolint:gosec // the operator's own setting
+	if err != nil {
+		return nil, fmt.Errorf("STORES: %w", err)
+	}
+	var defs map[string]*store
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&defs); err != nil {
+		for _, name := range []string{"stripeLiveSK", "stripeTestSK", "smtpPassword"} {
+			if strings.Contains(err.Error(), `unknown field "`+name+`"`) {
+				return nil, fmt.Errorf("STORES: %s: %s: a secret is not written into STORES; name its file with %sFile or its environment variable with %sEnv", path, name, name, name)
+			}
+		}
+		return nil, fmt.Errorf("STORES: %s: %w", path, err)
+	}
+	loaded := map[string]*store{}
+	var errs []error
+	for _, host := range slices.Sorted(maps.Keys(defs)) {
+		s := defs[host]
+		if s == nil {
+			s = &store{}
+		}
+		s.Host = normalizeHost(host)
+		if s.Host == "" || loaded[s.Host] != nil {
+			errs = append(errs, fmt.Errorf("STORES: %q is empty or named twice", host))
+			continue
+		}
+		for _, k := range []struct {
+			name      string
+			key       *string
+			file, env string
+		}{
+			{"stripeLiveSK", &s.StripeliveSK, s.StripeliveSKFile, s.StripeliveSKEnv},
+			{"stripeTestSK", &s.StripetestSK, s.StripetestSKFile, s.StripetestSKEnv},
+			{"smtpPassword", &s.SMTPPassword, s.SMTPPasswordFile, s.SMTPPasswordEnv},
+		} {
+			key, err := readStoreSecret(k.file, k.env)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("STORES: %s: %s: %w", s.Host, k.name, err))
+				continue
+			}
+			*k.key = key
+		}
+		loaded[s.Host] = s
+	}
+	return loaded, errors.Join(errs...)
+}
+
+// readStoreSecret is a secret a store names the file or the environment
+// variable of, trimmed; the environment is read as for the flags, MENV
+// after it. Naming neither is no secret; naming both, or a variable that is
+// not set, is an error.
+func readStoreSecret(file, env string) (string, error) {
+	switch {
+	case file != "" && env != "":
+		return "", errors.New("name its file or its environment variable, not both")
+	case file != "":
+		data, err := os.ReadFile(file) //nolint:gosec // the operator's own setting
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	case env != "":
+		v, _, ok := configValue(env)
+		if !ok || strings.TrimSpace(v) == "" {
+			return "", fmt.Errorf("%s is not set", env)
+		}
+		return strings.TrimSpace(v), nil
+	}
+	return "", nil
+}
+
+// normalizeHost is a Host header, or a host named in STORES, without its
+// port, in lower case and without a trailing dot.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(host)), ".")
+}
+
+// storeFor is the store a request is for, by its Host.
+func storeFor(c *gin.Context) *store {
+	if s, ok := stores[normalizeHost(c.Request.Host)]; ok {
+		return s
+	}
+	return defaultStore
+}
+
+// storeNamed is the store a command run from the shell works on: the one
+// STORES has for STORE, read the same way serve reads it, or defaultStore
+// when STORE is unset.
+func storeNamed() (*store, error) {
+	if err := initStores(); err != nil {
+		return nil, err
+	}
+	if f.Store == "" {
+		return defaultStore, nil
+	}
+	s, ok := stores[normalizeHost(f.Store)]
+	if !ok {
+		return nil, fmt.Errorf("STORE: no store in STORES is served at %q", f.Store)
+	}
+	return s, nil
+}
+
+// allStores is defaultStore and then every store STORES names, by host.
+func allStores() []*store {
+	all := []*store{defaultStore}
+	for _, host := range slices.Sorted(maps.Keys(stores)) {
+		all = append(all, stores[host])
+	}
+	return all
+}
+
+// setting is the name a problem with one of the store's settings is
+// reported under: the flag's for defaultStore, the host and the field for
+// the others.
+func (s *store) setting(flag, field string) string {
+	if s.Host == "" {
+		return flag
+	}
+	return "STORES: " + s.Host + ": " + field
+}
+
+func (s *store) catalog() string   { return cmp.Or(s.Catalog, f.Catalog) }
+func (s *store) ordersDir() string { return cmp.Or(s.OrdersDir, f.OrdersDir) }
+
+// currency is the store's in lower case, as Stripe and the client want it.
+func (s *store) currency() string { return strings.ToLower(cmp.Or(s.Currency, f.Currency)) }
+
+// themeTag is what the store's theme files are tagged with in htmlFiles: ""
+// for the flags' theme, shared by every store that does not have one of its
+// own, or else its directory, shared by stores that name the same one.
+func (s *store) themeTag() string {
+	if s.Theme == "" || s.Theme == f.Theme {
+		return ""
+	}
+	return s.Theme
+}
+
+// ownKeys reports whether the store takes payments with a Stripe account
+// of its own, rather than the flags'.
+func (s *store) ownKeys() bool {
+	return s.StripeliveSK != "" || s.StripelivePK != "" || s.StripetestSK != "" || s.StripetestPK != ""
+}
+
+// stripeKeys is the secret and publishable key the store takes payments
+// with: its own live or test pair, as TESTSTRIPEKEY says, or the flags'.
+func (s *store) stripeKeys() (sk, pk string) {
+	switch {
+	case !s.ownKeys():
+		return f.StripeSK, f.StripePK
+	case f.Teststripekey:
+		return s.StripetestSK, s.StripetestPK
+	}
+	return s.StripeliveSK, s.StripelivePK
+}
+
+func (s *store) intents() paymentintent.Client {
+	sk, _ := s.stripeKeys()
+	return paymentintent.Client{B: stripe.GetBackend(stripe.APIBackend), Key: sk}
+}
+
+func (s *store) refunds() refund.Client {
+	sk, _ := s.stripeKeys()
+	return refund.Client{B: stripe.GetBackend(stripe.APIBackend), Key: sk}
+}
+
+// checkStripeKeys reports a live or test key pair, whichever is in use, that
+// does not look like one. A store without keys of its own has the flags'.
+func (s *store) checkStripeKeys() []error {
+	mode, flag := "live", "STRIPELIVE"
+	sk, pk := s.StripeliveSK, s.StripelivePK
+	if s.Host == "" {
+		sk, pk = f.StripeliveSK, f.StripelivePK
+	}
+	if f.Teststripekey {
+		mode, flag, sk, pk = "test", "STRIPETEST", s.StripetestSK, s.StripetestPK
+		if s.Host == "" {
+			sk, pk = f.StripetestSK, f.StripetestPK
+		}
+	}
+	if s.Host != "" && !s.ownKeys() {
+		return nil
+	}
+	field := "stripe" + strings.ToUpper(mode[:1]) + mode[1:]
+	var errs []error
+	if !strings.HasPrefix(sk, "sk_"+mode+"_") && !strings.HasPrefix(sk, "rk_"+mode+"_") {
+		errs = append(errs, fmt.Errorf("%s: not a stripe %s secret key", s.setting(flag+"SK", field+"SK"), mode))
+	}
+	if !strings.HasPrefix(pk, "pk_"+mode+"_") {
+		errs = append(errs, fmt.Errorf("%s: not a stripe %s publishable key", s.setting(flag+"PK", field+"PK"), mode))
+	}
+	return errs
+}
+
+// check reports every problem with the settings the store has of its own,
+// all of them for defaultStore, but for its theme, which checkTheme looks
+// at once the themes are loaded.
+func (s *store) check() []error {
+	errs := s.checkStripeKeys()
+	if s.Host == "" || s.Currency != "" {
+		if c := s.currency(); len(c) != 3 {
+			errs = append(errs, fmt.Errorf("%s: %q is not a three-letter currency code", s.setting("CURRENCY", "currency"), c))
+		}
+	}
+	if s.Host == "" || s.Catalog != "" {
+		if products, err := s.loadCatalog(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.setting("CATALOG", "catalog"), err))
+		} else {
+			for _, err := range validateCatalog(products) {
+				errs = append(errs, fmt.Errorf("%s: %w", s.setting("CATALOG", "catalog"), err))
+			}
+		}
+	}
+	errs = append(errs, s.checkMail()...)
+	if s.Host == "" || s.OrdersDir != "" {
+		if fi, err := os.Stat(s.ordersDir()); err == nil && !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("%s: %s is not a directory", s.setting("ORDERSDIR", "ordersDir"), s.ordersDir()))
+		} else if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, fmt.Errorf("%s: %w", s.setting("ORDERSDIR", "ordersDir"), err))
+		}
+	}
+	return errs
+}
+
+// initStores reads STORES into stores and gives each store, defaultStore
+// among them, its card testing guard.
+func initStores() error {
+	loaded, err := loadStores(f.Stores)
+	if err != nil {
+		return err
+	}
+	stores = loaded
+	for _, s := range allStores() {
+		sk, _ := s.stripeKeys()
+		s.guard = newGuard(sk)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+//go:build !wasm
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// keepStores puts the flags and the stores back after a test.
+func keepStores(t *testing.T) {
+	t.Helper()
+	saved, savedStores, savedDefault := f, stores, *defaultStore
+	t.Cleanup(func() { f, stores, *defaultStore = saved, savedStores, savedDefault })
+}
+
+// writeStores writes a STORES file and points f.Stores at it.
+func writeStores(t *testing.T, body string) {
+	t.Helper()
+	f.Stores = filepath.Join(t.TempDir(), "stores.json")
+	if err := os.WriteFile(f.Stores, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ── loading ──────────────────────────────────────────────────────────────────
+
+func TestStoresAreReadByHost(t *testing.T) {
+	keepStores(t)
+	key := filepath.Join(t.TempDir(), "sk")
+	if err := os.WriteFile(key, []byte("sk_test_tubes\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeStores(t, `{
+		"Tubes.Example:8443": {"catalog": "tubes.json", "currency": "EUR", "stripeTestSKFile": "`+key+`", "stripeTestPK": "pk_test_tubes"},
+		"radios.example.": {}
+	}`)
+	if err := initStores(); err != nil {
+		t.Fatal(err)
+	}
+	if len(stores) != 2 || stores["tubes.example"] == nil || stores["radios.example"] == nil {
+		t.Fatalf("stores = %v, want tubes.example and radios.example", stores)
+	}
+	s := stores["tubes.example"]
+	if s.StripetestSK != "sk_test_tubes" {
+		t.Errorf("the secret key is %q, want the file's, trimmed", s.StripetestSK)
+	}
+	if s.catalog() != "tubes.json" || s.currency() != "eur" {
+		t.Errorf("catalog %q, currency %q", s.catalog(), s.currency())
+	}
+	for _, s := range allStores() {
+		if s.guard == nil {
+			t.Errorf("store %q has no card testing guard", s.Host)
+		}
+	}
+}
+
+func TestStoresRejectsWhatItCannotPlace(t *testing.T) {
+	keepStores(t)
+	for name, body := range map[string]string{
+		"unknown field": `{"a.example": {"catlog": "a.json"}}`,
+		"same host":     `{"a.example": {}, "A.example.": {}}`,
+		"empty host":    `{"": {}}`,
+		"missing key":   `{"a.example": {"stripeLiveSKFile": "/nonexistent/sk"}}`,
+		"unset key":     `{"a.example": {"stripeLiveSKEnv": "NO_SUCH_STORE_SK"}}`,
+		"two keys":      `{"a.example": {"stripeTestSKFile": "sk", "stripeTestSKEnv": "SK"}}`,
+		"inline key":    `{"a.example": {"stripeLiveSK": "sk_live_x"}}`,
+	} {
+		writeStores(t, body)
+		if err := initStores(); err == nil || !strings.HasPrefix(err.Error(), "STORES: ") {
+			t.Errorf("%s: got %v, want a STORES error", name, err)
+		}
+	}
+}
+
+// A secret key is read from where the store points, never from STORES.
+func TestAStoresSecretKeysComeFromTheEnvironmentOrAFile(t *testing.T) {
+	keepStores(t)
+	t.Setenv("RADIOS_SK", " sk_live_radios\n")
+	writeStores(t, `{"radios.example": {"stripeLiveSKEnv": "RADIOS_SK", "stripeLivePK": "pk_live_radios"}}`)
+	if err := initStores(); err != nil {
+		t.Fatal(err)
+	}
+	if sk := stores["radios.example"].StripeliveSK; sk != "sk_live_radios" {
+		t.Errorf("the secret key is %q, want the variable's, trimmed", sk)
+	}
+
+	writeStores(t, `{"radios.example": {"stripeTestSK": "sk_test_inline"}}`)
+	err := initStores()
+	if err == nil || !strings.Contains(err.Error(), "stripeTestSKFile") || strings.Contains(err.Error(), "sk_test_inline") {
+		t.Errorf("got %v, want an error that points at stripeTestSKFile and does not repeat the key", err)
+	}
+}
+
+// ── choosing ─────────────────────────────────────────────────────────────────
+
+func TestTheHostChoosesTheStore(t *testing.T) {
+	keepStores(t)
+	tubes := &store{Host: "tubes.example"}
+	stores = map[string]*store{"tubes.example": tubes}
+	for host, want := range map[string]*store{
+		"tubes.example":      tubes,
+		"TUBES.example:8080": tubes,
+		"tubes.example.":     tubes,
+		"radios.example":     defaultStore,
+		"":                   defaultStore,
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodGet, "/", nil)
+		c.Request.Host = host
+		if got := storeFor(c); got != want {
+			t.Errorf("%q: got the store of %q, want %q", host, got.Host, want.Host)
+		}
+	}
+}
+
+// orders and catalog work on the store STORE names, as serve would serve it.
+func TestACommandWorksOnTheStoreNamed(t *testing.T) {
+	keepStores(t)
+	t.Chdir(t.TempDir())
+	writeStores(t, `{"radios.example": {"catalog": "radios.json", "ordersDir": "radios"}}`)
+	if s, err := storeNamed(); err != nil || s != defaultStore {
+		t.Errorf("with no STORE got %v, %v, want the flags' store", s, err)
+	}
+	f.Store = "Radios.example:443"
+	s, err := storeNamed()
+	if err != nil || s.Host != "radios.example" || s.ordersDir() != "radios" {
+		t.Fatalf("got %v, %v, want radios.example's store", s, err)
+	}
+	if err := os.WriteFile("import.json", []byte(`[{"id": "R-1", "name": "a crystal set", "price": 1999}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	catalogImportCmd.Run(catalogImportCmd, []string{"import.json"})
+	if _, err := os.Stat("radios.json"); err != nil {
+		t.Errorf("catalog import did not write radios.example's catalog: %v", err)
+	}
+	if _, err := os.Stat(f.Catalog); !os.IsNotExist(err) {
+		t.Errorf("catalog import wrote the flags' catalog: %v", err)
+	}
+
+	f.Store = "tubes.example"
+	if _, err := storeNamed(); err == nil || !strings.HasPrefix(err.Error(), "STORE: ") {
+		t.Errorf("got %v, want a STORE error for a host STORES does not have", err)
+	}
+}
+
+// What a store leaves out is the flags', its Stripe account among it.
+func TestAStoreFallsBackToTheFlags(t *testing.T) {
+	keepStores(t)
+	f.Catalog, f.OrdersDir, f.Currency = "catalog.json", "orders", "USD"
+	f.StripeSK, f.StripePK, f.Teststripekey = "sk_live_flags", "pk_live_flags", false
+	s := &store{Host: "tubes.example", Currency: "eur"}
+	if s.catalog() != "catalog.json" || s.ordersDir() != "orders" || s.currency() != "eur" {
+		t.Errorf("catalog %q, orders %q, currency %q", s.catalog(), s.ordersDir(), s.currency())
+	}
+	if sk, pk := s.stripeKeys(); sk != "sk_live_flags" || pk != "pk_live_flags" {
+		t.Errorf("keys %q, %q, want the flags'", sk, pk)
+	}
+	s.StripeliveSK, s.StripelivePK, s.StripetestSK, s.StripetestPK = "sk_live_own", "pk_live_own", "sk_test_own", "pk_test_own"
+	if sk, pk := s.stripeKeys(); sk != "sk_live_own" || pk != "pk_live_own" {
+		t.Errorf("keys %q, %q, want its own live pair", sk, pk)
+	}
+	f.Teststripekey = true
+	if sk, pk := s.stripeKeys(); sk != "sk_test_own" || pk != "pk_test_own" {
+		t.Errorf("keys %q, %q, want its own test pair", sk, pk)
+	}
+	if cfg := s.clientConfig(); cfg.PublishableKey != "pk_test_own" || cfg.Currency != "eur" {
+		t.Errorf("client config %+v", cfg)
+	}
+}
+
+// ── serving ──────────────────────────────────────────────────────────────────
+
+// Each host gets its own theme and catalog from the one server.
+func TestEachStoreServesItsOwnThemeAndCatalog(t *testing.T) {
+	keepStores(t)
+	keepTheme(t)
+	t.Chdir(t.TempDir())
+	dir := writeTheme(t, map[string]string{"partials/header.html": `{{define "header"}}<h1 class='brand'>Radios</h1>{{end}}`})
+	if err := os.WriteFile("radios.json", []byte(`[{"id": "R-1", "name": "a crystal set", "price": 1999, "stock": 3}]`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	writeStores(t, `{"radios.example": {"catalog": "radios.json", "theme": "`+dir+`"}}`)
+	if err := initStores(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadThemes(); err != nil {
+		t.Fatal(err)
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/", pageHandler("/", "index", func(s *store, h *htmlTemplateData) error {
+		products, err := s.loadCatalog()
+		h.Categories = categories(products)
+		return err
+	}))
+	get := func(host string) string {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Host = host
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+	radios, shop := get("radios.example"), get("shop.example")
+	if !strings.Contains(radios, "<h1 class='brand'>Radios</h1>") || !strings.Contains(radios, "a crystal set") {
+		t.Error("radios.example is not served its own header and catalog")
+	}
+	if !strings.Contains(shop, "<h1>Shop</h1>") || strings.Contains(shop, "a crystal set") {
+		t.Error("another host is served radios.example's header or catalog")
+	}
+}
+
+// ── checking ─────────────────────────────────────────────────────────────────
+
+// A store's own catalog is its own: missing, it is an error rather than the
+// products compiled into the binary.
+func TestAStoresMissingCatalogIsAnError(t *testing.T) {
+	keepStores(t)
+	t.Chdir(t.TempDir())
+	s := &store{Host: "radios.example", Catalog: "radios.json"}
+	if products, err := s.loadCatalog(); err == nil {
+		t.Errorf("loaded %d products from a catalog that is not there", len(products))
+	}
+	if err := s.adjustStock(map[string]int64{"VT-8AW8A": 1}, -1); err == nil {
+		t.Error("a sale wrote a catalog for the store")
+	}
+	if _, err := os.Stat("radios.json"); !os.IsNotExist(err) {
+		t.Errorf("radios.json was written: %v", err)
+	}
+	var found bool
+	for _, err := range s.check() {
+		found = found || strings.HasPrefix(err.Error(), "STORES: radios.example: catalog: ")
+	}
+	if !found {
+		t.Error("config check does not report the missing catalog")
+	}
+}
+
+// A problem with a store's setting names the host and the field it is in.
+func TestStoreCheckNamesTheHostAndField(t *testing.T) {
+	keepStores(t)
+	t.Chdir(t.TempDir())
+	f.Teststripekey = true
+	if err := os.WriteFile("orders", nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s := &store{Host: "tubes.example", Currency: "euro", StripetestSK: "sk_live_wrong", StripetestPK: "pk_test_ok", OrdersDir: "orders"}
+	var got []string
+	for _, err := range s.check() {
+		got = append(got, err.Error())
+	}
+	for _, want := range []string{
+		"STORES: tubes.example: stripeTestSK: not a stripe test secret key",
+		`STORES: tubes.example: currency: "euro" is not a three-letter currency code`,
+		"STORES: tubes.example: ordersDir: orders is not a directory",
+	} {
+		if !strings.Contains(strings.Join(got, "\n"), want) {
+			t.Errorf("got %q, want %q among them", got, want)
+		}
+	}
+	if len(got) != 3 {
+		t.Errorf("got %d problems, want 3: %q", len(got), got)
+	}
+
+	// A store that sets nothing of its own has nothing of its own to check.
+	if errs := (&store{Host: "radios.example"}).check(); len(errs) > 0 {
+		t.Errorf("an empty store reports %v", errs)
+	}
+}
@@ -0,0 +1,321 @@
+//go:build !wasm
+
+package main
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	htmpl "html/template"
+	"io/fs"
+	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// theme holds the pages as templates: layout.html around every page, the
+// partials in partials/ that pages and the layout share, a template for each
+// page in pages/, the stylesheets and scripts they load, and theme.json
+// saying which page loads which. Any of them can be overridden by a file of
+// the same name under THEME, and files the built-in theme does not have can
+// be added there, without rebuilding the binary.
+//
+//go:embed theme
+var theme embed.FS
+
+const (
+	themeLayout   = "layout.html"
+	themePartials = "partials"
+	themePages    = "pages"
+	themeConfig   = "theme.json"
+)
+
+// themePage is what theme.json says about one page.
+type themePage struct {
+	Title   string   `json:"title"`
+	Styles  []string `json:"styles"`
+	Scripts []string `json:"scripts"`
+}
+
+// themeFuncs are the functions the templates have besides html/template's
+// own. json writes its arguments as a JSON array, for the data-args of an
+// element that calls into the wasm.
+var themeFuncs = htmpl.FuncMap{
+	"json": func(args ...any) (string, error) {
+		data, err := json.Marshal(args)
+		return string(data), err
+	},
+}
+
+// htmlFiles are the files of the theme, by the path each would be overridden
+// from. Until loadThemes has run they are the built-in theme as it is.
+var htmlFiles = func() []FileAsset {
+	var files []FileAsset
+	_ = fs.WalkDir(theme, "theme", func(p string, d fs.DirEntry, err error) error { //nolint:errcheck // the embedded tree cannot fail to walk
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, _ := theme.ReadFile(p) //nolint:errcheck // as above
+		rel := strings.TrimPrefix(p, "theme/")
+		files = append(files, FileAsset{Name: filepath.Join("theme", rel), Theme: rel, Data: data, Built: time.Now()})
+		return nil
+	})
+	return files
+}()
+
+// themeDefault is the built-in theme's copy of rel, if it has one.
+func themeDefault(rel string) ([]byte, bool) {
+	data, err := theme.ReadFile(path.Join("theme", rel))
+	return data, err == nil
+}
+
+// isTemplate reports whether a theme file is rendered into pages rather than
+// served under /assets.
+func isTemplate(rel string) bool {
+	return strings.HasSuffix(rel, ".html") || rel == themeConfig
+}
+
+// loadThemes reads the theme of every store: THEME, and each other
+// directory a store in STORES names. The files in a directory override the
+// built-in theme's of the same name, and it can add files of its own; one
+// that does not exist overrides nothing. Stylesheets and scripts are
+// published under /assets.
+func loadThemes() error {
+	var builtin []string
+	_ = fs.WalkDir(theme, "theme", func(p string, d fs.DirEntry, err error) error { //nolint:errcheck // the embedded tree cannot fail to walk
+		if err == nil && !d.IsDir() {
+			builtin = append(builtin, strings.TrimPrefix(p, "theme/"))
+		}
+		return err
+	})
+	dirs := map[string]string{"": f.Theme}
+	for _, st := range stores {
+		if tag := st.themeTag(); tag != "" {
+			dirs[tag] = st.Theme
+		}
+	}
+	var files []FileAsset
+	for _, tag := range slices.Sorted(maps.Keys(dirs)) {
+		dir := dirs[tag]
+		seen := map[string]bool{}
+		for _, rel := range builtin {
+			seen[rel] = true
+			files = append(files, FileAsset{Name: filepath.Join(dir, filepath.FromSlash(rel)), Theme: rel, ThemeTag: tag})
+		}
+		err := filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			rel, err := filepath.Rel(dir, p)
+			if err != nil {
+				return err
+			}
+			if rel = filepath.ToSlash(rel); !seen[rel] {
+				seen[rel] = true
+				files = append(files, FileAsset{Name: p, Theme: rel, ThemeTag: tag})
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("THEME: %w", err)
+		}
+	}
+	htmlFiles = files
+	var errs []error
+	for i := range htmlFiles {
+		if err := reloadHTML(i); err != nil {
+			errs = append(errs, err)
+		}
+		if fi, err := os.Stat(htmlFiles[i].Name); err == nil {
+			htmlFiles[i].Mod = fi.ModTime()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// themeFile is the index into htmlFiles of the store's theme file rel, or
+// -1.
+func (s *store) themeFile(rel string) int {
+	tag := s.themeTag()
+	for i := range htmlFiles {
+		if htmlFiles[i].Theme == rel && htmlFiles[i].ThemeTag == tag {
+			return i
+		}
+	}
+	return -1
+}
+
+// themeConfigPages reads the pages the store's theme.json lists.
+func (s *store) themeConfigPages() (map[string]themePage, error) {
+	var cfg struct {
+		Pages map[string]themePage `json:"pages"`
+	}
+	i := s.themeFile(themeConfig)
+	if i < 0 {
+		return nil, fmt.Errorf("the theme has no %s", themeConfig)
+	}
+	if err := json.Unmarshal(readFile(htmlFiles, i), &cfg); err != nil {
+		return nil, fmt.Errorf("%s: %w", themeConfig, err)
+	}
+	return cfg.Pages, nil
+}
+
+// themeURLs are the /assets URLs of the theme files names, which theme.json
+// lists for a page.
+func (s *store) themeURLs(names []string) ([]string, error) {
+	urls := make([]string, 0, len(names))
+	for _, name := range names {
+		i := s.themeFile(name)
+		if i < 0 || isTemplate(name) {
+			return nil, fmt.Errorf("%s: the theme has no stylesheet or script %s", themeConfig, name)
+		}
+		urls = append(urls, themeAssetURL(i))
+	}
+	return urls, nil
+}
+
+// themeAssetURL is where the stylesheet or script htmlFiles[i] is served,
+// publishing it if that has not happened yet.
+func themeAssetURL(i int) string {
+	htmlFiles[i].Mu.Lock()
+	defer htmlFiles[i].Mu.Unlock()
+	if htmlFiles[i].URL == "" {
+		htmlFiles[i].URL = publishThemeAsset(i, htmlFiles[i].Data)
+	}
+	return htmlFiles[i].URL
+}
+
+// publishThemeAsset publishes data as the stylesheet or script htmlFiles[i].
+// Each theme's copy of a file has builds of its own, by its theme tag, so
+// that editing one store's shop.css does not take another's off the server.
+func publishThemeAsset(i int, data []byte) string {
+	return publishVersion(path.Join(htmlFiles[i].ThemeTag, htmlFiles[i].Theme), path.Base(htmlFiles[i].Theme), data)
+}
+
+// renderPage executes the layout around the page name, with the partials and
+// the stylesheets and scripts the store's theme.json gives it. The templates
+// are parsed each time, so an edited theme file shows on the next request.
+func (s *store) renderPage(name string, h htmlTemplateData) ([]byte, error) {
+	pages, err := s.themeConfigPages()
+	if err != nil {
+		return nil, err
+	}
+	p, ok := pages[name]
+	if !ok {
+		return nil, fmt.Errorf("%s has no page %q", themeConfig, name)
+	}
+	if h.Title == "" {
+		h.Title = p.Title
+	}
+	if h.Styles, err = s.themeURLs(p.Styles); err != nil {
+		return nil, err
+	}
+	if h.Scripts, err = s.themeURLs(p.Scripts); err != nil {
+		return nil, err
+	}
+
+	page := path.Join(themePages, name+".html")
+	tmpl := htmpl.New(themeLayout).Funcs(themeFuncs)
+	var names []string
+	tag := s.themeTag()
+	for i := range htmlFiles {
+		if rel := htmlFiles[i].Theme; htmlFiles[i].ThemeTag == tag && strings.HasPrefix(rel, themePartials+"/") && strings.HasSuffix(rel, ".html") {
+			names = append(names, rel)
+		}
+	}
+	slices.Sort(names)
+	for _, rel := range append([]string{themeLayout, page}, names...) {
+		i := s.themeFile(rel)
+		if i < 0 {
+			return nil, fmt.Errorf("the theme has no %s", rel)
+		}
+		t := tmpl
+		if rel != themeLayout {
+			t = tmpl.New(rel)
+		}
+		if _, err := t.Parse(string(readFile(htmlFiles, i))); err != nil {
+			return nil, err
+		}
+	}
+	var out bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&out, themeLayout, map[string]interface{}{"Page": h}); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+// checkTheme renders every page the store's theme.json lists, with nothing
+// in it, and reports each one that fails.
+func (s *store) checkTheme() []error {
+	pages, err := s.themeConfigPages()
+	if err != nil {
+		return []error{err}
+	}
+	var errs []error
+	for _, name := range slices.Sorted(maps.Keys(pages)) {
+		if _, err := s.renderPage(name, htmlTemplateData{}); err != nil {
+			errs = append(errs, fmt.Errorf("page %s: %w", name, err))
+		}
+	}
+	return errs
+}
+
+// pageData is what every page of the store is rendered with: the wasm its
+// route loads, the store's client config, in dev mode the live reload
+// script, and the nonce its inline scripts and styles carry.
+func (s *store) pageData(route, nonce string) htmlTemplateData {
+	h := htmlTemplateData{Nonce: nonce}
+	if wasmFile := wasmForRoute(route); wasmFile >= 0 {
+		h.WasmExecURL = readURL(jsFiles, wasmExecJS(wasmFiles[wasmFile].Tiny))
+		h.WasmURL = readURL(wasmFiles, wasmFile)
+	}
+	h.ClientConfig = s.clientConfig()
+	h.LiveReload = liveReloadScript(nonce)
+	return h
+}
+
+// pageHandler serves the page name of the store the request is for. fill
+// adds what only that page shows; an error from it, like one from the
+// templates, is shown in place of the page.
+func pageHandler(route, name string, fill func(s *store, h *htmlTemplateData) error) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		s := storeFor(c)
+		nonce, token := newNonce(), csrfSession(c)
+		c.Writer.Header().Set("Server", "")
+		c.Writer.Header().Set("Content-Type", "text/html;charset=utf-8")
+		c.Writer.Header().Set("Transfer-Encoding", "chunked")
+		setCSP(c, nonce)
+		c.Writer.WriteHeader(http.StatusOK)
+		c.Writer.Flush()
+
+		h := s.pageData(route, nonce)
+		h.ClientConfig.CSRFToken = token
+		var page []byte
+		var err error
+		if fill != nil {
+			err = fill(s, &h)
+		}
+		if err == nil {
+			page, err = s.renderPage(name, h)
+		}
+		if err != nil {
+			msg := fmt.Sprintf("Could not render page %s: %v\n", name, err)
+			slog.ErrorContext(c.Request.Context(), "Could not render page", "page", name, "err", err)
+			_, _ = c.Writer.Write(htmlErr(msg, nonce)) //nolint:errcheck // the response is the error report; a failed write has nowhere to go
+			c.Writer.Flush()
+			return
+		}
+		_, _ = c.Writer.Write(page) //nolint:errcheck // as above: the client has gone
+		c.Writer.Flush()
+	}
+}
@@ -0,0 +1,161 @@
+//go:build !wasm
+
+package main
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// ── theme ────────────────────────────────────────────────────────────────────
+
+// keepTheme puts the built-in theme back after a test has loaded another.
+func keepTheme(t *testing.T) {
+	t.Helper()
+	saved, savedDir := htmlFiles, f.Theme
+	t.Cleanup(func() { htmlFiles, f.Theme = saved, savedDir })
+}
+
+// writeTheme writes files, by their names within the theme, under a new
+// theme directory.
+func writeTheme(t *testing.T, files map[string]string) string {
+	t.Helper()
+	dir := t.TempDir()
+	for name, body := range files {
+		p := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(p, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestEveryBuiltInPageRenders(t *testing.T) {
+	if errs := defaultStore.checkTheme(); len(errs) > 0 {
+		t.Fatal(errs)
+	}
+	out, err := defaultStore.renderPage("complete", htmlTemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<title>Order Status</title>", "payment-status", "<link rel='stylesheet' href='/assets/checkout."} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("the complete page has no %q", want)
+		}
+	}
+	out, err = defaultStore.renderPage("index", htmlTemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"<h1>Shop</h1>", "id='cart-items'", "id='stripecheckout'", "/assets/shop."} {
+		if !strings.Contains(string(out), want) {
+			t.Errorf("the index page has no %q", want)
+		}
+	}
+}
+
+// No wasm, no bootstrap: a page that loads none has no Go() to construct.
+func TestWasmBootstrapOnlyWithWasm(t *testing.T) {
+	out, err := defaultStore.renderPage("complete", htmlTemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(out), "new Go()") {
+		t.Error("a page without wasm starts Go")
+	}
+	out, err = defaultStore.renderPage("complete", htmlTemplateData{WasmExecURL: "/assets/wasm_exec.x.js", WasmURL: "/assets/complete.x.wasm"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "new Go()") || !strings.Contains(string(out), "complete.x.wasm") {
+		t.Error("the page does not load its wasm")
+	}
+}
+
+func TestPartialOverriddenFromDiskAndBackAgain(t *testing.T) {
+	keepTheme(t)
+	dir := writeTheme(t, map[string]string{"partials/header.html": `{{define "header"}}<h1 class='brand'>{{.Page.Title}}!</h1>{{end}}`})
+	f.Theme = dir
+	if err := loadThemes(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := defaultStore.renderPage("index", htmlTemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "<h1 class='brand'>Shop!</h1>") {
+		t.Error("the overriding header is not used")
+	}
+	if !strings.Contains(string(out), "id='cart-items'") {
+		t.Error("the partials not overridden are gone")
+	}
+
+	// Removing the override goes back to the built-in header.
+	if err := os.Remove(filepath.Join(dir, "partials", "header.html")); err != nil {
+		t.Fatal(err)
+	}
+	if !initHTMLFiles() {
+		t.Error("the removed override went unnoticed")
+	}
+	out, err = defaultStore.renderPage("index", htmlTemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(out), "<h1>Shop</h1>") {
+		t.Error("the built-in header did not come back")
+	}
+}
+
+// A theme can add a stylesheet of its own, which is served like any asset.
+func TestThemeAddsAStylesheet(t *testing.T) {
+	keepTheme(t)
+	dir := writeTheme(t, map[string]string{
+		"brand.css":  "h1 { color: gold; }",
+		"theme.json": `{"pages": {"index": {"title": "Tubes", "styles": ["shop.css", "brand.css"]}, "complete": {"styles": []}}}`,
+	})
+	f.Theme = dir
+	if err := loadThemes(); err != nil {
+		t.Fatal(err)
+	}
+	out, err := defaultStore.renderPage("index", htmlTemplateData{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := regexp.MustCompile(`href='(/assets/[^']+\.css)'`).FindAllStringSubmatch(string(out), -1)
+	if len(links) != 2 || !strings.Contains(links[0][1], "/shop.") || !strings.Contains(links[1][1], "/brand.") {
+		t.Fatalf("stylesheets = %v, want shop then brand", links)
+	}
+	if !strings.Contains(string(out), "<title>Tubes</title>") {
+		t.Error("the title from theme.json is not used")
+	}
+	w := getAsset(t, links[1][1], nil)
+	if w.Code != http.StatusOK || w.Body.String() != "h1 { color: gold; }" {
+		t.Errorf("%s: %d %q", links[1][1], w.Code, w.Body.String())
+	}
+}
+
+func TestBrokenThemeIsReportedPerPage(t *testing.T) {
+	keepTheme(t)
+	dir := writeTheme(t, map[string]string{
+		"theme.json":          `{"pages": {"index": {"styles": ["missing.css"]}, "complete": {}}}`,
+		"pages/complete.html": `{{define "content"}}{{.Page.Nope}}{{end}}`,
+	})
+	f.Theme = dir
+	if err := loadThemes(); err != nil {
+		t.Fatal(err)
+	}
+	errs := defaultStore.checkTheme()
+	if len(errs) != 2 {
+		t.Fatalf("got %v, want one error for each page", errs)
+	}
+	if !strings.Contains(errs[1].Error(), "missing.css") {
+		t.Errorf("%v does not name the missing stylesheet", errs[1])
+	}
+}
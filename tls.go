@@ -0,0 +1,158 @@
+//go:build !wasm
+
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// certReloader hands the TLS handshake the certificate in TLSCERT and TLSKEY
+// as they are now, so that a renewed one is served without a restart. The
+// files are looked at on each handshake, which costs two stats; they are
+// read again only when one of them has changed.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	certInfo os.FileInfo
+	keyInfo  os.FileInfo
+}
+
+// changed tells whether the file now is other than it was, without reading
+// it: renewals mostly put a new file in place, and otherwise rewrite it.
+func changed(was, now os.FileInfo) bool {
+	return was == nil || !os.SameFile(was, now) || !was.ModTime().Equal(now.ModTime()) || was.Size() != now.Size()
+}
+
+// newCertReloader loads the certificate, failing if it cannot: a server that
+// starts without one would fail every handshake.
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	r := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// reload reads the pair again if either file has changed since it was last
+// tried. A pair that does not load leaves the certificate already loaded in
+// use, and is not tried again until one of the files changes once more; a
+// renewal that writes the certificate and then the key passes through such
+// a state.
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return fmt.Errorf("TLSCERT: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return fmt.Errorf("TLSKEY: %w", err)
+	}
+	if r.cert != nil && !changed(r.certInfo, certInfo) && !changed(r.keyInfo, keyInfo) {
+		return nil
+	}
+	r.certInfo, r.keyInfo = certInfo, keyInfo
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("%s and %s: %w", r.certFile, r.keyFile, err)
+	}
+	r.cert = &cert
+	if leaf := cert.Leaf; leaf != nil {
+		log.Printf("loaded the certificate for %s from %s, valid until %s", strings.Join(leaf.DNSNames, ", "), r.certFile, leaf.NotAfter.Format(time.DateOnly))
+	}
+	return nil
+}
+
+// GetCertificate is the tls.Config hook.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.reload(); err != nil {
+		log.Printf("keeping the certificate already loaded: %v", err)
+	}
+	return r.cert, nil
+}
+
+// tlsConfig is the TLS the server speaks when TLSCERT is set.
+func tlsConfig(certs *certReloader) *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: certs.GetCertificate,
+	}
+}
+
+// hstsMiddleware tells browsers to use https for this host for maxAge,
+// however it is linked to. It is only added when the server itself speaks
+// TLS: a proxy in front that does is where the header belongs otherwise.
+func hstsMiddleware(maxAge time.Duration) gin.HandlerFunc {
+	value := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	return func(c *gin.Context) {
+		c.Writer.Header().Set("Strict-Transport-Security", value)
+		c.Next()
+	}
+}
+
+// redirectToHTTPS answers every request with a redirect to the same url over
+// https on port. 308 keeps the method and body, so a form posted to the
+// http url is not turned into a GET.
+func redirectToHTTPS(port int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.Trim(host, "[]")
+		if host == "" {
+			http.Error(w, "no Host header to redirect to", http.StatusBadRequest)
+			return
+		}
+		if port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(port))
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		w.Header().Set("Connection", "close")
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
+
+// checkTLS reports what in the TLS settings would stop serve starting.
+func checkTLS() []error {
+	var errs []error
+	if (f.TLSCert == "") != (f.TLSKey == "") {
+		errs = append(errs, errors.New("TLSCERT and TLSKEY: set both or neither"))
+	} else if f.TLSCert != "" {
+		if _, err := tls.LoadX509KeyPair(f.TLSCert, f.TLSKey); err != nil {
+			errs = append(errs, fmt.Errorf("TLSCERT and TLSKEY: %w", err))
+		}
+	}
+	if f.RedirectPort != 0 {
+		switch {
+		case f.TLSCert == "":
+			errs = append(errs, errors.New("REDIRECTPORT: set, but there is no https to redirect to without TLSCERT"))
+		case f.RedirectPort < 1 || f.RedirectPort > 65535:
+			errs = append(errs, fmt.Errorf("REDIRECTPORT: %d is not a port", f.RedirectPort))
+		case f.RedirectPort == f.WebPort && f.Listen == "":
+			errs = append(errs, fmt.Errorf("REDIRECTPORT: %d is WEBPORT too", f.RedirectPort))
+		}
+	}
+	if f.HSTSMaxAge < 0 {
+		errs = append(errs, fmt.Errorf("HSTSMAXAGE: %v is negative", f.HSTSMaxAge))
+	} else if f.HSTSMaxAge > 0 && f.TLSCert == "" {
+		errs = append(errs, errors.New("HSTSMAXAGE: set, but it is only sent with TLSCERT; set it on the proxy that speaks https instead"))
+	}
+	return errs
+}
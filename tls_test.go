@@ -0,0 +1,166 @@
+//go:build !wasm
+
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// writeCert writes a self-signed certificate for name, and its key, to
+// certFile and keyFile.
+func writeCert(t *testing.T, name, certFile, keyFile string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedName(t *testing.T, r *certReloader) string {
+	t.Helper()
+	cert, err := r.GetCertificate(nil)
+	if err != nil || cert == nil || cert.Leaf == nil {
+		t.Fatalf("no certificate: %v", err)
+	}
+	return cert.Leaf.DNSNames[0]
+}
+
+// ── certificates ─────────────────────────────────────────────────────────────
+
+func TestARenewedCertificateIsServedWithoutARestart(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, "old.example.com", certFile, keyFile)
+	r, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r); got != "old.example.com" {
+		t.Fatalf("serving %s", got)
+	}
+
+	// Half a renewal: the new certificate is there but its key is not.
+	newCert, newKey := filepath.Join(dir, "new.pem"), filepath.Join(dir, "newkey.pem")
+	writeCert(t, "new.example.com", newCert, newKey)
+	if err := os.Rename(newCert, certFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r); got != "old.example.com" {
+		t.Errorf("serving %s from a mismatched pair", got)
+	}
+	if err := os.Rename(newKey, keyFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r); got != "new.example.com" {
+		t.Errorf("serving %s after the renewal", got)
+	}
+
+	if err := os.Remove(certFile); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedName(t, r); got != "new.example.com" {
+		t.Errorf("serving %s with the file gone", got)
+	}
+}
+
+func TestTheServerWillNotStartWithoutACertificate(t *testing.T) {
+	dir := t.TempDir()
+	if _, err := newCertReloader(filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")); err == nil || !strings.Contains(err.Error(), "TLSCERT") {
+		t.Errorf("err = %v, want one naming TLSCERT", err)
+	}
+}
+
+// ── redirect and HSTS ────────────────────────────────────────────────────────
+
+func TestHTTPIsRedirectedToTheSameURLOverHTTPS(t *testing.T) {
+	for _, tc := range []struct {
+		port       int
+		host, want string
+	}{
+		{8443, "shop.example.com:8080", "https://shop.example.com:8443/p/VT-1?ref=x"},
+		{443, "shop.example.com", "https://shop.example.com/p/VT-1?ref=x"},
+		{443, "[::1]:80", "https://[::1]/p/VT-1?ref=x"},
+		{8443, "[::1]:80", "https://[::1]:8443/p/VT-1?ref=x"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/p/VT-1?ref=x", nil)
+		req.Host = tc.host
+		w := httptest.NewRecorder()
+		redirectToHTTPS(tc.port).ServeHTTP(w, req)
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tc.want {
+			t.Errorf("%s to port %d: %d %s, want %s", tc.host, tc.port, w.Code, w.Header().Get("Location"), tc.want)
+		}
+	}
+}
+
+func TestHSTSIsSentWithEveryResponse(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(hstsMiddleware(365 * 24 * time.Hour))
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/missing", nil))
+	if got := w.Header().Get("Strict-Transport-Security"); got != "max-age=31536000" {
+		t.Errorf("Strict-Transport-Security = %q", got)
+	}
+}
+
+func TestCheckTLSNamesEachBadSetting(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.TLSCert, f.TLSKey, f.RedirectPort, f.HSTSMaxAge, f.Listen = "", "key.pem", 80, time.Hour, ""
+	joined := ""
+	for _, err := range checkTLS() {
+		joined += err.Error() + "\n"
+	}
+	for _, want := range []string{"TLSCERT and TLSKEY: set both", "REDIRECTPORT", "HSTSMAXAGE"} {
+		if !strings.Contains(joined, want) {
+			t.Errorf("no complaint about %s in:\n%s", want, joined)
+		}
+	}
+
+	dir := t.TempDir()
+	f.TLSCert, f.TLSKey, f.WebPort, f.RedirectPort = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem"), 8443, 8080
+	writeCert(t, "shop.example.com", f.TLSCert, f.TLSKey)
+	if errs := checkTLS(); len(errs) != 0 {
+		t.Errorf("a good config reported %v", errs)
+	}
+	f.RedirectPort = 8443
+	if errs := checkTLS(); len(errs) != 1 {
+		t.Errorf("got %v, want REDIRECTPORT being WEBPORT reported", errs)
+	}
+}
@@ -0,0 +1,129 @@
+//go:build !wasm
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// compilers parses the COMPILER setting: go or tinygo for every entrypoint,
+// and entrypoint=go or entrypoint=tinygo for one of them, separated by commas.
+// What it gives back is the compiler wanted for each name in wasmFiles.
+func compilers(spec string) (map[string]string, error) {
+	def := "tinygo"
+	per := map[string]string{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, compiler, found := strings.Cut(item, "=")
+		if !found {
+			name, compiler = "", name
+		}
+		name, compiler = strings.TrimSpace(name), strings.TrimSpace(compiler)
+		if compiler != "go" && compiler != "tinygo" {
+			return nil, fmt.Errorf("COMPILER: %q: the compiler is go or tinygo", item)
+		}
+		if name == "" {
+			def = compiler
+			continue
+		}
+		known := false
+		for i := range wasmFiles {
+			known = known || wasmFiles[i].Name == name
+		}
+		if !known {
+			return nil, fmt.Errorf("COMPILER: %s is not a wasm entrypoint", name)
+		}
+		per[name] = compiler
+	}
+	want := map[string]string{}
+	for i := range wasmFiles {
+		want[wasmFiles[i].Name] = def
+		if c, ok := per[wasmFiles[i].Name]; ok {
+			want[wasmFiles[i].Name] = c
+		}
+	}
+	return want, nil
+}
+
+// tinygoRoot asks tinygo where it is installed, which honours TINYGOROOT, or
+// is empty when there is no tinygo to ask.
+func tinygoRoot() string {
+	out, err := exec.Command("tinygo", "env", "TINYGOROOT").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// goWasmExec is the wasm_exec.js of the Go installation at root. Go 1.24
+// moved it from misc/wasm to lib/wasm; whichever is there is the one.
+func goWasmExec(root string) string {
+	lib := filepath.Join(root, "lib", "wasm", "wasm_exec.js")
+	for _, p := range []string{lib, filepath.Join(root, "misc", "wasm", "wasm_exec.js")} {
+		if _, err := os.Stat(p); err == nil {
+			return p
+		}
+	}
+	return lib
+}
+
+// selectCompilers decides which compiler builds each entrypoint, and points
+// jsFiles at the wasm_exec.js that goes with each. An entrypoint that wants
+// tinygo where there is none is built with go instead, and served the go
+// wasm_exec.js to match: the two runtimes are not interchangeable.
+func selectCompilers(spec string) error {
+	want, err := compilers(spec)
+	if err != nil {
+		return err
+	}
+	troot := ""
+	for i := range wasmFiles {
+		if wasmFiles[i].Cmp && want[wasmFiles[i].Name] == "tinygo" {
+			troot = tinygoRoot()
+			break
+		}
+	}
+	jsFiles[wasmExecJS(false)].Name = goWasmExec(goroot())
+	if troot != "" {
+		jsFiles[wasmExecJS(true)].Name = filepath.Join(troot, "targets", "wasm_exec.js")
+	}
+	for i := range wasmFiles {
+		tiny := want[wasmFiles[i].Name] == "tinygo"
+		if tiny && troot == "" && wasmFiles[i].Cmp {
+			log.Printf("tinygo is not installed; compiling %s with go instead", wasmFiles[i].Name)
+			tiny = false
+		}
+		wasmFiles[i].Tiny = tiny
+	}
+	return nil
+}
+
+// compilerName is what manifest.json calls the compiler of an entrypoint.
+func compilerName(tiny bool) string {
+	if tiny {
+		return "tinygo"
+	}
+	return "go"
+}
+
+// wasmExecInUse lists the indices into jsFiles of the wasm_exec.js files the
+// entrypoints being built need.
+func wasmExecInUse() []int {
+	var idx []int
+	for i := range wasmFiles {
+		if js := wasmExecJS(wasmFiles[i].Tiny); wasmFiles[i].Cmp && !slices.Contains(idx, js) {
+			idx = append(idx, js)
+		}
+	}
+	slices.Sort(idx)
+	return idx
+}
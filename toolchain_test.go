@@ -0,0 +1,152 @@
+//go:build !wasm
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// ── compiler selection ───────────────────────────────────────────────────────
+
+// keepToolchain puts the compiler of each entrypoint and the paths of the
+// wasm_exec.js files back as they were.
+func keepToolchain(t *testing.T) {
+	t.Helper()
+	tiny := make([]bool, len(wasmFiles))
+	for i := range wasmFiles {
+		tiny[i] = wasmFiles[i].Tiny
+	}
+	names := []string{jsFiles[0].Name, jsFiles[1].Name}
+	t.Cleanup(func() {
+		for i := range tiny {
+			wasmFiles[i].Tiny = tiny[i]
+		}
+		jsFiles[0].Name, jsFiles[1].Name = names[0], names[1]
+	})
+}
+
+// fakeTinygo puts a tinygo on PATH that answers `tinygo env TINYGOROOT` with
+// root, or takes every tinygo off PATH when root is empty. go stays on it.
+func fakeTinygo(t *testing.T, root string) {
+	t.Helper()
+	bin := t.TempDir()
+	if goBin, err := filepath.Abs(filepath.Join(goroot(), "bin", "go")); err == nil {
+		_ = os.Symlink(goBin, filepath.Join(bin, "go")) //nolint:errcheck // without it goroot falls back to the runtime's
+	}
+	if root != "" {
+		script := "#!/bin/sh\necho " + root + "\n"
+		if err := os.WriteFile(filepath.Join(bin, "tinygo"), []byte(script), 0o755); err != nil { //nolint:gosec // it has to be executable
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", bin)
+}
+
+func TestCompilerSpecDefaultsAndOverrides(t *testing.T) {
+	for spec, want := range map[string]map[string]string{
+		"":                             {"checkout_wasm.go": "tinygo", "complete/complete_wasm.go": "tinygo"},
+		"go":                           {"checkout_wasm.go": "go", "complete/complete_wasm.go": "go"},
+		"complete/complete_wasm.go=go": {"checkout_wasm.go": "tinygo", "complete/complete_wasm.go": "go"},
+		"go, checkout_wasm.go=tinygo":  {"checkout_wasm.go": "tinygo", "complete/complete_wasm.go": "go"},
+	} {
+		got, err := compilers(spec)
+		if err != nil {
+			t.Errorf("%q: %v", spec, err)
+			continue
+		}
+		for name, c := range want {
+			if got[name] != c {
+				t.Errorf("%q: %s = %q, want %q", spec, name, got[name], c)
+			}
+		}
+	}
+	for _, bad := range []string{"gccgo", "checkout_wasm.go=clang", "nothere.go=go"} {
+		if _, err := compilers(bad); err == nil {
+			t.Errorf("%q was accepted", bad)
+		}
+	}
+}
+
+func TestGoWasmExecPrefersLibOverMisc(t *testing.T) {
+	root := t.TempDir()
+	misc := filepath.Join(root, "misc", "wasm", "wasm_exec.js")
+	lib := filepath.Join(root, "lib", "wasm", "wasm_exec.js")
+	for _, p := range []string{misc, lib} {
+		if err := os.MkdirAll(filepath.Dir(p), 0o750); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.WriteFile(misc, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := goWasmExec(root); got != misc {
+		t.Errorf("with only misc/wasm: %s", got)
+	}
+	if err := os.WriteFile(lib, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if got := goWasmExec(root); got != lib {
+		t.Errorf("with both: %s", got)
+	}
+}
+
+func TestTinygoFallsBackToGoWhenNotInstalled(t *testing.T) {
+	keepToolchain(t)
+	fakeTinygo(t, "")
+	if err := selectCompilers("tinygo"); err != nil {
+		t.Fatal(err)
+	}
+	for i := range wasmFiles {
+		if wasmFiles[i].Cmp && wasmFiles[i].Tiny {
+			t.Errorf("%s is still compiled with tinygo", wasmFiles[i].Name)
+		}
+	}
+	if got := wasmExecInUse(); len(got) != 1 || got[0] != wasmExecJS(false) {
+		t.Errorf("wasm_exec.js in use = %v, want only go's", got)
+	}
+}
+
+func TestTinygoRootLocatesItsWasmExec(t *testing.T) {
+	keepToolchain(t)
+	fakeTinygo(t, "/opt/tinygo")
+	if err := selectCompilers("tinygo,complete/complete_wasm.go=go"); err != nil {
+		t.Fatal(err)
+	}
+	if want := filepath.Join("/opt/tinygo", "targets", "wasm_exec.js"); jsFiles[wasmExecJS(true)].Name != want {
+		t.Errorf("tinygo wasm_exec.js = %s, want %s", jsFiles[wasmExecJS(true)].Name, want)
+	}
+	for i := range wasmFiles {
+		if want := wasmFiles[i].Name != "complete/complete_wasm.go"; wasmFiles[i].Tiny != want {
+			t.Errorf("%s tiny = %v, want %v", wasmFiles[i].Name, wasmFiles[i].Tiny, want)
+		}
+	}
+	if got := wasmExecInUse(); len(got) != 2 {
+		t.Errorf("wasm_exec.js in use = %v, want both", got)
+	}
+}
+
+func TestManifestPicksTheWasmExecOfEachEntrypoint(t *testing.T) {
+	keepToolchain(t)
+	dist := fstest.MapFS{
+		manifestName:                    {Data: []byte(`{"checkout.wasm": "go", "complete.wasm": "go"}`)},
+		wasmExecName(wasmExecJS(false)): {Data: []byte("// go exec")},
+	}
+	for i := range wasmFiles {
+		wasmFiles[i].Tiny = true
+		dist[wasmName(wasmFiles[i].Name)] = &fstest.MapFile{Data: []byte("\x00asm")}
+	}
+	if err := loadPrebuilt(dist); err != nil {
+		t.Fatal(err)
+	}
+	for i := range wasmFiles {
+		if wasmFiles[i].Cmp && wasmFiles[i].Tiny {
+			t.Errorf("%s was left as tinygo", wasmFiles[i].Name)
+		}
+	}
+	if got := string(readFile(jsFiles, wasmExecJS(false))); got != "// go exec" {
+		t.Errorf("go wasm_exec.js = %q", got)
+	}
+}
@@ -0,0 +1,269 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// The most each route that takes JSON will read of a request body. A cart
+// is small; an order carries the cart and the rest of the shopper's local
+// storage with it.
+const (
+	intentBodyLimit = 16 * KB
+	orderBodyLimit  = 64 * KB
+	refundBodyLimit = 4 * KB
+)
+
+// maxAmount is the most Stripe will charge in one payment, $999,999.99 in
+// cents, and so the most an item or a cart can come to.
+const maxAmount = 99_999_999
+
+// maxItemID bounds an item's id. The shipping line's carries the address.
+const maxItemID = 1 * KB
+
+// fieldError is what is wrong with one field of a request: its path, as in
+// items[2].quantity, and the problem. A problem with the body as a whole has
+// no field.
+type fieldError struct {
+	Field   string `json:"field,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// limitBody stops a request body being read past limit bytes.
+func limitBody(limit int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit)
+		c.Next()
+	}
+}
+
+// bindStrict decodes the request's JSON body into v, which must be all there
+// is: a field v has no place for, a value of the wrong type or anything after
+// it is an error, as is a body over its route's limit. What is decoded is
+// then checked with v's validate. Whatever is wrong is answered with a 400,
+// or a 413, listing each problem, and bindStrict reports false.
+func bindStrict(c *gin.Context, v interface{ validate() []fieldError }) bool {
+	dec := json.NewDecoder(c.Request.Body)
+	dec.DisallowUnknownFields()
+	err := dec.Decode(v)
+	if err == nil && dec.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("more than one JSON value")
+	}
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		rejectInvalid(c, http.StatusRequestEntityTooLarge, []fieldError{{Problem: fmt.Sprintf("the body is larger than %d bytes", tooLarge.Limit)}})
+		return false
+	case err != nil:
+		rejectInvalid(c, http.StatusBadRequest, []fieldError{decodeError(err)})
+		return false
+	}
+	if errs := v.validate(); len(errs) > 0 {
+		rejectInvalid(c, http.StatusBadRequest, errs)
+		return false
+	}
+	return true
+}
+
+// decodeError says what a decoding error means in terms of the request.
+func decodeError(err error) fieldError {
+	var syntax *json.SyntaxError
+	var typ *json.UnmarshalTypeError
+	switch {
+	case errors.Is(err, io.EOF):
+		return fieldError{Problem: "the body is empty"}
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		return fieldError{Problem: "the body is not valid JSON: it ends too soon"}
+	case errors.As(err, &syntax):
+		return fieldError{Problem: fmt.Sprintf("the body is not valid JSON at byte %d: %s", syntax.Offset, strings.TrimPrefix(syntax.Error(), "json: "))}
+	case errors.As(err, &typ):
+		return fieldError{Field: fieldPath(typ.Field), Problem: "must be " + jsonKind(typ.Type)}
+	case strings.HasPrefix(err.Error(), `json: unknown field "`):
+		return fieldError{Field: strings.TrimSuffix(strings.TrimPrefix(err.Error(), `json: unknown field "`), `"`), Problem: "is not a field of this request"}
+	}
+	return fieldError{Problem: strings.TrimPrefix(err.Error(), "json: ")}
+}
+
+// fieldPath writes the indexes in a path encoding/json gives, items.0.amount,
+// the way the rest of the problems do, items[0].amount.
+func fieldPath(path string) string {
+	var b strings.Builder
+	for i, part := range strings.Split(path, ".") {
+		switch _, err := strconv.Atoi(part); {
+		case err == nil:
+			b.WriteString("[" + part + "]")
+		case i > 0:
+			b.WriteString("." + part)
+		default:
+			b.WriteString(part)
+		}
+	}
+	return b.String()
+}
+
+// jsonKind is what a value of t looks like in JSON.
+func jsonKind(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "true or false"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "a whole number"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	}
+	return "an object"
+}
+
+func rejectInvalid(c *gin.Context, status int, errs []fieldError) {
+	slog.WarnContext(c.Request.Context(), "Invalid request", "path", c.Request.URL.Path, "problems", describeFieldErrors(errs))
+	body := errorBody(c, "invalid request: "+describeFieldErrors(errs))
+	body["fields"] = errs
+	c.AbortWithStatusJSON(status, body)
+}
+
+// describeFieldErrors is the problems as one line, for the shopper.
+func describeFieldErrors(errs []fieldError) string {
+	parts := make([]string, len(errs))
+	for i, e := range errs {
+		parts[i] = strings.TrimSpace(e.Field + " " + e.Problem)
+	}
+	return strings.Join(parts, "; ")
+}
+
+// paymentIntentRequest is the cart /create-payment-intent charges for.
+type paymentIntentRequest struct {
+	Items []item `json:"items"`
+}
+
+func (r *paymentIntentRequest) validate() []fieldError {
+	var errs []fieldError
+	switch {
+	case len(r.Items) == 0:
+		errs = append(errs, fieldError{"items", "is empty"})
+	case len(r.Items) > f.MaxItems:
+		errs = append(errs, fieldError{"items", fmt.Sprintf("has more than %d lines", f.MaxItems)})
+	}
+	var total int64
+	for i, it := range r.Items {
+		field := fmt.Sprintf("items[%d]", i)
+		errs = append(errs, checkItemID(field+".id", it.Id)...)
+		errs = append(errs, checkQuantity(field+".quantity", float64(it.Qty))...)
+		if it.Amount < 1 || it.Amount > maxAmount {
+			errs = append(errs, fieldError{field + ".amount", fmt.Sprintf("must be from 1 to %d", maxAmount)})
+			continue
+		}
+		total += it.Amount
+	}
+	if total > maxAmount {
+		errs = append(errs, fieldError{"items", fmt.Sprintf("add up to more than %d", maxAmount)})
+	}
+	return errs
+}
+
+// orderRequest is an order /submit-order records: the payment it was paid
+// with and everything the shopper's browser kept in local storage, the cart
+// and the shipping details among it. Only the cart is looked at here; the
+// rest is kept as it came.
+type orderRequest struct {
+	LocalStorageData map[string]interface{} `json:"localStorageData"`
+	PaymentIntentId  string                 `json:"paymentIntentId"`
+}
+
+func (r *orderRequest) validate() []fieldError {
+	var errs []fieldError
+	if !piidPattern.MatchString(r.PaymentIntentId) {
+		errs = append(errs, fieldError{"paymentIntentId", "is not a payment intent id"})
+	}
+	if r.LocalStorageData == nil {
+		return append(errs, fieldError{"localStorageData", "is missing"})
+	}
+	cart, ok := r.LocalStorageData["cartItems"]
+	if !ok {
+		return errs
+	}
+	lines, ok := cart.([]interface{})
+	if !ok {
+		return append(errs, fieldError{"localStorageData.cartItems", "must be a list"})
+	}
+	if len(lines) > f.MaxItems {
+		errs = append(errs, fieldError{"localStorageData.cartItems", fmt.Sprintf("has more than %d lines", f.MaxItems)})
+	}
+	for i, l := range lines {
+		field := fmt.Sprintf("localStorageData.cartItems[%d]", i)
+		line, ok := l.(map[string]interface{})
+		if !ok {
+			errs = append(errs, fieldError{field, "must be an object"})
+			continue
+		}
+		id, _ := line["id"].(string) //nolint:errcheck // not a string is reported as missing
+		errs = append(errs, checkItemID(field+".id", id)...)
+		qty, ok := line["quantity"].(float64)
+		if !ok {
+			errs = append(errs, fieldError{field + ".quantity", "must be a whole number"})
+			continue
+		}
+		errs = append(errs, checkQuantity(field+".quantity", qty)...)
+	}
+	return errs
+}
+
+func (r *refundRequest) validate() []fieldError {
+	var errs []fieldError
+	if r.Amount < 0 || r.Amount > maxAmount {
+		errs = append(errs, fieldError{"amount", fmt.Sprintf("must be from 0, all of what is left, to %d", maxAmount)})
+	}
+	if len(r.Restock) > f.MaxItems {
+		errs = append(errs, fieldError{"restock", fmt.Sprintf("has more than %d lines", f.MaxItems)})
+	}
+	for id, n := range r.Restock {
+		errs = append(errs, checkQuantity("restock."+id, float64(n))...)
+	}
+	return errs
+}
+
+func checkItemID(field, id string) []fieldError {
+	switch {
+	case id == "":
+		return []fieldError{{field, "is missing"}}
+	case len(id) > maxItemID:
+		return []fieldError{{field, fmt.Sprintf("is longer than %d bytes", maxItemID)}}
+	}
+	return nil
+}
+
+func checkQuantity(field string, qty float64) []fieldError {
+	if qty < 1 || qty > float64(f.MaxQuantity) || qty != math.Trunc(qty) {
+		return []fieldError{{field, fmt.Sprintf("must be a whole number from 1 to %d", f.MaxQuantity)}}
+	}
+	return nil
+}
+
+// checkLimits reports a MAXITEMS or MAXQUANTITY that would refuse every
+// cart.
+func checkLimits() []error {
+	var errs []error
+	if f.MaxItems < 1 {
+		errs = append(errs, fmt.Errorf("MAXITEMS: %d, but a cart has at least one item", f.MaxItems))
+	}
+	if f.MaxQuantity < 1 {
+		errs = append(errs, fmt.Errorf("MAXQUANTITY: %d, but an item is bought at least once", f.MaxQuantity))
+	}
+	return errs
+}
@@ -0,0 +1,141 @@
+//go:build !wasm
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// bind posts body to a route that binds it strictly into v, limited to
+// limit bytes, and returns the status and the problems listed.
+func bind(t *testing.T, v interface{ validate() []fieldError }, limit int64, body string) (int, []fieldError) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.POST("/", limitBody(limit), func(c *gin.Context) {
+		if bindStrict(c, v) {
+			c.Status(http.StatusNoContent)
+		}
+	})
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body)))
+	var resp struct {
+		Error  string
+		Fields []fieldError
+	}
+	if w.Code != http.StatusNoContent {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("%v: %s", err, w.Body)
+		}
+		if !strings.HasPrefix(resp.Error, "invalid request: ") {
+			t.Errorf("error = %q", resp.Error)
+		}
+	}
+	return w.Code, resp.Fields
+}
+
+// fields is the field of each problem, for comparing.
+func fields(errs []fieldError) string {
+	var names []string
+	for _, e := range errs {
+		names = append(names, e.Field)
+	}
+	return strings.Join(names, ",")
+}
+
+// ── decoding ─────────────────────────────────────────────────────────────────
+
+func TestBodiesAreDecodedStrictly(t *testing.T) {
+	for _, tc := range []struct {
+		body, field, problem string
+	}{
+		{``, "", "empty"},
+		{`{"items":[`, "", "ends too soon"},
+		{`{"items":}`, "", "byte 10"},
+		{`{"items":[{"id":"a","amount":100,"quantity":1}],"coupon":"FREE"}`, "coupon", "not a field"},
+		{`{"items":[{"id":"a","amount":100,"quantity":1,"price":1}]}`, "price", "not a field"},
+		{`{"items":[{"id":"a","amount":"100","quantity":1}]}`, "items[0].amount", "a whole number"},
+		{`{"items":{}}`, "items", "a list"},
+		{`{"items":[{"id":"a","amount":100,"quantity":1}]} {}`, "", "more than one"},
+	} {
+		code, errs := bind(t, &paymentIntentRequest{}, intentBodyLimit, tc.body)
+		if code != http.StatusBadRequest || len(errs) != 1 || !strings.HasSuffix(errs[0].Field, tc.field) || !strings.Contains(errs[0].Problem, tc.problem) {
+			t.Errorf("%s: %d %+v", tc.body, code, errs)
+		}
+	}
+}
+
+func TestABodyOverItsLimitIsRefused(t *testing.T) {
+	body := `{"items":[{"id":"` + strings.Repeat("a", 200) + `","amount":100,"quantity":1}]}`
+	if code, errs := bind(t, &paymentIntentRequest{}, 100, body); code != http.StatusRequestEntityTooLarge || len(errs) != 1 || !strings.Contains(errs[0].Problem, "100 bytes") {
+		t.Errorf("%d %+v", code, errs)
+	}
+	if code, _ := bind(t, &paymentIntentRequest{}, intentBodyLimit, body); code != http.StatusNoContent {
+		t.Errorf("under the limit: %d", code)
+	}
+}
+
+// ── validation ───────────────────────────────────────────────────────────────
+
+// Every bad field is listed, not just the first.
+func TestACartIsBounded(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.MaxItems, f.MaxQuantity = 3, 10
+	code, errs := bind(t, &paymentIntentRequest{}, intentBodyLimit, `{"items":[
+		{"id":"a","amount":100,"quantity":1},
+		{"id":"","amount":100,"quantity":11},
+		{"id":"c","amount":0,"quantity":2},
+		{"id":"d","amount":100,"quantity":1}]}`)
+	if want := "items,items[1].id,items[1].quantity,items[2].amount"; code != http.StatusBadRequest || fields(errs) != want {
+		t.Errorf("%d %s, want %s", code, fields(errs), want)
+	}
+	if _, errs := bind(t, &paymentIntentRequest{}, intentBodyLimit, `{"items":[]}`); fields(errs) != "items" {
+		t.Errorf("empty cart: %+v", errs)
+	}
+	if _, errs := bind(t, &paymentIntentRequest{}, intentBodyLimit, `{"items":[{"id":"a","amount":99999999,"quantity":1},{"id":"b","amount":1,"quantity":1}]}`); fields(errs) != "items" {
+		t.Errorf("over Stripe's most: %+v", errs)
+	}
+}
+
+func TestAnOrdersCartIsChecked(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.MaxItems, f.MaxQuantity = 50, 10
+	code, _ := bind(t, &orderRequest{}, orderBodyLimit, `{"paymentIntentId":"pi_1","localStorageData":{"theme":"dark","cartItems":[{"id":"a","amount":100,"quantity":2}]}}`)
+	if code != http.StatusNoContent {
+		t.Errorf("good order: %d", code)
+	}
+	code, errs := bind(t, &orderRequest{}, orderBodyLimit, `{"paymentIntentId":"../pi_1","localStorageData":{"cartItems":[{"id":"a","quantity":2.5},"x",{"quantity":1}]}}`)
+	want := "paymentIntentId,localStorageData.cartItems[0].quantity,localStorageData.cartItems[1],localStorageData.cartItems[2].id"
+	if code != http.StatusBadRequest || fields(errs) != want {
+		t.Errorf("%d %s, want %s", code, fields(errs), want)
+	}
+	if _, errs := bind(t, &orderRequest{}, orderBodyLimit, `{"paymentIntentId":"pi_1"}`); fields(errs) != "localStorageData" {
+		t.Errorf("no storage: %+v", errs)
+	}
+}
+
+func TestARefundIsChecked(t *testing.T) {
+	if code, errs := bind(t, &refundRequest{}, refundBodyLimit, `{"amount":-5,"restock":{"VT-1":0},"everything":true}`); code != http.StatusBadRequest || fields(errs) != "everything" {
+		t.Errorf("%d %+v", code, errs)
+	}
+	if _, errs := bind(t, &refundRequest{}, refundBodyLimit, `{"amount":-5,"restock":{"VT-1":0}}`); fields(errs) != "amount,restock.VT-1" {
+		t.Errorf("%+v", errs)
+	}
+}
+
+func TestCheckLimitsNamesEachBadSetting(t *testing.T) {
+	saved := f
+	defer func() { f = saved }()
+	f.MaxItems, f.MaxQuantity = 0, -1
+	if errs := checkLimits(); len(errs) != 2 || !strings.Contains(errs[0].Error(), "MAXITEMS") || !strings.Contains(errs[1].Error(), "MAXQUANTITY") {
+		t.Errorf("errs = %v", errs)
+	}
+}
@@ -0,0 +1,196 @@
+//go:build !wasm
+
+package main
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// debounce is how long the sources have to be quiet before a rebuild starts.
+// An editor saving a file is several events — a write, a rename, a chmod —
+// and a checkout or a formatter touches many files at once; one rebuild
+// covers them all.
+const debounce = 150 * time.Millisecond
+
+// wasmSources lists the files a wasm entrypoint is built from: every Go and
+// embedded file of every package it imports that is not part of the standard
+// library, not just the entry file itself.
+func wasmSources(name string) ([]string, error) {
+	cmd := exec.Command("go", "list", "-deps", "-f",
+		`{{if not .Standard}}{{$d := .Dir}}{{range .GoFiles}}{{$d}}/{{.}}
+{{end}}{{range .EmbedFiles}}{{$d}}/{{.}}
+{{end}}{{end}}`, name)
+	cmd.Env = append(os.Environ(), "GOOS=js", "GOARCH=wasm")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+	srcs := []string{"go.mod"}
+	if abs, err := filepath.Abs("go.mod"); err == nil {
+		srcs[0] = abs
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if line != "" {
+			srcs = append(srcs, filepath.Clean(line))
+		}
+	}
+	return srcs, nil
+}
+
+// sourceSet maps each watched file to what has to be redone when it changes:
+// the pages it is one of, and the wasm entrypoints it is a source of.
+type sourceSet struct {
+	html map[string]int
+	wasm map[string][]int
+}
+
+func watchedSources() sourceSet {
+	s := sourceSet{html: map[string]int{}, wasm: map[string][]int{}}
+	for i := range htmlFiles {
+		if abs, err := filepath.Abs(htmlFiles[i].Name); err == nil {
+			s.html[abs] = i
+		}
+	}
+	for i := range wasmFiles {
+		if !wasmFiles[i].Cmp {
+			continue
+		}
+		srcs, err := wasmSources(wasmFiles[i].Name)
+		if err != nil {
+			// Most likely it does not compile right now. The entry file
+			// is enough to see it being fixed; the rest are found then.
+			log.Printf("listing the sources of %s: %v", wasmFiles[i].Name, err)
+			abs, _ := filepath.Abs(wasmFiles[i].Name) //nolint:errcheck // an unresolved path is still worth watching for
+			srcs = []string{abs}
+		}
+		for _, src := range srcs {
+			s.wasm[src] = append(s.wasm[src], i)
+		}
+	}
+	return s
+}
+
+// watch adds every directory the sources are in. Watching directories rather
+// than files is what sees an editor that saves by writing a new file and
+// renaming it over the old one.
+func (s sourceSet) watch(w *fsnotify.Watcher) {
+	dirs := map[string]bool{}
+	for src := range s.html {
+		dirs[filepath.Dir(src)] = true
+	}
+	for src := range s.wasm {
+		dirs[filepath.Dir(src)] = true
+	}
+	for dir := range dirs {
+		if _, err := os.Stat(dir); err != nil {
+			continue // a theme directory nothing is overridden in
+		}
+		if err := w.Add(dir); err != nil {
+			log.Printf("watching %s: %v", dir, err)
+			watchErrors.inc()
+		}
+	}
+}
+
+// watchSources rebuilds whatever a change to the sources affects, once they
+// have settled. Each rebuild is made beside the one being served and swapped
+// in when it is done, so pages keep loading from the last good build while
+// the next one compiles. Without inotify it falls back to polling. It
+// returns when ctx is done.
+func watchSources(ctx context.Context) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Printf("cannot watch for changes, polling instead: %v", err)
+		watchErrors.inc()
+		pollSources(ctx)
+		return
+	}
+	defer w.Close() //nolint:errcheck // only reached when the watcher has already failed
+	srcs := watchedSources()
+	srcs.watch(w)
+
+	changed := map[string]bool{}
+	timer := time.NewTimer(debounce)
+	timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-w.Events:
+			if !ok {
+				return
+			}
+			if ev.Has(fsnotify.Chmod) && !ev.Has(fsnotify.Write) {
+				continue
+			}
+			if _, html := srcs.html[ev.Name]; html || len(srcs.wasm[ev.Name]) > 0 {
+				changed[ev.Name] = true
+				timer.Reset(debounce)
+			}
+		case err, ok := <-w.Errors:
+			if !ok {
+				return
+			}
+			log.Printf("watching sources: %v", err)
+			watchErrors.inc()
+		case <-timer.C:
+			rebuild(srcs, changed)
+			changed = map[string]bool{}
+			// A rebuild is when imports come and go, so the sources are
+			// listed again after each.
+			srcs = watchedSources()
+			srcs.watch(w)
+		}
+	}
+}
+
+// rebuild redoes each page and wasm entrypoint that one of the changed files
+// belongs to, each once however many of its files changed.
+func rebuild(srcs sourceSet, changed map[string]bool) {
+	html, wasm := map[int]bool{}, map[int]bool{}
+	for name := range changed {
+		if i, ok := srcs.html[name]; ok {
+			html[i] = true
+		}
+		for _, i := range srcs.wasm[name] {
+			wasm[i] = true
+		}
+	}
+	for i := range html {
+		if err := reloadHTML(i); err != nil {
+			log.Printf("Failed to read html file %s: %v", htmlFiles[i].Name, err)
+		}
+	}
+	var idx []int
+	for i := range wasm {
+		idx = append(idx, i)
+	}
+	_ = inParallel(idx, func(i int) error { rebuildWasm(i); return nil }) //nolint:errcheck // rebuildWasm keeps its own errors
+	notifyReload()
+}
+
+// pollSources is the way changes were found before there was a watcher:
+// every second, by modification time. It only sees the entry files.
+func pollSources(ctx context.Context) {
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		html := initHTMLFiles()
+		if initFiles() || html {
+			notifyReload()
+		}
+	}
+}
@@ -0,0 +1,81 @@
+//go:build !wasm
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// ── sources ──────────────────────────────────────────────────────────────────
+
+// The watcher covers the whole package an entrypoint is built from, and the
+// module file that decides what its imports resolve to.
+func TestWasmSourcesIncludeTheEntryAndGoMod(t *testing.T) {
+	srcs, err := wasmSources("checkout_wasm.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"checkout_wasm.go", "go.mod"} {
+		abs, _ := filepath.Abs(want) //nolint:errcheck // the working directory exists
+		if !slices.Contains(srcs, abs) {
+			t.Errorf("%s is not among the sources %v", abs, srcs)
+		}
+	}
+	for _, src := range srcs {
+		if filepath.Base(src) == "server.go" {
+			t.Errorf("a host-only file is listed as a wasm source: %s", src)
+		}
+	}
+}
+
+// ── rebuilds ─────────────────────────────────────────────────────────────────
+
+func TestRebuildRereadsOnlyWhatChanged(t *testing.T) {
+	saved := [2]struct {
+		name string
+		data []byte
+	}{{htmlFiles[0].Name, htmlFiles[0].Data}, {htmlFiles[1].Name, htmlFiles[1].Data}}
+	defer func() {
+		for i, s := range saved {
+			htmlFiles[i].Name, htmlFiles[i].Data = s.name, s.data
+		}
+	}()
+	dir := t.TempDir()
+	for i, body := range []string{"new index", "new complete"} {
+		htmlFiles[i].Name = filepath.Join(dir, filepath.Base(saved[i].name))
+		htmlFiles[i].Data = []byte("old")
+		if err := os.WriteFile(htmlFiles[i].Name, []byte(body), 0o600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	srcs := sourceSet{html: map[string]int{htmlFiles[0].Name: 0, htmlFiles[1].Name: 1}}
+	rebuild(srcs, map[string]bool{htmlFiles[0].Name: true})
+	if got := string(readFile(htmlFiles, 0)); got != "new index" {
+		t.Errorf("the changed page = %q", got)
+	}
+	if got := string(readFile(htmlFiles, 1)); got != "old" {
+		t.Errorf("an unchanged page was reread: %q", got)
+	}
+}
+
+// A page that cannot be read mid-save keeps being served as it was, when the
+// built-in theme has no copy of it to fall back to.
+func TestReloadHTMLKeepsTheLastCopyOnFailure(t *testing.T) {
+	name, data, rel := htmlFiles[0].Name, htmlFiles[0].Data, htmlFiles[0].Theme
+	defer func() { htmlFiles[0].Name, htmlFiles[0].Data, htmlFiles[0].Theme = name, data, rel }()
+	htmlFiles[0].Name = filepath.Join(t.TempDir(), "gone.html")
+	htmlFiles[0].Data = []byte("last good")
+	htmlFiles[0].Theme = "gone.html"
+	if err := reloadHTML(0); err == nil {
+		t.Error("reading a missing file succeeded")
+	}
+	if got := string(readFile(htmlFiles, 0)); got != "last good" {
+		t.Errorf("Data = %q", got)
+	}
+	// The lock was given back, or this would hang.
+	htmlFiles[0].Mu.Lock()
+	htmlFiles[0].Mu.Unlock() //nolint:staticcheck // an empty critical section is the point
+}